@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// backupDone is set once the -f tarball has been backed up, so an
+// invocation modifying it twice keeps the version it started from.
+var backupDone bool
+
+// backupName returns the name of the next backup of p for -backup: p.bak
+// for simple backups, p.~N~ for numbered ones, and for existing, numbered
+// backups when there already are some.
+func backupName(p, mode string) (string, error) {
+	switch mode {
+	case "simple", "never":
+		return p + ".bak", nil
+	case "numbered", "t", "existing", "nil":
+	default:
+		return "", fmt.Errorf("Invalid -backup mode %q; use simple, numbered or existing", mode)
+	}
+	last := 0
+	matches, _ := filepath.Glob(p + ".~*~")
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(m, p+".~"), "~"))
+		if err == nil && n > last {
+			last = n
+		}
+	}
+	if last == 0 && (mode == "existing" || mode == "nil") {
+		return p + ".bak", nil
+	}
+	return fmt.Sprintf("%s.~%d~", p, last+1), nil
+}
+
+// backupTarball keeps the -f tarball as it is before -a, -u, -d or -A
+// modify it. Hard links are used when they can be, as the rewriting
+// operations replace the tarball rather than write into it; -a and -A
+// write in place, so inPlace makes a copy instead.
+func backupTarball(inPlace bool) error {
+	if bakMode == "" || dryRun || backupDone {
+		return nil
+	}
+	name, err := backupName(*tfile, bakMode)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(*tfile); os.IsNotExist(err) {
+		return nil
+	}
+	backupDone = true
+	os.Remove(name)
+	if !inPlace && os.Link(*tfile, name) == nil {
+		return nil
+	}
+	if err := copyFile(*tfile, name); err != nil {
+		return fmt.Errorf("Error backing up the tarball: %s", err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pedroalbanese/tar/pkg/tarball"
+)
+
+// compressor returns a writer compressing to w in format, as detected by
+// sniff, so a rewritten tarball keeps its compression.
+func compressor(format string, w io.Writer) (io.WriteCloser, error) {
+	switch format {
+	case "gzip":
+		return newGzipWriter(w, threads), nil
+	case "zlib":
+		return zlib.NewWriter(w), nil
+	case "xz":
+		return newFilterWriter([]string{"xz", fmt.Sprintf("-T%d", threads)}, w)
+	case "zstd":
+		return newFilterWriter(append([]string{"zstd", fmt.Sprintf("-T%d", threads)}, zstdDictArgs()...), w)
+	}
+	return newFilterWriter([]string{format}, w)
+}
+
+// compressedTarball reports whether format, as detected by sniff, is a
+// tarball compressed by a program compressor can run, and not another kind
+// of archive read as a tarball, such as a zip file, which -A cannot write.
+func compressedTarball(format string) bool {
+	switch format {
+	case "", "gzip", "bzip2", "zlib", "xz", "zstd", "lz4":
+		return true
+	}
+	return false
+}
+
+// addTarballs copies the members of the named tarballs, which may be
+// compressed, to a.
+func addTarballs(a *tarball.Archiver, paths []string) error {
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		in, done, err := decompress(f)
+		if err == nil {
+			err = a.AddTarball(in)
+		}
+		if err == nil {
+			err = done()
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Error adding %s: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// catenate adds the members of the tarballs in paths to the -f tarball. A
+// plain tarball is appended to in place; a compressed one is rewritten
+// with the same compression.
+func catenate(paths []string) error {
+	if dryRun {
+		a := tarball.NewArchiver(ioutil.Discard)
+		a.Report = reporter(os.Stdout, "append")
+		return addTarballs(a, paths)
+	}
+
+	f, err := os.Open(*tfile)
+	if err != nil {
+		return err
+	}
+	r, head, err := peek(f, len(encMagic))
+	if err == nil && string(head) == encMagic {
+		err = fmt.Errorf("Cannot add to an encrypted tarball")
+	}
+	var format string
+	if err == nil {
+		_, format, err = sniff(r)
+	}
+	if err == nil && !compressedTarball(format) {
+		err = fmt.Errorf("Cannot add to the %s archive %s", format, *tfile)
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if format == "" {
+		a, err := tarball.OpenAppend(*tfile)
+		if err != nil {
+			return err
+		}
+		a.Report = reporter(os.Stdout, "append")
+		a.Sync = fsyncF
+		if err := addTarballs(a, paths); err != nil {
+			a.Close()
+			return err
+		}
+		return a.Close()
+	}
+
+	out, err := tarball.CreateAtomic(*tfile)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+	comp, err := compressor(format, out)
+	if err != nil {
+		return err
+	}
+	a := tarball.NewArchiver(comp)
+	if err := addTarballs(a, []string{*tfile}); err != nil {
+		return err
+	}
+	a.Report = reporter(os.Stdout, "append")
+	if err := addTarballs(a, paths); err != nil {
+		return err
+	}
+	if err := a.Close(); err != nil {
+		return err
+	}
+	if err := comp.Close(); err != nil {
+		return err
+	}
+	return out.Commit()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pedroalbanese/tar/pkg/tarball"
+)
+
+func TestCatenateRefusesArchives(t *testing.T) {
+	tests := []struct {
+		format string
+		head   string
+	}{
+		{"ar", tarball.ArMagic},
+		{"cpio", tarball.CpioNewcMagic},
+		{"rpm", tarball.RPMMagic},
+		{"zip", "PK\x03\x04"},
+	}
+	dir, err := ioutil.TempDir("", "tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(saved string) { *tfile = saved }(*tfile)
+	added := filepath.Join(dir, "added.tar")
+	if err := ioutil.WriteFile(added, make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		*tfile = filepath.Join(dir, tt.format)
+		archive := []byte(tt.head + strings.Repeat("\x00", 1024))
+		if err := ioutil.WriteFile(*tfile, archive, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := catenate([]string{added})
+		if err == nil || !strings.HasPrefix(err.Error(), "Cannot add to") {
+			t.Errorf("%s: got %v, want a refusal", tt.format, err)
+		}
+		if data, _ := ioutil.ReadFile(*tfile); string(data) != string(archive) {
+			t.Errorf("%s: the archive changed", tt.format)
+		}
+	}
+}
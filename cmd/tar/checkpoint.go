@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordSize is the size of a tar record, 20 blocks of 512 bytes, in
+// which -checkpoint counts.
+const recordSize = 20 * 512
+
+// defaultCheckpoint is the number of records between checkpoints when
+// -checkpoint is given without one.
+const defaultCheckpoint = 10
+
+// checkpointFlag is a flag.Value for -checkpoint, which may be given alone
+// or with a number of records.
+type checkpointFlag struct {
+	n *int64
+}
+
+func (f checkpointFlag) IsBoolFlag() bool { return true }
+
+func (f checkpointFlag) String() string {
+	if f.n == nil || *f.n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(*f.n, 10)
+}
+
+func (f checkpointFlag) Set(value string) error {
+	if value == "true" {
+		*f.n = defaultCheckpoint
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("Invalid number of records %q", value)
+	}
+	*f.n = n
+	return nil
+}
+
+// checkpoint runs the -checkpoint-action actions every so many records
+// read or written, as GNU tar does, for long jobs to show they are alive.
+type checkpoint struct {
+	every   int64
+	actions []string
+	// op is "read" or "write", and command the subcommand, such as "x".
+	op      string
+	command string
+	bytes   int64
+	n       int64
+}
+
+// parseCheckpointActions checks the -checkpoint-action values, which
+// default to echo.
+func parseCheckpointActions(actions []string) ([]string, error) {
+	if len(actions) == 0 {
+		return []string{"echo"}, nil
+	}
+	for _, a := range actions {
+		name := a
+		if i := strings.IndexByte(a, '='); i >= 0 {
+			name = a[:i]
+		}
+		switch name {
+		case "bell", "dot", ".", "echo", "ttyout", "exec", "totals":
+		case "sleep":
+			if _, err := strconv.Atoi(strings.TrimPrefix(a, "sleep=")); err != nil {
+				return nil, fmt.Errorf("Invalid checkpoint action %q: expected sleep=seconds", a)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid checkpoint action %q", a)
+		}
+	}
+	return actions, nil
+}
+
+// add counts n more bytes, running the actions at every checkpoint passed.
+func (c *checkpoint) add(n int) {
+	c.bytes += int64(n)
+	for c.bytes >= (c.n+1)*c.every*recordSize {
+		c.n++
+		c.run()
+	}
+}
+
+// skip counts n bytes passed over at once, running the actions a single
+// time when checkpoints were passed.
+func (c *checkpoint) skip(n int64) {
+	c.bytes += n
+	if reached := c.bytes / (c.every * recordSize); reached > c.n {
+		c.n = reached
+		c.run()
+	}
+}
+
+func (c *checkpoint) run() {
+	for _, a := range c.actions {
+		name, arg := a, ""
+		if i := strings.IndexByte(a, '='); i >= 0 {
+			name, arg = a[:i], a[i+1:]
+		}
+		switch name {
+		case "bell":
+			c.tty("\a")
+		case "dot", ".":
+			fmt.Fprint(os.Stderr, ".")
+		case "echo":
+			if arg == "" {
+				arg = "%s checkpoint %u"
+			}
+			fmt.Fprintf(os.Stderr, "tar: %s\n", c.expand(arg))
+		case "ttyout":
+			c.tty(c.expand(arg))
+		case "totals":
+			done := "written"
+			if c.op == "read" {
+				done = "read"
+			}
+			fmt.Fprintf(os.Stderr, "Total bytes %s: %d (%s)\n", done, c.bytes, humanSize(c.bytes))
+		case "sleep":
+			secs, _ := strconv.Atoi(arg)
+			time.Sleep(time.Duration(secs) * time.Second)
+		case "exec":
+			c.exec(arg)
+		}
+	}
+}
+
+// expand replaces %u in s with the checkpoint number, %s with the
+// operation, %T with the bytes done so far and %% with %.
+func (c *checkpoint) expand(s string) string {
+	op := "Write"
+	if c.op == "read" {
+		op = "Read"
+	}
+	return strings.NewReplacer(
+		"%u", strconv.FormatInt(c.n, 10),
+		"%s", op,
+		"%T", humanSize(c.bytes),
+		"%%", "%",
+	).Replace(s)
+}
+
+// tty writes s to the terminal, or to standard error without one.
+func (c *checkpoint) tty(s string) {
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		fmt.Fprint(tty, s)
+		tty.Close()
+		return
+	}
+	fmt.Fprint(os.Stderr, s)
+}
+
+// exec runs command with the shell and waits for it. It finds the
+// checkpoint number, the tarball and the subcommand in TAR_CHECKPOINT,
+// TAR_ARCHIVE and TAR_SUBCOMMAND.
+func (c *checkpoint) exec(command string) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"TAR_CHECKPOINT="+strconv.FormatInt(c.n, 10),
+		"TAR_ARCHIVE="+*tfile,
+		"TAR_SUBCOMMAND=-"+c.command,
+	)
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running the checkpoint action %q: %s\n", command, err)
+	}
+}
+
+type checkpointWriter struct {
+	w io.Writer
+	c *checkpoint
+}
+
+func (cw *checkpointWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.c.add(n)
+	return n, err
+}
+
+type checkpointReader struct {
+	r   io.Reader
+	c   *checkpoint
+	pos int64
+}
+
+// newCheckpointReader returns a reader counting what is read from r for
+// c, which is an io.Seeker when r is one.
+func newCheckpointReader(r io.Reader, c *checkpoint) io.Reader {
+	cr := &checkpointReader{r: r, c: c}
+	if _, ok := r.(io.Seeker); ok {
+		return checkpointSeeker{cr}
+	}
+	return cr
+}
+
+func (cr *checkpointReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.pos += int64(n)
+	cr.c.add(n)
+	return n, err
+}
+
+// checkpointSeeker lets a checkpointReader stand in for a seekable
+// tarball. The records sought past count as read.
+type checkpointSeeker struct {
+	*checkpointReader
+}
+
+func (cs checkpointSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := cs.r.(io.Seeker).Seek(offset, whence)
+	if err == nil {
+		if pos > cs.pos {
+			cs.c.skip(pos - cs.pos)
+		}
+		cs.pos = pos
+	}
+	return pos, err
+}
+
+// newCheckpoint returns the checkpoint for the -checkpoint records read
+// or written by the subcommand, or nil without -checkpoint.
+func newCheckpoint(op, command string) *checkpoint {
+	if ckptN == 0 {
+		return nil
+	}
+	return &checkpoint{every: ckptN, actions: ckptActs, op: op, command: command}
+}
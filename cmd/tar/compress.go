@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pedroalbanese/tar/pkg/tarball"
+)
+
+// magic lists the signatures used to recognise compressed tarballs. Formats
+// without a decoder in the standard library are handed to the program of
+// the same name, run with -d. Brotli streams have no signature and need -I.
+var magic = []struct {
+	format string
+	sig    []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"bzip2", []byte("BZh")},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	// Zip files are read as tarballs of their entries; the second
+	// signature is that of an empty one.
+	{"zip", []byte("PK\x03\x04")},
+	{"zip", []byte("PK\x05\x06")},
+	// So are ar archives, such as Debian packages.
+	{"ar", []byte(tarball.ArMagic)},
+	{"cpio", []byte(tarball.CpioNewcMagic)},
+	{"cpio", []byte(tarball.CpioCRCMagic)},
+	{"cpio", []byte(tarball.CpioOdcMagic)},
+	// RPM packages hold a compressed cpio archive.
+	{"rpm", []byte(tarball.RPMMagic)},
+}
+
+// peek reads up to n bytes from the start of r. It returns a reader that
+// still yields the whole stream, which is r itself, rewound, when r can
+// seek.
+func peek(r io.Reader, n int) (io.Reader, []byte, error) {
+	seeker, _ := r.(io.Seeker)
+	if seeker != nil {
+		if _, err := seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+	head := make([]byte, n)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("Error reading the tarball: %s", err)
+	}
+	head = head[:n]
+	if seeker != nil {
+		if _, err := seeker.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return nil, nil, fmt.Errorf("Error seeking in the tarball: %s", err)
+		}
+	} else {
+		r = io.MultiReader(bytes.NewReader(head), r)
+	}
+	return r, head, nil
+}
+
+// sniff tells how the tarball read from r is compressed, returning a
+// reader that still yields the whole stream and the format name, empty for
+// a plain tarball.
+func sniff(r io.Reader) (io.Reader, string, error) {
+	r, head, err := peek(r, 512)
+	if err != nil {
+		return nil, "", err
+	}
+	n := len(head)
+	// A ustar header is conclusive, whatever its member name starts with.
+	if n == 512 && bytes.HasPrefix(head[257:], []byte("ustar")) {
+		return r, "", nil
+	}
+	for _, m := range magic {
+		if bytes.HasPrefix(head, m.sig) {
+			return r, m.format, nil
+		}
+	}
+	if n >= 2 && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return r, "zlib", nil
+	}
+	return r, "", nil
+}
+
+// decompressor returns a reader yielding the tarball inside r, compressed
+// as format, and a function to call once done with it. A gzip tarball
+// with an index of its blocks can be seeked in.
+func decompressor(r io.Reader, format string) (io.Reader, func() error, error) {
+	if format == "" {
+		return r, func() error { return nil }, nil
+	}
+	seeker, ok := r.(io.ReadSeeker)
+	if ok && format == "gzip" && tarIndex != nil && len(tarIndex.Blocks) > 0 {
+		br, err := newBlockReader(seeker, tarIndex.Blocks)
+		if err != nil {
+			return nil, nil, err
+		}
+		return br, br.Close, nil
+	}
+	return openDecompressor(r, format)
+}
+
+func openDecompressor(r io.Reader, format string) (io.Reader, func() error, error) {
+	nop := func() error { return nil }
+	switch format {
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading the gzip stream: %s", err)
+		}
+		return zr, zr.Close, nil
+	case "bzip2":
+		return bzip2.NewReader(r), nop, nil
+	case "zlib":
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading the zlib stream: %s", err)
+		}
+		return zr, zr.Close, nil
+	case "ar":
+		as := tarball.ArStream(r)
+		return as, as.Close, nil
+	case "cpio":
+		cs := tarball.CpioStream(r)
+		return cs, cs.Close, nil
+	case "rpm":
+		payload, err := tarball.RPMPayload(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, pformat, err := sniff(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		in, done, err := decompressor(payload, pformat)
+		if err != nil {
+			return nil, nil, err
+		}
+		cs := tarball.CpioStream(in)
+		return cs, func() error {
+			cs.Close()
+			return done()
+		}, nil
+	case "zip":
+		ra, size, err := readerAt(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		zs, err := tarball.ZipStream(ra, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zs, zs.Close, nil
+	}
+	args := []string{format}
+	switch format {
+	case "xz":
+		// xz is the only one of these decoders that can use several threads.
+		args = append(args, fmt.Sprintf("-T%d", threads))
+	case "zstd":
+		if zstdLong > 0 {
+			args = append(args, fmt.Sprintf("--long=%d", zstdLong))
+		}
+		args = append(args, zstdDictArgs()...)
+	}
+	fr, err := newFilterReader(args, r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error decompressing the %s tarball (use -I to name another program): %s", format, err)
+	}
+	return fr, fr.Close, nil
+}
+
+// readerAt returns r for random access, as zip files need, with its size.
+// Files are read in place; other streams are read into memory.
+func readerAt(r io.Reader) (io.ReaderAt, int64, error) {
+	if v, ok := r.(verifiedFile); ok {
+		r = v.tarballFile
+	}
+	if f, ok := r.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			return f, info.Size(), nil
+		}
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error reading the zip file: %s", err)
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Encrypted tarballs start with a header of the magic, a random salt, the
+// scrypt parameters log2 N, r and p in a byte each and a zero byte, and
+// the chunk size. The stream follows as chunks
+// sealed with AES-256-GCM, each authenticating the header, with a nonce
+// made of the chunk number and a flag marking the last chunk, so chunks
+// cannot be reordered and truncation is detected.
+const (
+	encMagic      = "TARAES2\x00"
+	encHeaderSize = len(encMagic) + 16 + 4 + 4
+	encChunkSize  = 64 << 10
+	// The scrypt parameters written, which take 128 MiB to derive a key.
+	encLogN = 17
+	encR    = 8
+	encP    = 1
+	// encMaxLogN and encMaxP bound the parameters read from a header,
+	// which could otherwise have tar allocate and work without end.
+	encMaxLogN = 20
+	encMaxP    = 4
+)
+
+func newAEAD(pass, header []byte) (cipher.AEAD, error) {
+	salt := header[len(encMagic) : len(encMagic)+16]
+	params := header[len(encMagic)+16 : len(encMagic)+20]
+	logN, r, p := int(params[0]), int(params[1]), int(params[2])
+	if logN < encLogN || logN > encMaxLogN || r != encR || p < 1 || p > encMaxP || params[3] != 0 {
+		return nil, fmt.Errorf("Invalid encryption header: unsupported scrypt parameters N=2^%d, r=%d, p=%d", logN, r, p)
+	}
+	block, err := aes.NewCipher(scrypt(pass, salt, logN, r, p, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts the tarball stream for -e.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint64
+}
+
+func newEncryptWriter(w io.Writer, pass []byte) (*encryptWriter, error) {
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	if _, err := rand.Read(header[len(encMagic) : len(encMagic)+16]); err != nil {
+		return nil, err
+	}
+	copy(header[len(encMagic)+16:], []byte{encLogN, encR, encP, 0})
+	binary.BigEndian.PutUint32(header[len(encMagic)+20:], encChunkSize)
+	aead, err := newAEAD(pass, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	ew.buf = append(ew.buf, p...)
+	// The last chunk is sealed differently, so keep at least one chunk
+	// back until Close.
+	for len(ew.buf) > encChunkSize {
+		if err := ew.seal(ew.buf[:encChunkSize], false); err != nil {
+			return 0, err
+		}
+		ew.buf = ew.buf[encChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (ew *encryptWriter) seal(chunk []byte, last bool) error {
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.counter, last), chunk, ew.header)
+	ew.counter++
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (ew *encryptWriter) Close() error {
+	return ew.seal(ew.buf, true)
+}
+
+// decryptReader decrypts a tarball written by encryptWriter.
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	chunk   []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+func newDecryptReader(r io.Reader, pass []byte) (*decryptReader, error) {
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("Error reading the encryption header: %s", err)
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(encMagic)+20:])
+	if chunkSize == 0 || chunkSize > 16<<20 {
+		return nil, fmt.Errorf("Invalid encryption header")
+	}
+	aead, err := newAEAD(pass, header)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, int(chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(dr.r, dr.chunk)
+		last := err == io.ErrUnexpectedEOF
+		if err == nil {
+			_, perr := dr.r.Peek(1)
+			last = perr == io.EOF
+		} else if !last {
+			if err == io.EOF {
+				return 0, fmt.Errorf("The encrypted tarball is truncated")
+			}
+			return 0, err
+		}
+		plain, err := dr.aead.Open(dr.chunk[:0], chunkNonce(dr.counter, last), dr.chunk[:n], dr.header)
+		if err != nil {
+			return 0, fmt.Errorf("Wrong passphrase or corrupted tarball")
+		}
+		dr.counter++
+		dr.plain = plain
+		dr.done = last
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// decrypt returns the stream of r, decrypted when it starts with the
+// encryption header.
+func decrypt(r io.Reader) (io.Reader, error) {
+	r, head, err := peek(r, len(encMagic))
+	if err != nil {
+		return nil, err
+	}
+	if string(head) != encMagic {
+		return r, nil
+	}
+	pass, err := passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(r, pass)
+}
+
+// cachedPass keeps the passphrase once given, so -W can read back the
+// tarball just encrypted without asking again.
+var cachedPass []byte
+
+// passphrase reads the passphrase from -passfile, or asks for it on the
+// terminal, twice when confirm is set.
+func passphrase(confirm bool) ([]byte, error) {
+	if cachedPass != nil {
+		return cachedPass, nil
+	}
+	pass, err := readPassphrase(confirm)
+	if err != nil {
+		return nil, err
+	}
+	cachedPass = pass
+	return pass, nil
+}
+
+func readPassphrase(confirm bool) ([]byte, error) {
+	if passFile != "" {
+		data, err := ioutil.ReadFile(passFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the passphrase file: %s", err)
+		}
+		pass := bytes.TrimRight(data, "\r\n")
+		if len(pass) == 0 {
+			return nil, fmt.Errorf("The passphrase file is empty")
+		}
+		return pass, nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("No terminal to ask for the passphrase; use -passfile")
+	}
+	defer tty.Close()
+	pass, err := readPassword(tty, "Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		again, err := readPassword(tty, "Repeat passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if again != pass {
+			return nil, fmt.Errorf("The passphrases do not match")
+		}
+	}
+	if pass == "" {
+		return nil, fmt.Errorf("Empty passphrase")
+	}
+	return []byte(pass), nil
+}
+
+// readPassword prompts on tty and reads a line with echo turned off, when
+// stty is available to do so.
+func readPassword(tty *os.File, prompt string) (string, error) {
+	fmt.Fprint(tty, prompt)
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	if stty("-echo") == nil {
+		defer stty("echo")
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	fmt.Fprintln(tty)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("Error reading the passphrase: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func sealStream(t *testing.T, pass, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	ew, err := newEncryptWriter(&buf, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ew.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptAll(pass, sealed []byte) ([]byte, error) {
+	dr, err := newDecryptReader(bytes.NewReader(sealed), pass)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(dr)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	pass := []byte("passphrase")
+	for _, size := range []int{0, 1, encChunkSize, encChunkSize + 1, 3*encChunkSize - 7} {
+		plain := bytes.Repeat([]byte("tarball!"), size/8+1)[:size]
+		got, err := decryptAll(pass, sealStream(t, pass, plain))
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: the decrypted stream differs", size)
+		}
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	pass := []byte("passphrase")
+	sealed := sealStream(t, pass, make([]byte, 2*encChunkSize+100))
+	chunk := encChunkSize + 16
+	tooMany := append([]byte(nil), sealed...)
+	tooMany[len(encMagic)+16] = encMaxLogN + 1
+	tests := []struct {
+		name   string
+		pass   []byte
+		sealed []byte
+	}{
+		{"wrong passphrase", []byte("wrong"), sealed},
+		{"truncated at a chunk", pass, sealed[:encHeaderSize+2*chunk]},
+		{"truncated in a chunk", pass, sealed[:len(sealed)-1]},
+		{"truncated header", pass, sealed[:encHeaderSize-1]},
+		{"flipped bit", pass, flipBit(sealed, encHeaderSize+chunk+3)},
+		{"too costly", pass, tooMany},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decryptAll(tt.pass, tt.sealed); err == nil {
+				t.Error("the stream was decrypted")
+			}
+		})
+	}
+}
+
+func flipBit(b []byte, i int) []byte {
+	b = append([]byte(nil), b...)
+	b[i] ^= 1
+	return b
+}
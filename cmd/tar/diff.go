@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	maxDiffSize  = 1 << 20
+	maxDiffLines = 5000
+	diffContext  = 3
+)
+
+// archiveMember is what -diff-archives keeps of each member: its header,
+// a digest of its contents and, for small text members when -diff-text is
+// given, the contents themselves.
+type archiveMember struct {
+	hdr  *tar.Header
+	sum  [sha256.Size]byte
+	text []byte
+}
+
+func readArchive(tarballPath string, keepText bool) (map[string]*archiveMember, error) {
+	f, err := os.Open(tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	in, done, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]*archiveMember)
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", tarballPath, err)
+		}
+		m := &archiveMember{hdr: hdr}
+		h := sha256.New()
+		var buf bytes.Buffer
+		w := io.Writer(h)
+		if keepText && hdr.Size <= maxDiffSize {
+			w = io.MultiWriter(h, &buf)
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return nil, fmt.Errorf("Error reading %s from %s: %s", hdr.Name, tarballPath, err)
+		}
+		copy(m.sum[:], h.Sum(nil))
+		if buf.Len() > 0 && bytes.IndexByte(buf.Bytes(), 0) < 0 {
+			m.text = buf.Bytes()
+		}
+		members[strings.TrimPrefix(hdr.Name, "./")] = m
+	}
+	return members, done()
+}
+
+// memberChanges lists what differs between two versions of a member.
+func memberChanges(a, b *archiveMember) []string {
+	var changes []string
+	ha, hb := a.hdr, b.hdr
+	if ha.Typeflag != hb.Typeflag {
+		changes = append(changes, "type")
+	}
+	if ha.Size != hb.Size {
+		changes = append(changes, "size")
+	}
+	if a.sum != b.sum {
+		changes = append(changes, "contents")
+	}
+	if ha.Linkname != hb.Linkname {
+		changes = append(changes, "link target")
+	}
+	if ha.Mode != hb.Mode {
+		changes = append(changes, "mode")
+	}
+	if ha.Uid != hb.Uid || ha.Gid != hb.Gid || ha.Uname != hb.Uname || ha.Gname != hb.Gname {
+		changes = append(changes, "owner")
+	}
+	if !ha.ModTime.Equal(hb.ModTime) {
+		changes = append(changes, "mtime")
+	}
+	return changes
+}
+
+// diffArchives prints the members only in a ('-'), only in b ('+') and
+// changed between them ('~'), followed, with text set, by unified diffs of
+// the changed text members. It returns the number of differences.
+func diffArchives(pathA, pathB string, text bool) (int, error) {
+	a, err := readArchive(pathA, text)
+	if err != nil {
+		return 0, err
+	}
+	b, err := readArchive(pathB, text)
+	if err != nil {
+		return 0, err
+	}
+
+	names := make([]string, 0, len(a)+len(b))
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	count := 0
+	var diffs []string
+	for _, name := range names {
+		ma, inA := a[name]
+		mb, inB := b[name]
+		switch {
+		case !inB:
+			fmt.Printf("- %s\n", name)
+		case !inA:
+			fmt.Printf("+ %s\n", name)
+		default:
+			changes := memberChanges(ma, mb)
+			if len(changes) == 0 {
+				continue
+			}
+			fmt.Printf("~ %s: %s\n", name, strings.Join(changes, ", "))
+			if text && ma.sum != mb.sum {
+				diffs = append(diffs, name)
+			}
+		}
+		count++
+	}
+
+	for _, name := range diffs {
+		ma, mb := a[name], b[name]
+		if ma.text == nil && ma.hdr.Size > 0 || mb.text == nil && mb.hdr.Size > 0 {
+			fmt.Printf("\nBinary or large member %s differs\n", name)
+			continue
+		}
+		fmt.Println()
+		unifiedDiff(os.Stdout, name, splitLines(ma.text), splitLines(mb.text))
+	}
+	return count, nil
+}
+
+func splitLines(text []byte) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// unifiedDiff writes the differences between the lines of a and b in
+// unified format, using a longest common subsequence.
+func unifiedDiff(w io.Writer, name string, a, b []string) {
+	fmt.Fprintf(w, "--- a/%s\n+++ b/%s\n", name, name)
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		fmt.Fprintf(w, "(too many lines to diff)\n")
+		return
+	}
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', i, j})
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', i, j})
+			j++
+		}
+	}
+
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			k++
+			continue
+		}
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for idle := 0; end < len(ops) && idle <= 2*diffContext; end++ {
+			if ops[end].kind == ' ' {
+				idle++
+			} else {
+				idle = 0
+			}
+		}
+		// Trim the trailing context down to diffContext lines.
+		for end > k && ops[end-1].kind == ' ' {
+			end--
+		}
+		if end += diffContext; end > len(ops) {
+			end = len(ops)
+		}
+
+		lenA, lenB := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				lenA++
+			}
+			if op.kind != '-' {
+				lenB++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(ops[start].a, lenA), hunkRange(ops[start].b, lenB))
+		for _, op := range ops[start:end] {
+			line := ""
+			if op.kind == '+' {
+				line = b[op.b]
+			} else {
+				line = a[op.a]
+			}
+			fmt.Fprintf(w, "%c%s", op.kind, line)
+			if !strings.HasSuffix(line, "\n") {
+				fmt.Fprintf(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
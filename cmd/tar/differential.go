@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// newerThan returns a Filter for -c that lets through only the members
+// new or changed relative to the base tarball, so the result can be
+// extracted over it. Regular files of the same size and modification time,
+// rounded to the second as in ustar headers, are taken as unchanged; those
+// of the same size but another time are compared by contents. The names of
+// the members of the base tarball are returned with it.
+func newerThan(basePath string) (func(hdr *tar.Header) bool, []string, error) {
+	base, err := readArchive(basePath, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(base))
+	for name := range base {
+		names = append(names, name)
+	}
+	return func(hdr *tar.Header) bool {
+		m, ok := base[strings.TrimPrefix(hdr.Name, "./")]
+		if !ok {
+			return true
+		}
+		old := m.hdr
+		switch {
+		case old.Typeflag != hdr.Typeflag, old.Linkname != hdr.Linkname, old.Mode != hdr.Mode:
+			return true
+		case hdr.Typeflag != tar.TypeReg:
+			return false
+		case old.Size != hdr.Size:
+			return true
+		case old.ModTime.Round(time.Second).Equal(hdr.ModTime.Round(time.Second)):
+			return false
+		}
+		sum, err := fileSum(hdr.Name)
+		return err != nil || sum != m.sum
+	}, names, nil
+}
+
+func fileSum(p string) (sum [sha256.Size]byte, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// filterWriter pipes the tarball through an external compressor given with
+// -I, writing the compressed stream to the underlying writer.
+type filterWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func newFilterWriter(args []string, w io.Writer) (*filterWriter, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Empty compress program")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Error starting %s: %s", args[0], err)
+	}
+	return &filterWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (f *filterWriter) Write(p []byte) (int, error) {
+	return f.stdin.Write(p)
+}
+
+// Close ends the input and waits for the compressor to flush its output.
+func (f *filterWriter) Close() error {
+	f.stdin.Close()
+	if err := f.cmd.Wait(); err != nil {
+		return fmt.Errorf("Error running %s: %s", f.cmd.Path, err)
+	}
+	return nil
+}
+
+// filterReader decompresses a tarball by running the -I program with -d,
+// reading the compressed stream from the underlying reader.
+type filterReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+}
+
+func newFilterReader(args []string, r io.Reader) (*filterReader, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Empty compress program")
+	}
+	cmd := exec.Command(args[0], append(args[1:], "-d")...)
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Error starting %s: %s", args[0], err)
+	}
+	return &filterReader{cmd: cmd, stdout: stdout}, nil
+}
+
+func (f *filterReader) Read(p []byte) (int, error) {
+	return f.stdout.Read(p)
+}
+
+// Close drains what the tar reader left unread, such as the end-of-archive
+// padding, so the decompressor can exit cleanly, and waits for it.
+func (f *filterReader) Close() error {
+	io.Copy(ioutil.Discard, f.stdout)
+	if err := f.cmd.Wait(); err != nil {
+		return fmt.Errorf("Error running %s: %s", f.cmd.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The FUSE kernel protocol, as much of it as a read-only file system
+// needs. Requests are served one at a time.
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseReadlink    = 5
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseGetxattr    = 22
+	fuseListxattr   = 23
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+
+	fuseInHeaderSize = 40
+	fuseMaxRead      = 128 << 10
+	// fuseKeepCache lets the kernel keep the pages of files, which never
+	// change.
+	fuseKeepCache = 1 << 1
+)
+
+// fuseTTL is how long the kernel may cache names and attributes.
+const fuseTTL = 3600
+
+// mountTarball serves the -f tarball read-only at dir until interrupted
+// or unmounted.
+func mountTarball(dir string) error {
+	t, err := loadTree()
+	if err != nil {
+		return err
+	}
+	dev, err := fuseMount(dir)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fuseUnmount(dir)
+	}()
+	fmt.Fprintf(os.Stderr, "Serving %s at %s; interrupt or unmount to stop\n", *tfile, dir)
+	return t.serve(dev)
+}
+
+// fuseMount mounts a FUSE file system at dir and returns the device to
+// serve it on: directly as root, or through fusermount otherwise.
+func fuseMount(dir string) (*os.File, error) {
+	opts := "ro,nosuid,nodev,default_permissions"
+	if os.Geteuid() != 0 {
+		return fusermount(dir, opts)
+	}
+	dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening /dev/fuse: %s", err)
+	}
+	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0,default_permissions", dev.Fd())
+	if err := syscall.Mount("tar:"+*tfile, dir, "fuse.tar", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RDONLY, data); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("Error mounting at %s: %s", dir, err)
+	}
+	return dev, nil
+}
+
+// fusermount has the setuid fusermount program mount dir, which hands
+// back the device over a socket.
+func fusermount(dir, opts string) (*os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error mounting at %s: %s", dir, err)
+	}
+	local, remote := os.NewFile(uintptr(fds[0]), "fusermount"), os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+	prog, err := exec.LookPath("fusermount3")
+	if err != nil {
+		prog = "fusermount"
+	}
+	cmd := exec.Command(prog, "-o", opts+",fsname=tar:"+*tfile, "--", dir)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	remote.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error mounting at %s with %s: %s", dir, prog, err)
+	}
+	buf, oob := make([]byte, 32), make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(local.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error mounting at %s: %s", dir, err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err == nil && len(msgs) == 0 {
+		err = fmt.Errorf("no device received")
+	}
+	var rights []int
+	if err == nil {
+		rights, err = syscall.ParseUnixRights(&msgs[0])
+	}
+	if err == nil && len(rights) == 0 {
+		err = fmt.Errorf("no device received")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error mounting at %s: %s", dir, err)
+	}
+	return os.NewFile(uintptr(rights[0]), "/dev/fuse"), nil
+}
+
+func fuseUnmount(dir string) {
+	if os.Geteuid() == 0 {
+		syscall.Unmount(dir, syscall.MNT_DETACH)
+		return
+	}
+	prog, err := exec.LookPath("fusermount3")
+	if err != nil {
+		prog = "fusermount"
+	}
+	exec.Command(prog, "-u", "-z", dir).Run()
+}
+
+// serve answers the requests read from dev until the file system is
+// unmounted.
+func (t *archiveTree) serve(dev *os.File) error {
+	buf := make([]byte, fuseMaxRead+4096)
+	for {
+		n, err := syscall.Read(int(dev.Fd()), buf)
+		switch err {
+		case nil:
+		case syscall.EINTR, syscall.EAGAIN, syscall.ENOENT:
+			continue
+		case syscall.ENODEV:
+			return nil
+		default:
+			return fmt.Errorf("Error reading FUSE requests: %s", err)
+		}
+		if n < fuseInHeaderSize {
+			continue
+		}
+		req := buf[:n]
+		opcode := binary.LittleEndian.Uint32(req[4:])
+		unique := binary.LittleEndian.Uint64(req[8:])
+		nodeid := binary.LittleEndian.Uint64(req[16:])
+		out, errno := t.handle(opcode, nodeid, req[fuseInHeaderSize:])
+		switch opcode {
+		case fuseForget, fuseBatchForget, fuseInterrupt:
+			continue
+		}
+		reply := make([]byte, 16+len(out))
+		binary.LittleEndian.PutUint32(reply, uint32(len(reply)))
+		binary.LittleEndian.PutUint32(reply[4:], uint32(-int32(errno)))
+		binary.LittleEndian.PutUint64(reply[8:], unique)
+		copy(reply[16:], out)
+		// The request may have been interrupted meanwhile, which is no
+		// error.
+		if _, err := syscall.Write(int(dev.Fd()), reply); err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("Error answering FUSE requests: %s", err)
+		}
+		if opcode == fuseDestroy {
+			return nil
+		}
+	}
+}
+
+// handle answers one request with the reply payload or an error number.
+func (t *archiveTree) handle(opcode uint32, nodeid uint64, in []byte) ([]byte, syscall.Errno) {
+	if opcode == fuseInit {
+		return fuseInitReply(in), 0
+	}
+	n := t.node(nodeid)
+	switch opcode {
+	case fuseForget, fuseBatchForget, fuseInterrupt, fuseDestroy:
+		return nil, 0
+	case fuseStatfs:
+		out := make([]byte, 80)
+		binary.LittleEndian.PutUint64(out[24:], uint64(len(t.nodes)))
+		binary.LittleEndian.PutUint32(out[40:], 512)
+		binary.LittleEndian.PutUint32(out[44:], 255)
+		binary.LittleEndian.PutUint32(out[48:], 512)
+		return out, 0
+	case fuseGetxattr, fuseListxattr:
+		return nil, syscall.ENOSYS
+	}
+	if n == nil {
+		return nil, syscall.ENOENT
+	}
+	switch opcode {
+	case fuseLookup:
+		name := string(in)
+		if i := indexNUL(in); i >= 0 {
+			name = string(in[:i])
+		}
+		child := n.children[name]
+		if child == nil {
+			return nil, syscall.ENOENT
+		}
+		out := make([]byte, 40, 128)
+		binary.LittleEndian.PutUint64(out, child.ino)
+		binary.LittleEndian.PutUint64(out[16:], fuseTTL)
+		binary.LittleEndian.PutUint64(out[24:], fuseTTL)
+		return append(out, fuseAttr(child)...), 0
+	case fuseGetattr:
+		out := make([]byte, 16, 104)
+		binary.LittleEndian.PutUint64(out, fuseTTL)
+		return append(out, fuseAttr(n)...), 0
+	case fuseReadlink:
+		if n.hdr.Typeflag != tar.TypeSymlink {
+			return nil, syscall.EINVAL
+		}
+		return []byte(n.hdr.Linkname), 0
+	case fuseOpen, fuseOpendir:
+		if (opcode == fuseOpendir) != (n.children != nil) {
+			if n.children != nil {
+				return nil, syscall.EISDIR
+			}
+			return nil, syscall.ENOTDIR
+		}
+		if len(in) >= 4 && binary.LittleEndian.Uint32(in)&syscall.O_ACCMODE != syscall.O_RDONLY {
+			return nil, syscall.EROFS
+		}
+		if opcode == fuseOpen && n.hdr.Typeflag == tar.TypeReg {
+			if err := t.open(n); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return nil, syscall.EIO
+			}
+		}
+		out := make([]byte, 16)
+		binary.LittleEndian.PutUint32(out[8:], fuseKeepCache)
+		return out, 0
+	case fuseRelease:
+		if n.hdr.Typeflag == tar.TypeReg {
+			t.release(n)
+		}
+		return nil, 0
+	case fuseReleasedir:
+		return nil, 0
+	case fuseRead:
+		if len(in) < 24 {
+			return nil, syscall.EINVAL
+		}
+		off := int64(binary.LittleEndian.Uint64(in[8:]))
+		size := binary.LittleEndian.Uint32(in[16:])
+		if size > fuseMaxRead {
+			size = fuseMaxRead
+		}
+		buf := make([]byte, size)
+		k, err := t.readAt(n, buf, off)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, syscall.EIO
+		}
+		return buf[:k], 0
+	case fuseReaddir:
+		if len(in) < 24 || n.children == nil {
+			return nil, syscall.ENOTDIR
+		}
+		return t.readdir(n, int(binary.LittleEndian.Uint64(in[8:])), int(binary.LittleEndian.Uint32(in[16:]))), 0
+	}
+	return nil, syscall.ENOSYS
+}
+
+func indexNUL(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// fuseInitReply accepts the protocol version the kernel offers, up to
+// 7.31, with none of the optional features.
+func fuseInitReply(in []byte) []byte {
+	minor := uint32(31)
+	if len(in) >= 8 && binary.LittleEndian.Uint32(in[4:]) < minor {
+		minor = binary.LittleEndian.Uint32(in[4:])
+	}
+	out := make([]byte, 64)
+	binary.LittleEndian.PutUint32(out, 7)
+	binary.LittleEndian.PutUint32(out[4:], minor)
+	binary.LittleEndian.PutUint32(out[8:], fuseMaxRead)
+	binary.LittleEndian.PutUint16(out[16:], 16)
+	binary.LittleEndian.PutUint16(out[18:], 12)
+	binary.LittleEndian.PutUint32(out[20:], fuseMaxRead)
+	binary.LittleEndian.PutUint32(out[24:], 1)
+	if minor < 23 {
+		// Older kernels take the reply without the fields added since.
+		return out[:24]
+	}
+	return out
+}
+
+// fuseAttr encodes the attributes of n as struct fuse_attr.
+func fuseAttr(n *treeNode) []byte {
+	hdr := n.hdr
+	mode := uint32(hdr.Mode) & 07777
+	size := uint64(0)
+	rdev := uint32(0)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		mode |= syscall.S_IFDIR
+	case tar.TypeSymlink:
+		mode |= syscall.S_IFLNK
+		size = uint64(len(hdr.Linkname))
+	case tar.TypeChar, tar.TypeBlock:
+		mode |= syscall.S_IFCHR
+		if hdr.Typeflag == tar.TypeBlock {
+			mode = mode&^syscall.S_IFCHR | syscall.S_IFBLK
+		}
+		major, minor := uint32(hdr.Devmajor), uint32(hdr.Devminor)
+		rdev = minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	default:
+		mode |= syscall.S_IFREG
+		size = uint64(hdr.Size)
+	}
+	mtime := hdr.ModTime
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	out := make([]byte, 88)
+	le := binary.LittleEndian
+	le.PutUint64(out, n.ino)
+	le.PutUint64(out[8:], size)
+	le.PutUint64(out[16:], (size+511)/512)
+	for i := 0; i < 3; i++ {
+		le.PutUint64(out[24+8*i:], uint64(mtime.Unix()))
+		le.PutUint32(out[48+4*i:], uint32(mtime.Nanosecond()))
+	}
+	le.PutUint32(out[60:], mode)
+	le.PutUint32(out[64:], n.nlink)
+	le.PutUint32(out[68:], uint32(hdr.Uid))
+	le.PutUint32(out[72:], uint32(hdr.Gid))
+	le.PutUint32(out[76:], rdev)
+	le.PutUint32(out[80:], 4096)
+	return out
+}
+
+// readdir lists the entries of the directory n from number off on, as
+// struct fuse_dirent records fitting size bytes.
+func (t *archiveTree) readdir(n *treeNode, off, size int) []byte {
+	type entry struct {
+		name string
+		node *treeNode
+	}
+	entries := []entry{{".", n}, {"..", n}}
+	for _, name := range n.names {
+		entries = append(entries, entry{name, n.children[name]})
+	}
+	var out []byte
+	for i := off; i < len(entries); i++ {
+		e := entries[i]
+		rec := make([]byte, 24+(len(e.name)+7)&^7)
+		if len(out)+len(rec) > size {
+			break
+		}
+		binary.LittleEndian.PutUint64(rec, e.node.ino)
+		binary.LittleEndian.PutUint64(rec[8:], uint64(i+1))
+		binary.LittleEndian.PutUint32(rec[16:], uint32(len(e.name)))
+		binary.LittleEndian.PutUint32(rec[20:], fuseAttrMode(e.node)>>12)
+		copy(rec[24:], e.name)
+		out = append(out, rec...)
+	}
+	return out
+}
+
+func fuseAttrMode(n *treeNode) uint32 {
+	return binary.LittleEndian.Uint32(fuseAttr(n)[60:]) & syscall.S_IFMT
+}
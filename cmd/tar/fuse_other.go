@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// mountTarball needs FUSE, which only the Linux build speaks.
+func mountTarball(dir string) error {
+	return fmt.Errorf("-mount is only supported on Linux")
+}
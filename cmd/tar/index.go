@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pedroalbanese/tar/pkg/tarball"
+)
+
+// indexPath names the sidecar index written next to a tarball by -index.
+func indexPath(tarballPath string) string {
+	return tarballPath + ".tari"
+}
+
+// loadIndex returns the index of the -f tarball opened as ifile, or nil
+// when there is none, it was made for a different version of the file, or
+// the tarball cannot seek.
+func loadIndex(ifile tarballFile) (*tarball.Index, error) {
+	if *tfile == "-" || cprog != "" {
+		return nil, nil
+	}
+	if _, err := ifile.Seek(0, io.SeekCurrent); err != nil {
+		return nil, nil
+	}
+	data, err := readSidecar(indexPath(*tfile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ix, err := tarball.ReadIndex(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	info, err := ifile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != ix.Size {
+		return nil, nil
+	}
+	return ix, nil
+}
+
+// saveIndex completes ix with the size of the written tarball and the gzip
+// blocks of comp, if any, and writes it next to the tarball.
+func saveIndex(ix *tarball.Index, comp io.WriteCloser) error {
+	info, err := os.Stat(*tfile)
+	if err != nil {
+		return err
+	}
+	ix.Size = info.Size()
+	switch c := comp.(type) {
+	case *pgzipWriter:
+		ix.Blocks = c.blocks
+	case *gzip.Writer:
+		ix.Blocks = []tarball.IndexBlock{{Offset: 0, RawOffset: 0}}
+	}
+	return ix.Save(indexPath(*tfile))
+}
+
+// listIndexed lists the members of the tarball read from r at the
+// offsets recorded in ix, seeking over their contents instead of reading
+// them. Within a compressed block, which can only be entered at its start,
+// the stream is read through to the next member instead.
+func listIndexed(r io.Reader, seeker io.Seeker, ix *tarball.Index) error {
+	cr := &countingReader{r: r}
+	for i, entry := range ix.Entries {
+		if i == 0 || entry.Offset < cr.n || skipsBlock(ix.Blocks, cr.n, entry.Offset) {
+			if _, err := seeker.Seek(entry.Offset, io.SeekStart); err != nil {
+				return fmt.Errorf("Error seeking to %s: %s", entry.Name, err)
+			}
+			cr.n = entry.Offset
+		} else if _, err := io.CopyN(ioutil.Discard, cr, entry.Offset-cr.n); err != nil {
+			return fmt.Errorf("Error reading the tarball: %s", err)
+		}
+		hdr, err := tar.NewReader(cr).Next()
+		if err != nil {
+			return fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		if hdr.Name != entry.Name {
+			return fmt.Errorf("The index does not match the tarball at %s", entry.Name)
+		}
+		listMember(hdr)
+	}
+	return nil
+}
+
+// skipsBlock reports whether seeking from pos to off in the tar stream
+// would start decompressing at a later block than the one being read. A
+// plain tarball, without blocks, can always be seeked in.
+func skipsBlock(blocks []tarball.IndexBlock, pos, off int64) bool {
+	if len(blocks) == 0 {
+		return off != pos
+	}
+	for _, b := range blocks {
+		if b.RawOffset > pos && b.RawOffset <= off {
+			return true
+		}
+	}
+	return false
+}
+
+// countingReader tracks the offset reached in the tar stream.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// blockReader decompresses a gzip tarball written by -z, seeking to any
+// tar stream offset by restarting at the nearest block recorded in the
+// index.
+type blockReader struct {
+	src    io.ReadSeeker
+	blocks []tarball.IndexBlock
+	zr     *gzip.Reader
+}
+
+func newBlockReader(src io.ReadSeeker, blocks []tarball.IndexBlock) (*blockReader, error) {
+	br := &blockReader{src: src, blocks: blocks}
+	if _, err := br.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	return br.zr.Read(p)
+}
+
+// Seek supports offsets from the start of the tar stream only.
+func (br *blockReader) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, fmt.Errorf("Cannot seek in a compressed tarball")
+	}
+	block := br.blocks[0]
+	for _, b := range br.blocks {
+		if b.RawOffset > offset {
+			break
+		}
+		block = b
+	}
+	if _, err := br.src.Seek(block.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	var err error
+	if br.zr == nil {
+		br.zr, err = gzip.NewReader(br.src)
+	} else {
+		err = br.zr.Reset(br.src)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error reading the gzip stream: %s", err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, br.zr, offset-block.RawOffset); err != nil {
+		return 0, fmt.Errorf("Error seeking in the tarball: %s", err)
+	}
+	return offset, nil
+}
+
+func (br *blockReader) Close() error {
+	return br.zr.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// tarballLock is an advisory lock on name.lock, held while the -f tarball
+// is modified. The tarball itself cannot be locked, as rewriting it
+// replaces the file.
+type tarballLock struct {
+	path string
+	f    *os.File
+}
+
+// lockTarball locks the tarball at p, failing at once if another process
+// holds the lock. A lock file left behind by a process that died is not
+// locked, and is taken over.
+func lockTarball(p string) (*tarballLock, error) {
+	lockPath := p + ".lock"
+	for {
+		f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating the lock file: %s", err)
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s is locked by another process; use -no-lock to ignore the lock", p)
+		}
+		// The holder may have removed the file between our opening and
+		// locking it, in which case the lock is on a file no one else sees.
+		held, err1 := f.Stat()
+		current, err2 := os.Stat(lockPath)
+		if err1 == nil && err2 == nil && os.SameFile(held, current) {
+			return &tarballLock{path: lockPath, f: f}, nil
+		}
+		f.Close()
+	}
+}
+
+func (l *tarballLock) release() {
+	if l == nil {
+		return
+	}
+	if removeLockFirst {
+		os.Remove(l.path)
+		l.f.Close()
+	} else {
+		l.f.Close()
+		os.Remove(l.path)
+	}
+}
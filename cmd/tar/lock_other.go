@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package main
+
+import "os"
+
+const removeLockFirst = false
+
+// lockFile does nothing where there is no advisory locking to use.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Open files cannot be removed, so the lock file is closed first; removing
+// it then fails harmlessly if another process has opened it meanwhile.
+const removeLockFirst = false
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+)
+
+func lockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -2,33 +2,163 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/pedroalbanese/tar/pkg/tarball"
 )
 
 var (
+	catenat = flag.Bool("A", false, "add the members of the named tarballs to the -f tarball")
 	appendf = flag.Bool("a", false, "append instead of overwrite; see also -c and -u")
 	create  = flag.Bool("c", false, "create; it will overwrite the original file")
 	delete  = flag.Bool("d", false, "delete files from tarball")
 	extract = flag.Bool("x", false, "extract; see also -o")
 	fstats  = flag.Bool("s", false, "stats")
+	digest  = flag.String("print-digest", "", "print the `algorithm` (sha256 or sha512) digest of the created tarball")
 	list    = flag.Bool("l", false, "list contents of tarball")
+	diffArc = flag.Bool("diff-archives", false, "list the members added, removed or changed between the two tarballs named")
+	difftxt = flag.Bool("diff-text", false, "with -diff-archives, also print unified diffs of changed text members")
+	compare = flag.Bool("compare", false, "report members that differ from the files on disk, and with names, files missing from the tarball")
+	testArc = flag.Bool("test", false, "read the whole tarball and check that it is sound, without extracting")
+	mountAt = flag.String("mount", "", "serve the tarball as a read-only file system at the mount point `dir` until interrupted (Linux, FUSE)")
+	serveAt = flag.String("serve", "", "serve listings and contents of the tarball over HTTP at `addr` (e.g. :8080)")
+	oci     = flag.Bool("oci", false, "follow OCI image layer conventions when creating and extracting")
+	wmode   = flag.String("whiteout", "", "`mode` for .wh. entries on extract: 'remove' (default with -oci) or 'overlay'")
+	fakedb  = flag.String("fakeroot-db", "", "record ownership and devices on -x and restore them on -c using this database `file`")
+	mfile   = flag.String("manifest", "", "create from a manifest `file` of 'source => name [mode] [mtime]' lines")
 	stdout  = flag.Bool("o", false, "extract to stdout; see also -x")
+	strip   = flag.Int("strip-components", 0, "remove `N` leading path elements from member names on extract")
 	tfile   = flag.String("f", "", "tar file ('-' for stdin/stdout)")
+	flist   = flag.String("T", "", "read the names to archive from `file` ('-' for stdin)")
 	update  = flag.Bool("u", false, "update tarball; see also -c and -a")
-
-	tw *tar.Writer
-	tr *tar.Reader
+	showPrg = flag.Bool("progress", false, "show a progress bar with throughput and ETA on stderr for -c and -x")
+	verbose = flag.Bool("v", false, "verbose; print the name of every member processed")
+	vverbos = flag.Bool("vv", false, "very verbose; print the full metadata of every member processed")
+
+	absNames bool
+	dryRun   bool
+	cprog    string
+	gzipOut  bool
+	threads  int
+	zstdLong int
+	zstdDict string
+	trainOut string
+	writeIdx bool
+	encrypt  bool
+	passFile string
+	signKey  string
+	checkSig string
+	verifyW  bool
+	recoverX bool
+	volSize  int64
+	incrFile string
+	baseArc  string
+	sortMem  bool
+	bakMode  string
+	noLock   bool
+	sameOwn  bool
+	noSameOw bool
+	numOwner bool
+	uidMapF  string
+	gidMapF  string
+	uidMap   tarball.IDMap
+	gidMap   tarball.IDMap
+	ownerF   string
+	groupF   string
+	owner    *tarball.Owner
+	group    *tarball.Owner
+	mtimeF   string
+	mtime    time.Time
+	clampMt  bool
+	reprod   bool
+	sparse   bool
+	xattrs   bool
+	xattrInc stringList
+	xattrExc stringList
+	macMeta  bool
+	acls     bool
+	formatF  string
+	format   tar.Format
+	zipOut   bool
+	nested   string
+
+	tarIndex *tarball.Index
+	nullSep  bool
+	alsoTo   stringList
+	excludes stringList
+	exclFrom stringList
+	xforms   stringList
+	prefix   string
+	renames  []*tarball.Transform
+	inclRe   stringList
+	exclRe   stringList
+	nameSel  *tarball.RegexpFilter
+	ignCase  bool
+	anchorY  bool
+	anchorN  bool
+	wcSlash  bool
+	noWcSl   bool
+	matchOpt *tarball.MatchOptions
+	excVCS   bool
+	vcsIgn   bool
+	cacheTag bool
+	cacheUnd bool
+	cacheAll bool
+	caches   string
+	oneFS    bool
+	noRecurs bool
+	derefer  bool
+	hardDer  bool
+	newerF   string
+	newerMF  string
+	newer    time.Time
+	minSize  int64
+	maxSize  int64
+	sizeSel  *tarball.SizeFilter
+	typesF   string
+	typeSel  tarball.TypeFilter
+	interact bool
+	keepOld  bool
+	skipOld  bool
+	keepNew  bool
+	unlinkF  bool
+	samePerm bool
+	noSameP  bool
+	fsyncF   bool
+	bufSize  int64
+	noSpace  bool
+	resumeF  string
+	ckptN    int64
+	ckptActs stringList
+	totalsF  string
+	ignRead  bool
+	listJSON bool
+	// answers reads the answers to the questions of -w.
+	answers *bufio.Reader
+
+	fakeroot tarball.FakerootDB
+	names    []string
+	// nameList streams the -T names to -c and -a, instead of names.
+	nameList *nameReader
 )
 
 func addNumericSuffix(filename string) string {
@@ -47,331 +177,6 @@ func addNumericSuffix(filename string) string {
 	return newName
 }
 
-func walkpath(path string, f os.FileInfo, err error) error {
-	header, err := tar.FileInfoHeader(f, "")
-	if err != nil {
-		log.Fatal(path + " not found. Process aborted.")
-	}
-	header.Name = path
-	if *appendf && tw != nil {
-		if f.IsDir() {
-			header.Name = strings.TrimSuffix(path, "/")
-		} else {
-			duplicate, dupErr := findDuplicateFile(header.Name)
-			if dupErr == nil && duplicate {
-				fmt.Printf("File with the same name already exists in the tarball: %s\n", header.Name)
-				fmt.Printf("Do you want to append it? (y/n): ")
-				var response string
-				fmt.Scanln(&response)
-				if strings.ToLower(response) != "y" {
-					fmt.Printf("Skipping file: %s\n", header.Name)
-					return nil
-				}
-				newName := addNumericSuffix(header.Name)
-				header.Name = newName
-				fmt.Printf("Duplicated file renamed to: %s\n", header.Name)
-			}
-		}
-	}
-	tw.WriteHeader(header)
-	ifile, _ := os.Open(path)
-	io.Copy(tw, ifile)
-	if *tfile != "-" {
-		fmt.Fprintf(os.Stderr, "%s with %d bytes\n", path, f.Size())
-	}
-	return nil
-}
-
-func main() {
-	flag.Parse()
-
-	if *tfile == "" {
-		fmt.Printf("Usage for %[1]s: %[1]s [-x|o] [-c|a] [-d|l] [-f file] [files ...]\n", "tar")
-		flag.PrintDefaults()
-	}
-
-	if *fstats {
-		err := stats(*tfile, *tfile == "-")
-		if err != nil {
-			log.Fatalf("Error while getting statistics: %s", err)
-		}
-	}
-
-	if *list {
-		var ifile io.Reader
-		if *tfile == "-" {
-			ifile = os.Stdin
-		} else {
-			ifile, _ = os.Open(*tfile)
-		}
-
-		tr := tar.NewReader(ifile)
-		for {
-			hdr, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				log.Fatalln(err)
-			}
-			fileSize := float64(hdr.Size)
-
-			size := "bytes"
-			sizeValue := fileSize
-			if fileSize >= 1024.0 {
-				size = "KB"
-				sizeValue = fileSize / 1024.0
-			}
-			if fileSize >= 1024.0*1024.0 {
-				size = "MB"
-				sizeValue = fileSize / (1024.0 * 1024.0)
-			}
-			if fileSize >= 1024.0*1024.0*1024.0 {
-				size = "GB"
-				sizeValue = fileSize / (1024.0 * 1024.0 * 1024.0)
-			}
-
-			sizeFormat := "%.2f %s"
-			if sizeValue == float64(int64(sizeValue)) {
-				sizeFormat = "%.0f %s"
-			}
-			modTime := hdr.ModTime.Format("2006-01-02 15:04:05")
-			fmt.Printf("%s %s %s ("+sizeFormat+")\n", hdr.FileInfo().Mode(), modTime, hdr.Name, sizeValue, size)
-		}
-	}
-
-	if *delete {
-		err := deleteFromTarball(*tfile, flag.Args())
-		if err != nil {
-			log.Fatalf("Error deleting files from tarball: %s", err)
-		}
-	}
-
-	if *update {
-		err := updateTarball(*tfile, flag.Args())
-		if err != nil {
-			log.Fatalf("Error updating tarball: %s", err)
-		}
-		return
-	}
-
-	if (*extract || *stdout) && len(flag.Args()) > 0 {
-		var ifile io.Reader
-		if *tfile == "-" {
-			ifile = os.Stdin
-		} else {
-			var err error
-			ifile, err = os.Open(*tfile)
-			if err != nil {
-				log.Fatalln(err)
-			}
-		}
-		tr := tar.NewReader(ifile)
-
-		for _, arg := range flag.Args() {
-			dirs, err := filepath.Glob(arg)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if len(dirs) == 0 {
-				dirs = append(dirs, arg)
-			}
-			for _, dir := range dirs {
-				dirsToExtract := make(map[string]struct{})
-				dirsToExtract[dir] = struct{}{}
-
-				for {
-					hdr, err := tr.Next()
-					if err == io.EOF {
-						break
-					}
-					if err != nil {
-						log.Fatalln(err)
-					}
-
-					for dir := range dirsToExtract {
-						matched, err := filepath.Match(dir, hdr.Name)
-						if err != nil {
-							log.Fatal(err)
-						}
-						if matched {
-							if hdr.FileInfo().IsDir() {
-								err := extractDir(tr, hdr.Name, *stdout)
-								if err != nil {
-									log.Fatal(err)
-								}
-							} else {
-								if *stdout {
-									if _, err := io.Copy(os.Stdout, tr); err != nil {
-										log.Fatal(err)
-									}
-								} else {
-									destPath := hdr.Name
-									if strings.HasSuffix(dir, "/") {
-										destPath = path.Join(dir, path.Base(hdr.Name))
-									}
-									fi := hdr.FileInfo()
-									if fi.IsDir() {
-										if err := os.MkdirAll(destPath, fi.Mode()); err != nil {
-											log.Fatal(err)
-										}
-									} else {
-										if err := os.MkdirAll(filepath.Dir(destPath), fi.Mode()); err != nil {
-											log.Fatal(err)
-										}
-										ofile, err := os.Create(destPath)
-										if err != nil {
-											log.Fatal(err)
-										}
-										if _, err := io.Copy(ofile, tr); err != nil {
-											log.Fatal(err)
-										}
-										ofile.Close()
-										if err := os.Chmod(destPath, fi.Mode()); err != nil {
-											log.Fatal(err)
-										}
-									}
-									fmt.Println(destPath)
-								}
-							}
-						}
-					}
-				}
-				_, err = ifile.(io.Seeker).Seek(0, io.SeekStart)
-				if err != nil {
-					log.Fatal(err)
-				}
-				tr = tar.NewReader(ifile)
-			}
-		}
-		return
-	}
-
-	if (*extract || *stdout) && len(flag.Args()) == 0 {
-		var ifile io.Reader
-		if *tfile == "-" {
-			ifile = os.Stdin
-		} else {
-			var err error
-			ifile, err = os.Open(*tfile)
-			if err != nil {
-				log.Fatalln(err)
-			}
-		}
-		tr := tar.NewReader(ifile)
-
-		if *stdout == false {
-			for {
-				hdr, err := tr.Next()
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					log.Fatalln(err)
-				}
-				fi := hdr.FileInfo()
-				if fi.IsDir() {
-					if err := os.MkdirAll(hdr.Name, fi.Mode()); err != nil {
-						log.Fatalf("Error creating directory: %s", err)
-					}
-				} else {
-					if err := os.MkdirAll(filepath.Dir(hdr.Name), fi.Mode()); err != nil {
-						log.Fatalf("Error creating directory: %s", err)
-					}
-					ofile, err := os.Create(hdr.Name)
-					if err != nil {
-						log.Fatalf("Error creating file: %s", err)
-					}
-					if _, err := io.Copy(ofile, tr); err != nil {
-						log.Fatal(err)
-					}
-					ofile.Close()
-
-					if err := os.Chmod(hdr.Name, fi.Mode()); err != nil {
-						log.Fatalf("Error setting permissions: %s", err)
-					}
-
-					fmt.Println(hdr.Name)
-				}
-			}
-		}
-
-		if *stdout {
-			for {
-				_, err := tr.Next()
-				if err == io.EOF {
-					break
-				}
-				if _, err := io.Copy(os.Stdout, tr); err != nil {
-					log.Fatal(err)
-				}
-			}
-		}
-
-	} else if *appendf {
-		if _, err := os.Stat(*tfile); err == nil {
-			ofile, err := os.OpenFile(*tfile, os.O_RDWR, os.ModePerm)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			if _, err = ofile.Seek(-1024, os.SEEK_END); err != nil {
-				log.Fatalln(err)
-			}
-			tw = tar.NewWriter(ofile)
-
-			for _, incpath := range flag.Args() {
-				files, err := filepath.Glob(incpath)
-				if err != nil {
-					fmt.Println("Error getting files matching pattern:", err)
-					return
-				}
-				for _, file := range files {
-					filepath.Walk(file, walkpath)
-				}
-			}
-
-			tw.Close()
-			ofile.Close()
-		} else {
-			fmt.Fprintf(os.Stderr, "%s not found\n", *tfile)
-		}
-		if err := reorganizeTarball(*tfile); err != nil {
-			fmt.Println("Error:", err)
-		}
-
-	} else if *create {
-		if *tfile == "-" {
-			tw = tar.NewWriter(os.Stdout)
-			for _, incpath := range flag.Args() {
-				files, err := filepath.Glob(incpath)
-				if err != nil {
-					fmt.Println("Error getting files matching pattern:", err)
-					return
-				}
-				for _, file := range files {
-					filepath.Walk(file, walkpath)
-				}
-			}
-			tw.Close()
-		} else {
-			ofile, _ := os.Create(*tfile)
-			tw = tar.NewWriter(ofile)
-			for _, incpath := range flag.Args() {
-				files, err := filepath.Glob(incpath)
-				if err != nil {
-					fmt.Println("Error getting files matching pattern:", err)
-					return
-				}
-				for _, file := range files {
-					filepath.Walk(file, walkpath)
-				}
-			}
-			tw.Close()
-			ofile.Close()
-		}
-	}
-}
-
 func findDuplicateFile(filename string) (bool, error) {
 	tfile, err := os.Open(*tfile)
 	if err != nil {
@@ -405,53 +210,66 @@ func findDuplicateFile(filename string) (bool, error) {
 	return false, nil
 }
 
-func stats(tarballPath string, stdinInput bool) error {
-	var tarballFile io.ReadCloser
-	var err error
-
-	if stdinInput {
-		tarballFile = os.Stdin
-	} else {
-		tarballFile, err = os.Open(tarballPath)
-		if err != nil {
-			return fmt.Errorf("Error opening the tarball file: %s", err)
-		}
+// confirmAppend asks before appending a file whose name is already taken in
+// the tarball, storing it under a numbered name when accepted.
+func confirmAppend(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeDir {
+		header.Name = strings.TrimSuffix(header.Name, "/")
+		return true
 	}
-	defer tarballFile.Close()
-
-	tr := tar.NewReader(tarballFile)
-
-	var totalSize int64
-	fileCount := 0
-	dirCount := 0
-	symlinkCount := 0
-	otherCount := 0
-
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
+	duplicate, dupErr := findDuplicateFile(header.Name)
+	if dupErr == nil && duplicate {
+		fmt.Printf("File with the same name already exists in the tarball: %s\n", header.Name)
+		fmt.Printf("Do you want to append it? (y/n): ")
+		var response string
+		if *flist == "-" {
+			// Standard input holds the names being appended.
+			if tty, err := os.Open("/dev/tty"); err == nil {
+				fmt.Fscanln(tty, &response)
+				tty.Close()
+			}
+		} else {
+			fmt.Scanln(&response)
 		}
-		if err != nil {
-			return fmt.Errorf("Error reading the tarball header: %s", err)
+		if strings.ToLower(response) != "y" {
+			fmt.Printf("Skipping file: %s\n", header.Name)
+			return false
 		}
+		header.Name = addNumericSuffix(header.Name)
+		fmt.Printf("Duplicated file renamed to: %s\n", header.Name)
+	}
+	return true
+}
 
-		switch header.Typeflag {
-		case tar.TypeReg:
-			fileCount++
-			totalSize += header.Size
-		case tar.TypeDir:
-			dirCount++
-		case tar.TypeSymlink:
-			symlinkCount++
-		default:
-			otherCount++
+// confirm returns the -w question asking whether to action a member. It
+// is asked on standard error and answered from /dev/tty, so that the
+// tarball and the -T names can still use standard input and output.
+func confirm(action string) func(hdr *tar.Header) bool {
+	return func(hdr *tar.Header) bool {
+		if answers == nil {
+			tty, err := os.Open("/dev/tty")
+			if err != nil && (*tfile == "-" || *flist == "-") {
+				fatal("-w needs a terminal to read the answers from")
+			} else if err != nil {
+				answers = bufio.NewReader(os.Stdin)
+			} else {
+				answers = bufio.NewReader(tty)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s %s? (y/n) ", action, hdr.Name)
+		answer, err := answers.ReadString('\n')
+		if err != nil && answer == "" {
+			fatal("No answer to -w")
 		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
 	}
+}
 
+// humanSize formats a byte count with the largest fitting unit.
+func humanSize(n int64) string {
 	size := "bytes"
-	sizeValue := float64(totalSize)
-
+	sizeValue := float64(n)
 	if sizeValue >= 1024.0 {
 		size = "KB"
 		sizeValue = sizeValue / 1024.0
@@ -468,349 +286,1509 @@ func stats(tarballPath string, stdinInput bool) error {
 	if sizeValue == float64(int64(sizeValue)) {
 		sizeFormat = "%.0f %s"
 	}
+	return fmt.Sprintf(sizeFormat, sizeValue, size)
+}
 
-	fmt.Printf("Statistics for tarball : %s\n", tarballPath)
-	fmt.Printf("Total files            : %d\n", fileCount)
-	fmt.Printf("Total directories      : %d\n", dirCount)
-	fmt.Printf("Total symbolic links   : %d\n", symlinkCount)
-	fmt.Printf("Total other entries    : %d\n", otherCount)
-	fmt.Printf("Total size             : "+sizeFormat+"\n", sizeValue, size)
-
-	return nil
+// openInput opens the -f tarball, reading its volumes as one when it was
+// split with -volume-size: either base.001 or base itself may be named.
+// An http:// or https:// URL or an s3:// URI is read with Range requests.
+// Once -verify-sig has checked the tarball, it is the verified one.
+func openInput() (tarballFile, error) {
+	if verifiedInput != nil {
+		if _, err := verifiedInput.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return verifiedFile{verifiedInput}, nil
+	}
+	if *tfile == "-" {
+		return os.Stdin, nil
+	}
+	if isS3(*tfile) {
+		return openS3Input(*tfile)
+	}
+	if isRemote(*tfile) {
+		return openRemote(*tfile, nil)
+	}
+	if strings.HasSuffix(*tfile, ".001") {
+		return openVolumes(strings.TrimSuffix(*tfile, ".001"))
+	}
+	f, err := os.Open(*tfile)
+	if os.IsNotExist(err) {
+		if _, verr := os.Stat(volumeName(*tfile, 1)); verr == nil {
+			return openVolumes(*tfile)
+		}
+	}
+	return f, err
 }
 
-func extractDir(tr *tar.Reader, dirPath string, toStdout bool) error {
+// decompress returns the tarball stream read from r, decrypting it if it
+// was created with -e, passing it through the -I program when one is given
+// and otherwise detecting the compression from the first bytes, and a
+// function to call once done with it. With -nested, the stream is that of
+// the member of the tarball it names, decompressed in turn.
+func decompress(r io.Reader) (io.Reader, func() error, error) {
+	in, done, err := decompressStream(r)
+	if err != nil || nested == "" {
+		return in, done, err
+	}
+	tr := tar.NewReader(in)
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
+			done()
+			return nil, nil, fmt.Errorf("No member matching %s in the tarball", nested)
+		} else if err != nil {
+			done()
+			return nil, nil, fmt.Errorf("Error reading the tarball: %s", err)
+		}
+		if ok, _ := tarball.Match(nested, hdr.Name); ok && hdr.Typeflag == tar.TypeReg {
 			break
 		}
-		if err != nil {
-			return fmt.Errorf("Error reading the tarball header: %s", err)
+	}
+	inner, innerDone, err := decompressStream(tr)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return inner, func() error {
+		if err := innerDone(); err != nil {
+			done()
+			return err
 		}
+		return done()
+	}, nil
+}
 
-		if strings.HasPrefix(hdr.Name, dirPath) {
-			destPath := hdr.Name
-			if strings.HasSuffix(dirPath, "/") {
-				destPath = path.Join(dirPath, path.Base(hdr.Name))
-			}
-
-			fi := hdr.FileInfo()
-			if fi.IsDir() && !toStdout {
-				if err := os.MkdirAll(destPath, fi.Mode()); err != nil {
-					return fmt.Errorf("Error creating directory: %s", err)
-				}
-			} else if toStdout {
-				if _, err := io.Copy(os.Stdout, tr); err != nil {
-					return err
-				}
-			} else {
-				if err := os.MkdirAll(filepath.Dir(destPath), fi.Mode()); err != nil {
-					return fmt.Errorf("Error creating directory: %s", err)
-				}
-				ofile, err := os.Create(destPath)
-				if err != nil {
-					return fmt.Errorf("Error creating file: %s", err)
-				}
-				if _, err := io.Copy(ofile, tr); err != nil {
-					ofile.Close()
-					return err
-				}
-				ofile.Close()
-
-				if err := os.Chmod(destPath, fi.Mode()); err != nil {
-					return fmt.Errorf("Error setting permissions: %s", err)
-				}
-
-				if !toStdout {
-					fmt.Println(destPath)
-				}
-			}
+func decompressStream(r io.Reader) (io.Reader, func() error, error) {
+	r, err := decrypt(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cprog != "" {
+		fr, err := newFilterReader(filterCommand(cprog), r)
+		if err != nil {
+			return nil, nil, err
 		}
+		return fr, fr.Close, nil
 	}
-	return nil
-}
-
-func deleteFromTarball(tarballPath string, filesToDelete []string) error {
-	tarballFile, err := os.OpenFile(tarballPath, os.O_RDWR, os.ModePerm)
+	r, format, err := sniff(r)
 	if err != nil {
-		return fmt.Errorf("Error opening the Tarball file: %s", err)
+		return nil, nil, err
 	}
-	defer tarballFile.Close()
+	return decompressor(r, format)
+}
 
-	tarballData, err := ioutil.ReadAll(tarballFile)
+// verifyTarball reads back the -f tarball and compares its members with
+// the files they were made from, listing the differences on stderr.
+func verifyTarball(sources map[string]string) error {
+	ifile, err := openInput()
 	if err != nil {
-		return fmt.Errorf("Error reading the content of the tarball: %s", err)
+		return err
 	}
-	if err := tarballFile.Close(); err != nil {
-		return fmt.Errorf("Error closing the tarball file: %s", err)
+	defer ifile.Close()
+	in, done, err := decompress(ifile)
+	if err != nil {
+		return err
 	}
-
-	newTarballFile, err := os.Create(tarballPath)
+	c := &tarball.Comparer{Path: func(name string) string { return sources[name] }}
+	diffs, err := c.Compare(in)
 	if err != nil {
-		return fmt.Errorf("Error creating the new tarball file: %s", err)
+		return fmt.Errorf("Error verifying the tarball: %s", err)
 	}
-	defer newTarballFile.Close()
-
-	tw := tar.NewWriter(newTarballFile)
-	tr := tar.NewReader(bytes.NewReader(tarballData))
+	if err := done(); err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", d.Name, d.Reason)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("Verification failed: %d members differ from the files on disk", len(diffs))
+	}
+	return nil
+}
 
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("Error reading the tarball header: %s", err)
-		}
-		deleteFile := false
-		for _, fileToDelete := range filesToDelete {
-			matched, err := filepath.Match(fileToDelete, header.Name)
-			if err != nil {
-				return fmt.Errorf("Error matching wildcard pattern: %s", err)
-			}
-			if matched {
-				deleteFile = true
-				break
-			}
-		}
-		if !deleteFile {
-			if err := tw.WriteHeader(header); err != nil {
-				return fmt.Errorf("Error writing the file header to the new tarball: %s", err)
-			}
-			if _, err := io.Copy(tw, tr); err != nil {
-				return fmt.Errorf("Error copying the file content to the new tarball: %s", err)
-			}
-		}
+// reporter returns the callback printing processed members to w for -v,
+// -vv and -n, or nil when none is given. With -n every line starts with
+// action, saying what would have been done to the member.
+func reporter(w io.Writer, action string) func(*tar.Header) {
+	prefix := ""
+	if dryRun {
+		prefix = action + " "
 	}
-	for _, dirToDelete := range filesToDelete {
-		if strings.HasSuffix(dirToDelete, "/") {
-			dirToDelete = strings.TrimSuffix(dirToDelete, "/")
+	switch {
+	case *vverbos:
+		return func(hdr *tar.Header) {
+			fmt.Fprintln(w, prefix+longFormat(hdr))
 		}
-
-		for {
-			header, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("Error reading the tarball header: %s", err)
-			}
-			if strings.HasPrefix(header.Name, dirToDelete+"/") {
-				continue
-			}
-			if err := tw.WriteHeader(header); err != nil {
-				return fmt.Errorf("Error writing the file header to the new tarball: %s", err)
-			}
-			if _, err := io.Copy(tw, tr); err != nil {
-				return fmt.Errorf("Error copying the file content to the new tarball: %s", err)
-			}
+	case *verbose, dryRun:
+		return func(hdr *tar.Header) {
+			fmt.Fprintln(w, prefix+hdr.Name)
 		}
 	}
-	if err := tw.Close(); err != nil {
-		return fmt.Errorf("Error closing the tarball writer: %s", err)
-	}
 	return nil
 }
 
-func updateTarball(tarballPath string, filesToAdd []string) error {
-	tarballFile, err := os.OpenFile(tarballPath, os.O_RDWR, os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("Error opening the tarball file: %s", err)
+// extractReporter adapts reporter for extraction, adding the destination
+// path to -n output when it differs from the member name.
+func extractReporter(w io.Writer) func(*tar.Header, string) {
+	report := reporter(w, "extract")
+	if report == nil {
+		return nil
 	}
-	defer tarballFile.Close()
-
-	var updatedTarballData bytes.Buffer
-	tw := tar.NewWriter(&updatedTarballData)
-	tr := tar.NewReader(tarballFile)
-
-	existingFiles := make(map[string]bool)
-
-	for _, fileToAdd := range filesToAdd {
-		files, err := filepath.Glob(fileToAdd)
-		if err != nil {
-			fmt.Println("Error getting files matching pattern:", err)
-			continue
-		}
-		for _, file := range files {
-			filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return fmt.Errorf("Error accessing file %s: %s", path, err)
-				}
-
-				header, err := tar.FileInfoHeader(info, "")
-				if err != nil {
-					return fmt.Errorf("Error creating tar header for %s: %s", path, err)
-				}
-				header.Name = path
-
-				if existingFiles[path] {
-					return nil
-				} else {
-					existingFiles[path] = true
-				}
-
-				if err := tw.WriteHeader(header); err != nil {
-					return fmt.Errorf("Error writing the file header to the updated tarball: %s", err)
-				}
-				if info.IsDir() {
-					return nil
-				}
-				fileToCopy, err := os.Open(path)
-				if err != nil {
-					return fmt.Errorf("Error opening the file %s: %s", path, err)
-				}
-				defer fileToCopy.Close()
-				if _, err := io.Copy(tw, fileToCopy); err != nil {
-					return fmt.Errorf("Error copying the file content to the updated tarball: %s", err)
-				}
-				fmt.Printf("Updated file: %s (%d bytes)\n", path, info.Size())
-
-				return nil
-			})
+	return func(hdr *tar.Header, dest string) {
+		if dryRun && dest != "" && dest != hdr.Name {
+			fmt.Fprintf(w, "extract %s to %s\n", hdr.Name, dest)
+			return
 		}
+		report(hdr)
+	}
+}
+
+// longFormat describes a member with its mode, owner, mtime, name and size.
+func longFormat(hdr *tar.Header) string {
+	owner := hdr.Uname
+	if owner == "" {
+		owner = strconv.Itoa(hdr.Uid)
+	}
+	group := hdr.Gname
+	if group == "" {
+		group = strconv.Itoa(hdr.Gid)
 	}
+	modTime := hdr.ModTime.Format("2006-01-02 15:04:05")
+	line := fmt.Sprintf("%s %s/%s %s %s (%s)", hdr.FileInfo().Mode(), owner, group, modTime, hdr.Name, humanSize(hdr.Size))
+	if hdr.Linkname != "" {
+		line += " -> " + hdr.Linkname
+	}
+	return line
+}
 
+func listTarball(r io.Reader) error {
+	l := tarball.NewLister(r)
 	for {
-		header, err := tr.Next()
+		hdr, err := l.Next()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			return fmt.Errorf("Error reading from the original tarball: %s", err)
-		}
-		if !existingFiles[header.Name] {
-			if err := tw.WriteHeader(header); err != nil {
-				return fmt.Errorf("Error writing the file header to the updated tarball: %s", err)
-			}
-			if _, err := io.Copy(tw, tr); err != nil {
-				return fmt.Errorf("Error copying the file content to the updated tarball: %s", err)
-			}
+			return err
 		}
+		listMember(hdr)
 	}
+}
 
-	if err := tw.Close(); err != nil {
-		return fmt.Errorf("Error closing the tarball writer: %s", err)
-	}
-	if err := tarballFile.Truncate(0); err != nil {
-		return fmt.Errorf("Error truncating the tarball file: %s", err)
-	}
-	if _, err := tarballFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("Error seeking to the beginning of the tarball file: %s", err)
+// compileRegex compiles an -include-regex or -exclude-regex expression,
+// ignoring case with -ignore-case.
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	if ignCase {
+		return regexp.Compile("(?i)" + expr)
 	}
-	if _, err := updatedTarballData.WriteTo(tarballFile); err != nil {
-		return fmt.Errorf("Error writing the updated tarball data to the original tarball file: %s", err)
-	}
-	if err := reorganizeTarball(tarballPath); err != nil {
-		fmt.Println("Error:", err)
+	return regexp.Compile(expr)
+}
+
+// listEntry describes a member in a -json listing.
+type listEntry struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Size     int64             `json:"size"`
+	Mode     string            `json:"mode"`
+	Uid      int               `json:"uid"`
+	Gid      int               `json:"gid"`
+	Uname    string            `json:"uname,omitempty"`
+	Gname    string            `json:"gname,omitempty"`
+	ModTime  string            `json:"mtime"`
+	Link     string            `json:"link,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	PAX      map[string]string `json:"pax,omitempty"`
+}
+
+// memberType names the type of hdr in a -json listing.
+func memberType(hdr *tar.Header) string {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
 	}
-	return nil
+	return "file"
 }
 
-type FileEntry struct {
-	Header  *tar.Header
-	Content []byte
+// listMember prints hdr, unless -include-regex, -exclude-regex or -type
+// leave it out.
+func listMember(hdr *tar.Header) {
+	if !nameSel.Match(hdr.Name) || !typeSel.Match(hdr) {
+		return
+	}
+	if listJSON {
+		line, _ := json.Marshal(listEntry{
+			Name:     hdr.Name,
+			Type:     memberType(hdr),
+			Size:     hdr.Size,
+			Mode:     fmt.Sprintf("%04o", hdr.Mode&07777),
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Uname:    hdr.Uname,
+			Gname:    hdr.Gname,
+			ModTime:  hdr.ModTime.Format(time.RFC3339),
+			Link:     hdr.Linkname,
+			Devmajor: hdr.Devmajor,
+			Devminor: hdr.Devminor,
+			PAX:      hdr.PAXRecords,
+		})
+		fmt.Printf("%s\n", line)
+		return
+	}
+	modTime := hdr.ModTime.Format("2006-01-02 15:04:05")
+	fmt.Printf("%s %s %s (%s)\n", hdr.FileInfo().Mode(), modTime, hdr.Name, humanSize(hdr.Size))
 }
 
-func reorganizeTarball(tarballPath string) error {
-	tarballFile, err := os.OpenFile(tarballPath, os.O_RDWR, os.ModePerm)
+func printStats(r io.Reader) error {
+	st, err := tarball.NewLister(r).Stats()
 	if err != nil {
-		return fmt.Errorf("Error opening the tarball file: %s", err)
+		return err
 	}
-	defer tarballFile.Close()
+	fmt.Printf("Statistics for tarball : %s\n", *tfile)
+	fmt.Printf("Total files            : %d\n", st.Files)
+	fmt.Printf("Total directories      : %d\n", st.Directories)
+	fmt.Printf("Total symbolic links   : %d\n", st.Symlinks)
+	fmt.Printf("Total other entries    : %d\n", st.Others)
+	fmt.Printf("Total size             : %s\n", humanSize(st.Size))
+	return nil
+}
 
-	fileData := make(map[string]*FileEntry)
-	tr := tar.NewReader(tarballFile)
+// testTarball reads every member of the tarball to its end, and then the
+// rest of the stream so compressors check their trailers and checksums.
+func testTarball(r io.Reader) error {
+	// Hide any Seek method so member contents are really read.
+	tr := tar.NewReader(struct{ io.Reader }{r})
+	members := 0
+	var size int64
 	for {
-		header, err := tr.Next()
+		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("Error reading from the original tarball: %s", err)
-		}
-
-		var fileContent []byte
-		if !header.FileInfo().IsDir() {
-			fileContent, err = io.ReadAll(tr)
-			if err != nil {
-				return fmt.Errorf("Error reading file content from the original tarball: %s", err)
-			}
+			return fmt.Errorf("Damaged tarball after %d members: %s", members, err)
 		}
-
-		fileData[header.Name] = &FileEntry{
-			Header:  header,
-			Content: fileContent,
+		n, err := io.Copy(ioutil.Discard, tr)
+		if err != nil {
+			return fmt.Errorf("Damaged member %s: %s", hdr.Name, err)
 		}
+		members++
+		size += n
 	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return fmt.Errorf("Damaged compressed stream: %s", err)
+	}
+	fmt.Printf("%s: OK, %d members, %s\n", *tfile, members, humanSize(size))
+	return nil
+}
 
-	var updatedTarballData bytes.Buffer
-	tw := tar.NewWriter(&updatedTarballData)
-
-	sortedFileNames := sortedKeys(fileData)
-
-	for _, fileName := range sortedFileNames {
-		fileEntry := fileData[fileName]
-		header := &tar.Header{
-			Name:       fileName,
-			Mode:       fileEntry.Header.Mode,
-			Uid:        fileEntry.Header.Uid,
-			Gid:        fileEntry.Header.Gid,
-			Uname:      fileEntry.Header.Uname,
-			Gname:      fileEntry.Header.Gname,
-			ModTime:    fileEntry.Header.ModTime,
-			AccessTime: fileEntry.Header.AccessTime,
-			ChangeTime: fileEntry.Header.ChangeTime,
+// compareTarball reports the members read from r whose type, size,
+// contents, mode or mtime differ from the files on disk. With names, only
+// the members below them are compared, and files below them that the
+// tarball lacks are reported too. It returns the number of differences.
+func compareTarball(r io.Reader, args []string) (int, error) {
+	inScope := func(name string) bool {
+		if len(args) == 0 {
+			return true
 		}
-		if fileEntry.Header.FileInfo().IsDir() {
-			header.Typeflag = tar.TypeDir
-			if err := tw.WriteHeader(header); err != nil {
-				return fmt.Errorf("Error writing the directory header to the updated tarball: %s", err)
+		for _, arg := range args {
+			arg = path.Clean(arg)
+			if name == arg || strings.HasPrefix(name, arg+"/") {
+				return true
 			}
-			continue
-		}
-
-		header.Size = int64(len(fileEntry.Content))
-		if err := tw.WriteHeader(header); err != nil {
-			return fmt.Errorf("Error writing the file header to the updated tarball: %s", err)
 		}
-		if _, err := tw.Write(fileEntry.Content); err != nil {
-			return fmt.Errorf("Error writing the file content to the updated tarball: %s", err)
+		return false
+	}
+	seen := make(map[string]bool)
+	c := &tarball.Comparer{Metadata: true}
+	c.Path = func(name string) string {
+		p := path.Clean(strings.TrimLeft(name, "/"))
+		if !inScope(p) {
+			return ""
 		}
+		seen[p] = true
+		return p
+	}
+	diffs, err := c.Compare(r)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range diffs {
+		fmt.Printf("%s: %s\n", d.Name, d.Reason)
 	}
-	if err := tw.Close(); err != nil {
-		return fmt.Errorf("Error closing the tarball writer: %s", err)
+	if len(args) == 0 {
+		return len(diffs), nil
 	}
 
-	if err := tarballFile.Truncate(0); err != nil {
-		return fmt.Errorf("Error truncating the tarball file: %s", err)
+	missing := 0
+	a := tarball.NewArchiver(ioutil.Discard)
+	a.Exclude = excludes
+	a.Matching = matchOpt
+	a.IgnoreFile = ".tarignore"
+	a.ExcludeVCS = excVCS
+	a.VCSIgnores = vcsIgn
+	a.ExcludeCaches = caches
+	a.OneFileSystem = oneFS
+	a.NoRecursion = noRecurs
+	a.Dereference = derefer
+	a.HardDereference = hardDer
+	a.Newer, a.NewerMtime = newer, newerMF != ""
+	a.Filter = func(hdr *tar.Header) bool {
+		if !seen[path.Clean(hdr.Name)] {
+			fmt.Printf("%s: missing from the tarball\n", hdr.Name)
+			missing++
+		}
+		return false
+	}
+	if err := addPaths(a, args); err != nil {
+		return 0, err
 	}
+	return len(diffs) + missing, nil
+}
+
+// nameReader reads the names listed in a -T file, one per line or, with
+// nul set, separated by NUL bytes as printed by find -print0.
+type nameReader struct {
+	scanner *bufio.Scanner
+	nul     bool
+}
 
-	if _, err := tarballFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("Error seeking to the beginning of the tarball file: %s", err)
+func newNameReader(r io.Reader, nul bool) *nameReader {
+	scanner := bufio.NewScanner(r)
+	if nul {
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			if i := bytes.IndexByte(data, 0); i >= 0 {
+				return i + 1, data[:i], nil
+			}
+			if atEOF && len(data) > 0 {
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		})
 	}
+	return &nameReader{scanner: scanner, nul: nul}
+}
 
-	if _, err := updatedTarballData.WriteTo(tarballFile); err != nil {
-		return fmt.Errorf("Error writing the updated tarball data to the original tarball file: %s", err)
+// next returns the next name as soon as it is read, or "" at the end.
+func (nr *nameReader) next() (string, error) {
+	for nr.scanner.Scan() {
+		name := nr.scanner.Text()
+		if !nr.nul {
+			name = strings.TrimSuffix(name, "\r")
+		}
+		if name != "" {
+			return name, nil
+		}
 	}
-	return nil
+	if err := nr.scanner.Err(); err != nil {
+		return "", fmt.Errorf("Error reading the list of names: %s", err)
+	}
+	return "", nil
 }
 
-func sortedKeys(m map[string]*FileEntry) []string {
-	keys := make([]string, 0, len(m))
-	for key := range m {
-		keys = append(keys, key)
+// readAll returns the remaining names.
+func (nr *nameReader) readAll() ([]string, error) {
+	var list []string
+	for {
+		name, err := nr.next()
+		if name == "" {
+			return list, err
+		}
+		list = append(list, name)
 	}
-	sort.SliceStable(keys, func(i, j int) bool {
-		partsI := strings.Split(keys[i], string(os.PathSeparator))
-		partsJ := strings.Split(keys[j], string(os.PathSeparator))
-		for k := 0; k < len(partsI) && k < len(partsJ); k++ {
-			if partsI[k] == partsJ[k] {
+}
+
+// addPaths expands each argument as a glob and adds the matches to a,
+// followed by the names read with -T, which are taken literally. Names
+// streamed from nameList are added as they arrive.
+func addPaths(a *tarball.Archiver, args []string) error {
+	var layerPaths []string
+	for _, incpath := range args {
+		files, err := tarball.Glob(incpath)
+		if err != nil {
+			return fmt.Errorf("Error getting files matching pattern: %s", err)
+		}
+		if len(files) == 0 {
+			// Let the Archiver report what is missing.
+			files = []string{incpath}
+		}
+		last := ""
+		for _, file := range files {
+			// A match below the previous one was added with it.
+			if last != "" && strings.HasPrefix(file, last+string(filepath.Separator)) && !noRecurs {
 				continue
 			}
-			return partsI[k] < partsJ[k]
+			last = file
+			if *oci {
+				layerPaths = append(layerPaths, file)
+				continue
+			}
+			if err := a.AddPath(file); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range names {
+		if *oci {
+			layerPaths = append(layerPaths, name)
+			continue
 		}
-		return len(partsI) < len(partsJ)
-	})
-	return keys
+		if err := a.AddPath(name); err != nil {
+			return err
+		}
+	}
+	for nameList != nil {
+		name, err := nameList.next()
+		if err != nil {
+			return err
+		} else if name == "" {
+			break
+		}
+		if *oci {
+			layerPaths = append(layerPaths, name)
+			continue
+		}
+		if err := a.AddPath(name); err != nil {
+			return err
+		}
+	}
+	if *oci {
+		return a.AddLayer(layerPaths)
+	}
+	return nil
+}
+
+// addMembers adds the -manifest entries and then the named paths to a.
+func addMembers(a *tarball.Archiver) error {
+	if *mfile != "" {
+		entries, err := tarball.ReadManifest(*mfile)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := a.AddManifestEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return addPaths(a, flag.Args())
+}
+
+// sortTarball sorts the members of the -f tarball by path for -sort.
+func sortTarball() {
+	if !sortMem || dryRun {
+		return
+	}
+	if err := tarball.NewEditor(*tfile).Reorganize(); err != nil {
+		fatalf("Error sorting tarball: %s", err)
+	}
+}
+
+// xattrFilter returns the extended attributes selected by -xattrs and its
+// patterns and by -mac-metadata, or nil without either.
+func xattrFilter() *tarball.XattrFilter {
+	if !xattrs && !macMeta {
+		return nil
+	}
+	f := &tarball.XattrFilter{Include: xattrInc, Exclude: xattrExc}
+	if macMeta {
+		if !xattrs {
+			f.Include = nil
+		} else if len(f.Include) == 0 {
+			f.Include = tarball.DefaultXattrs
+		}
+		f.Include = append(f.Include[:len(f.Include):len(f.Include)], tarball.MacMetadata)
+	}
+	return f
+}
+
+// estimateSize walks the inputs without reading file contents and returns
+// the size of the tarball they produce.
+func estimateSize() (int64, error) {
+	total := int64(1024)
+	est := tarball.NewArchiver(ioutil.Discard)
+	est.Exclude = excludes
+	est.Matching = matchOpt
+	est.IgnoreFile = ".tarignore"
+	est.ExcludeVCS = excVCS
+	est.VCSIgnores = vcsIgn
+	est.ExcludeCaches = caches
+	est.OneFileSystem = oneFS
+	est.NoRecursion = noRecurs
+	est.Dereference = derefer
+	est.HardDereference = hardDer
+	est.Newer, est.NewerMtime = newer, newerMF != ""
+	est.Filter = func(hdr *tar.Header) bool {
+		total += 512 + (hdr.Size+511)/512*512
+		return false
+	}
+	if err := addMembers(est); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// Exit statuses, as GNU tar's: exitDiffers when files differed or were
+// skipped, and exitFatal when tar could not go on or files could not be
+// read.
+const (
+	exitOK      = 0
+	exitDiffers = 1
+	exitFatal   = 2
+)
+
+// exitStatus is the status to exit with once done.
+var exitStatus = exitOK
+
+// heldLock is the lock on the -f tarball, if held, which fatal releases
+// as os.Exit skips the deferred release.
+var heldLock *tarballLock
+
+// fatal prints v like log.Println and exits with exitFatal.
+func fatal(v ...interface{}) {
+	log.Println(v...)
+	heldLock.release()
+	closeVerifiedInput()
+	os.Exit(exitFatal)
+}
+
+// fatalf prints v like log.Printf and exits with exitFatal.
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	heldLock.release()
+	closeVerifiedInput()
+	os.Exit(exitFatal)
+}
+
+// reportSkipped prints what was left out, which makes tar exit with
+// exitDiffers.
+func reportSkipped(skipped []string) {
+	for _, sk := range skipped {
+		fmt.Fprintln(os.Stderr, "Skipped:", sk)
+	}
+	if len(skipped) > 0 && exitStatus < exitDiffers {
+		exitStatus = exitDiffers
+	}
+}
+
+// reportFailed prints the files that could not be read, and exits with
+// exitFatal when there are any.
+func reportFailed(failed []string) {
+	for _, f := range failed {
+		fmt.Fprintln(os.Stderr, "Failed:", f)
+	}
+	if len(failed) > 0 {
+		fatalf("%d files could not be read; use -ignore-failed-read to skip them", len(failed))
+	}
+}
+
+func main() {
+	run()
+	closeVerifiedInput()
+	os.Exit(exitStatus)
+}
+
+func run() {
+	flag.BoolVar(&absNames, "P", false, "don't strip leading '/' or refuse '..' in member names on extract")
+	flag.BoolVar(&absNames, "absolute-names", false, "same as -P")
+	flag.Var(&excludes, "exclude", "skip files matching `pattern` on -c, -a and -u (repeatable)")
+	flag.BoolVar(&nullSep, "null", false, "-T reads NUL-separated names")
+	flag.BoolVar(&nullSep, "0", false, "same as -null")
+	flag.BoolVar(&dryRun, "n", false, "dry run; show what would be added, deleted, updated or extracted without doing it")
+	flag.BoolVar(&dryRun, "dry-run", false, "same as -n")
+	flag.StringVar(&cprog, "I", "", "filter the tarball through `program` (run with -d to decompress)")
+	flag.StringVar(&cprog, "use-compress-program", "", "same as -I")
+	flag.BoolVar(&gzipOut, "z", false, "compress the created tarball with gzip")
+	flag.BoolVar(&gzipOut, "gzip", false, "same as -z")
+	flag.IntVar(&zstdLong, "zstd-long", 0, "accept zstd tarballs with windows of up to 2^`N` bytes, as written by zstd --long=N")
+	flag.StringVar(&zstdDict, "zstd-dict", "", "read zstd tarballs compressed with the dictionary `file`, and compress with it on -c -I zstd")
+	flag.StringVar(&trainOut, "train-dict", "", "train a zstd dictionary from the named files and write it to `file`")
+	flag.BoolVar(&writeIdx, "index", false, "write an index of member offsets next to the created tarball, used by -l to read only the headers and by -x and -o to seek to the members named")
+	flag.BoolVar(&encrypt, "e", false, "encrypt the created tarball with a passphrase (AES-256-GCM); decryption is automatic")
+	flag.BoolVar(&encrypt, "encrypt", false, "same as -e")
+	flag.StringVar(&passFile, "passfile", "", "read the passphrase for -e and for encrypted tarballs from `file`")
+	flag.StringVar(&signKey, "sign", "", "sign the created tarball with the Ed25519 private key in `file`, writing name.sig")
+	flag.StringVar(&checkSig, "verify-sig", "", "check name.sig with the Ed25519 public key in `file` before -x, -o, -l or -s")
+	flag.BoolVar(&verifyW, "W", false, "verify the created tarball against the files on disk")
+	flag.BoolVar(&verifyW, "verify", false, "same as -W")
+	flag.BoolVar(&recoverX, "recover", false, "on -x and -o, skip damaged parts of the tarball and extract the rest")
+	flag.StringVar(&incrFile, "listed-incremental", "", "on -c, archive only what changed since the snapshot `file` and update it; on -x, remove what was deleted since the previous level")
+	flag.StringVar(&baseArc, "newer-than-archive", "", "on -c, archive only the files new or changed relative to the members of the `tarball`")
+	flag.BoolVar(&sortMem, "sort", false, "sort the members by path when -a, -u or -d rewrites the tarball, instead of keeping their order")
+	flag.StringVar(&bakMode, "backup", "", "keep the tarball as it was before -a, -u, -d or -A as name.bak (`mode` simple), name.~N~ (numbered), or numbered only if such backups exist (existing)")
+	flag.BoolVar(&noLock, "no-lock", false, "don't lock the tarball while -c, -a, -u, -d or -A modify it")
+	flag.BoolVar(&sameOwn, "same-owner", false, "on -x, give files the owner and group recorded in the tarball (default when run as root)")
+	flag.BoolVar(&noSameOw, "no-same-owner", false, "on -x, leave files owned by the user extracting them, even as root")
+	flag.BoolVar(&numOwner, "numeric-owner", false, "on -c, store only numeric user and group ids; on -x, restore them ignoring the names")
+	flag.StringVar(&uidMapF, "owner-map", "", "translate user ids on -c, -a and -x with the ranges in `file`, as from,to[,count] or name:start:count lines")
+	flag.StringVar(&gidMapF, "group-map", "", "translate group ids on -c, -a and -x like -owner-map, with the ranges in `file`")
+	flag.StringVar(&ownerF, "owner", "", "on -c and -a, store every file as owned by `user`, given as name:uid, name or uid")
+	flag.StringVar(&groupF, "group", "", "on -c and -a, store every file with the `group`, given as name:gid, name or gid")
+	flag.StringVar(&mtimeF, "mtime", "", "on -c and -a, set the modification time of every member to `time` (@seconds, a date, or a file's time); defaults to $SOURCE_DATE_EPOCH when set")
+	flag.BoolVar(&clampMt, "clamp-mtime", false, "with -mtime or $SOURCE_DATE_EPOCH, only set the times later than it")
+	flag.BoolVar(&reprod, "reproducible", false, "create byte-identical tarballs from identical trees: implies -numeric-owner, -owner 0, -group 0 and -clamp-mtime, and compresses -z the same way whatever the number of CPUs")
+	flag.BoolVar(&sparse, "S", false, "on -c and -a, store the holes of sparse files as a map; on -x, leave holes for the runs of zeros in every file")
+	flag.BoolVar(&sparse, "sparse", false, "same as -S")
+	flag.BoolVar(&xattrs, "xattrs", false, "store extended attributes (user.* and security.* by default) on -c and -a and restore them on -x")
+	flag.Var(&xattrInc, "xattrs-include", "with -xattrs, handle the extended attributes matching `pattern` instead of user.* and security.* (repeatable)")
+	flag.Var(&xattrExc, "xattrs-exclude", "with -xattrs, leave out the extended attributes matching `pattern` (repeatable)")
+	flag.BoolVar(&macMeta, "mac-metadata", false, "store and restore the macOS metadata of files (resource forks, Finder flags and other com.apple.* extended attributes), alone or with -xattrs")
+	flag.BoolVar(&acls, "acls", false, "store POSIX ACLs on -c and -a and restore them on -x")
+	flag.StringVar(&formatF, "format", "", "write members on -c and -a in the `format` ustar, pax or gnu (default: ustar, and pax for members ustar cannot store), or create a zip file with zip")
+	flag.StringVar(&nested, "nested", "", "read the tarball stored as the first member matching `pattern` of the -f tarball, such as data.tar.* of a Debian package")
+	flag.Var(&xforms, "transform", "rename members on -c, -a and -x with the sed expression `s/regexp/replacement/flags` (repeatable)")
+	flag.Var(&xforms, "xform", "same as -transform")
+	flag.StringVar(&prefix, "prefix", "", "put members below `dir` on -c, -a and -x")
+	flag.Var(&inclRe, "include-regex", "only take members whose names match the regular expression `re` on -c, -a, -x, -o, -l and -d (repeatable)")
+	flag.Var(&exclRe, "exclude-regex", "leave out members whose names match the regular expression `re` on -c, -a, -x, -o, -l and -d (repeatable)")
+	flag.BoolVar(&ignCase, "ignore-case", false, "match -exclude, -include-regex, -exclude-regex and member name patterns regardless of case")
+	flag.BoolVar(&anchorY, "anchored", false, "patterns must match whole names, or with -exclude, whole paths (default for member names)")
+	flag.BoolVar(&anchorN, "no-anchored", false, "patterns may match any trailing part of a name after a '/' (default for -exclude)")
+	flag.BoolVar(&wcSlash, "wildcards-match-slash", false, "let * and ? in patterns match '/' too")
+	flag.BoolVar(&noWcSl, "no-wildcards-match-slash", false, "keep * and ? in patterns from matching '/' (default)")
+	flag.BoolVar(&excVCS, "exclude-vcs", false, "on -c and -a, leave out the directories and files of version control systems (.git, .hg, .svn, CVS, ...)")
+	flag.BoolVar(&vcsIgn, "exclude-vcs-ignores", false, "on -c and -a, leave out the files matched by the .gitignore files in the tree")
+	flag.BoolVar(&cacheTag, "exclude-caches", false, "on -c and -a, leave out the contents of directories holding a CACHEDIR.TAG file, except the tag")
+	flag.BoolVar(&cacheUnd, "exclude-caches-under", false, "on -c and -a, leave out everything in directories holding a CACHEDIR.TAG file")
+	flag.BoolVar(&cacheAll, "exclude-caches-all", false, "on -c and -a, leave out directories holding a CACHEDIR.TAG file")
+	flag.BoolVar(&oneFS, "one-file-system", false, "on -c and -a, don't descend into directories on other file systems than the path named")
+	flag.BoolVar(&noRecurs, "no-recursion", false, "on -c, -a and -u, add the directories named without what they hold")
+	flag.BoolVar(&derefer, "h", false, "on -c and -a, archive the files symbolic links point to instead of the links")
+	flag.BoolVar(&derefer, "L", false, "same as -h")
+	flag.BoolVar(&derefer, "dereference", false, "same as -h")
+	flag.BoolVar(&hardDer, "hard-dereference", false, "on -c and -a, store hard linked files with their contents every time instead of as links")
+	flag.StringVar(&newerF, "N", "", "on -c and -a, only take the files modified or whose status changed after `time` (@seconds, a date, or a file's time); directories are always taken")
+	flag.StringVar(&newerF, "newer", "", "same as -N")
+	flag.StringVar(&newerF, "after-date", "", "same as -N")
+	flag.StringVar(&newerMF, "newer-mtime", "", "like -N, but only take the files modified after `time`")
+	flag.Var(sizeFlag{&minSize}, "min-size", "on -c, -a, -x and -o, leave out regular files smaller than `size` bytes (K, M, G suffixes)")
+	flag.Var(sizeFlag{&maxSize}, "max-size", "on -c, -a, -x and -o, leave out regular files larger than `size` bytes (K, M, G suffixes)")
+	flag.StringVar(&typesF, "type", "", "on -x, -o and -l, only take members of the `types`: f (files), d (directories), l (symbolic links), h (hard links), c, b (devices) or p (FIFOs), as in -type f,l")
+	flag.BoolVar(&interact, "w", false, "ask on the terminal before adding or extracting each file")
+	flag.BoolVar(&interact, "interactive", false, "same as -w")
+	flag.BoolVar(&interact, "confirmation", false, "same as -w")
+	flag.BoolVar(&keepOld, "k", false, "on -x, stop with an error instead of replacing a file already on disk")
+	flag.BoolVar(&keepOld, "keep-old-files", false, "same as -k")
+	flag.BoolVar(&skipOld, "skip-old-files", false, "on -x, leave the files already on disk as they are")
+	flag.BoolVar(&keepNew, "keep-newer-files", false, "on -x, only replace the files on disk older than their member")
+	flag.BoolVar(&unlinkF, "U", false, "on -x, remove each file, symbolic link or empty directory in the way before extracting a member there")
+	flag.BoolVar(&unlinkF, "unlink-first", false, "same as -U")
+	flag.BoolVar(&samePerm, "p", false, "on -x, give files the exact modes recorded in the tarball instead of applying the umask (default when run as root)")
+	flag.BoolVar(&samePerm, "preserve-permissions", false, "same as -p")
+	flag.BoolVar(&samePerm, "same-permissions", false, "same as -p")
+	flag.BoolVar(&noSameP, "no-same-permissions", false, "on -x, apply the umask to the modes recorded in the tarball, even as root")
+	flag.BoolVar(&fsyncF, "fsync", false, "flush every file extracted by -x, and the tarball written by -c, -a or -A, to disk before finishing")
+	flag.Var(sizeFlag{&bufSize}, "buffer-size", "copy member contents on -x and -o through a buffer of `size` bytes (K, M suffixes; default 1M)")
+	flag.BoolVar(&noSpace, "no-check-space", false, "on -x, skip checking that the filesystem has room for the files of the tarball before extracting")
+	flag.StringVar(&resumeF, "resume", "", "on -x, record the members extracted in the state `file`, and skip those it lists that are still intact on disk; the file is removed once everything is extracted")
+	flag.Var(checkpointFlag{&ckptN}, "checkpoint", "on -c and -x, run the checkpoint actions every `n` records of 10 KiB (default 10 when given alone)")
+	flag.Var(&ckptActs, "checkpoint-action", "run `action` at every checkpoint: echo[=message], dot, bell, ttyout=message, totals, sleep=seconds or exec=command; %u in messages is the checkpoint number (repeatable)")
+	flag.Var(totalsFlag{&totalsF}, "totals", "after -c, -a or -u, print the bytes read and written, the compression ratio, the time taken and the throughput on stderr; -totals=json prints them as JSON")
+	flag.BoolVar(&ignRead, "ignore-failed-read", false, "on -c and -a, skip the files that cannot be read with a warning, exiting with status 1 instead of 2")
+	flag.BoolVar(&listJSON, "json", false, "with -l, print every member as a JSON object on a line of its own")
+	flag.Var(sizeFlag{&volSize}, "volume-size", "split the created tarball into volumes of `size` bytes (K, M, G suffixes) named name.001, name.002, ...")
+	flag.IntVar(&threads, "threads", 0, "use `N` threads for -z and for reading xz tarballs (default: the number of CPUs)")
+	flag.Var(&exclFrom, "exclude-from", "read -exclude patterns from `file`, one per line (repeatable)")
+	flag.Var(&alsoTo, "also-to", "additional output `path or URL` for -c (repeatable)")
+	flag.Parse()
+
+	if *diffArc {
+		if flag.NArg() != 2 {
+			fatal("-diff-archives needs two tarballs")
+		}
+		n, err := diffArchives(flag.Arg(0), flag.Arg(1), *difftxt)
+		if err != nil {
+			fatal(err)
+		}
+		if n > 0 {
+			os.Exit(exitDiffers)
+		}
+		return
+	}
+
+	if *tfile == "" {
+		fmt.Printf("Usage for %[1]s: %[1]s [-x|o] [-c|a] [-d|l] [-f file] [files ...]\n", "tar")
+		flag.PrintDefaults()
+	}
+
+	for _, name := range exclFrom {
+		patterns, err := tarball.ReadPatterns(name)
+		if err != nil {
+			fatal(err)
+		}
+		excludes = append(excludes, patterns...)
+	}
+
+	for _, expr := range xforms {
+		t, err := tarball.ParseTransform(expr)
+		if err != nil {
+			fatal(err)
+		}
+		renames = append(renames, t)
+	}
+	if prefix != "" {
+		renames = append(renames, tarball.PrefixTransform(prefix))
+	}
+	if newerF != "" && newerMF != "" {
+		fatal("-newer and -newer-mtime cannot be used together")
+	}
+	if newerF != "" || newerMF != "" {
+		t, err := parseMtime(newerF + newerMF)
+		if err != nil {
+			fatal(err)
+		}
+		newer = t
+	}
+	if minSize > 0 || maxSize > 0 {
+		if maxSize > 0 && minSize > maxSize {
+			fatal("-min-size cannot be larger than -max-size")
+		}
+		sizeSel = &tarball.SizeFilter{Min: minSize, Max: maxSize}
+	}
+	if typesF != "" {
+		f, err := tarball.ParseTypeFilter(typesF)
+		if err != nil {
+			fatal(err)
+		}
+		typeSel = f
+	}
+	if (keepOld && skipOld) || (keepOld && keepNew) || (skipOld && keepNew) {
+		fatal("Only one of -keep-old-files, -skip-old-files and -keep-newer-files can be given")
+	}
+	if len(ckptActs) > 0 && ckptN == 0 {
+		ckptN = defaultCheckpoint
+	}
+	if ckptN != 0 {
+		var err error
+		if ckptActs, err = parseCheckpointActions(ckptActs); err != nil {
+			fatal(err)
+		}
+	}
+	if listJSON && !*list {
+		fatal("-json only applies to -l")
+	}
+	// The option leaving out the most wins.
+	switch {
+	case cacheAll:
+		caches = tarball.ExcludeCachesAll
+	case cacheUnd:
+		caches = tarball.ExcludeCachesUnder
+	case cacheTag:
+		caches = tarball.ExcludeCachesTag
+	}
+	if anchorY && anchorN {
+		fatal("-anchored and -no-anchored cannot be used together")
+	}
+	if wcSlash && noWcSl {
+		fatal("-wildcards-match-slash and -no-wildcards-match-slash cannot be used together")
+	}
+	if ignCase || anchorY || anchorN || wcSlash {
+		matchOpt = &tarball.MatchOptions{IgnoreCase: ignCase, WildcardsMatchSlash: wcSlash}
+		if anchorY || anchorN {
+			matchOpt.Anchored = &anchorY
+		}
+	}
+	if len(inclRe) > 0 || len(exclRe) > 0 {
+		nameSel = &tarball.RegexpFilter{}
+		for _, expr := range inclRe {
+			re, err := compileRegex(expr)
+			if err != nil {
+				fatalf("Invalid regular expression %q: %s", expr, err)
+			}
+			nameSel.Include = append(nameSel.Include, re)
+		}
+		for _, expr := range exclRe {
+			re, err := compileRegex(expr)
+			if err != nil {
+				fatalf("Invalid regular expression %q: %s", expr, err)
+			}
+			nameSel.Exclude = append(nameSel.Exclude, re)
+		}
+	}
+
+	if *flist == "-" && *tfile == "-" && !*create {
+		fatal("-T - and -f - can only share standard input with -c, which writes the tarball to standard output")
+	}
+	if *flist != "" {
+		var r io.Reader = os.Stdin
+		if *flist != "-" {
+			lf, err := os.Open(*flist)
+			if err != nil {
+				fatal(err)
+			}
+			defer lf.Close()
+			r = lf
+		}
+		// -c and -a add the names as they are read, so that a list piped
+		// in from find is archived while it is being produced. -progress
+		// goes through them twice and needs them all first.
+		nr := newNameReader(r, nullSep)
+		if (*create || *appendf) && !*showPrg {
+			nameList = nr
+		} else {
+			var err error
+			if names, err = nr.readAll(); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	switch *wmode {
+	case "":
+		if *oci {
+			*wmode = tarball.WhiteoutRemove
+		}
+	case tarball.WhiteoutRemove, tarball.WhiteoutOverlay:
+	default:
+		fatalf("Unknown whiteout mode: %s", *wmode)
+	}
+
+	if formatF == "zip" {
+		zipOut = true
+		if !*create {
+			fatal("-format zip only works with -c")
+		}
+		if gzipOut || cprog != "" || writeIdx || verifyW || sparse {
+			fatal("-format zip cannot be used with -z, -I, -index, -W or -S")
+		}
+	} else if formatF != "" {
+		var err error
+		if format, err = tarball.ParseFormat(formatF); err != nil {
+			fatal(err)
+		}
+	}
+	if *fakedb != "" {
+		var err error
+		if fakeroot, err = tarball.LoadFakerootDB(*fakedb); err != nil {
+			fatal(err)
+		}
+	}
+	// Layers are reproducible too, since their digests name them.
+	if reprod || (*oci && (*create || *appendf)) {
+		numOwner, clampMt = true, true
+		owner, group = &tarball.Owner{}, &tarball.Owner{}
+	}
+	if ownerF != "" {
+		var err error
+		if owner, err = tarball.ParseOwner(ownerF, false); err != nil {
+			fatal(err)
+		}
+	}
+	if groupF != "" {
+		var err error
+		if group, err = tarball.ParseOwner(groupF, true); err != nil {
+			fatal(err)
+		}
+	}
+	if *create || *appendf {
+		var err error
+		if mtime, err = buildTime(); err != nil {
+			fatal(err)
+		}
+	}
+	if uidMapF != "" {
+		var err error
+		if uidMap, err = tarball.LoadIDMap(uidMapF); err != nil {
+			fatal(err)
+		}
+	}
+	if gidMapF != "" {
+		var err error
+		if gidMap, err = tarball.LoadIDMap(gidMapF); err != nil {
+			fatal(err)
+		}
+	}
+
+	if checkSig != "" && (*fstats || *list || *testArc || *compare || *extract || *stdout) {
+		if err := verifySignature(checkSig); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *fstats {
+		ifile, err := openInput()
+		if err != nil {
+			fatalf("Error while getting statistics: Error opening the tarball file: %s", err)
+		}
+		in, done, err := decompress(ifile)
+		if err != nil {
+			fatal(err)
+		}
+		if err := printStats(in); err != nil {
+			fatalf("Error while getting statistics: %s", err)
+		}
+		if err := done(); err != nil {
+			fatal(err)
+		}
+		ifile.Close()
+	}
+
+	if *list {
+		ifile, err := openInput()
+		if err != nil {
+			fatal(err)
+		}
+		if tarIndex, err = loadIndex(ifile); err != nil {
+			fatal(err)
+		}
+		in, done, err := decompress(ifile)
+		if err != nil {
+			fatal(err)
+		}
+		if seeker, ok := in.(io.Seeker); ok && tarIndex != nil {
+			err = listIndexed(in, seeker, tarIndex)
+		} else {
+			err = listTarball(in)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if err := done(); err != nil {
+			fatal(err)
+		}
+		ifile.Close()
+	}
+
+	if *testArc {
+		ifile, err := openInput()
+		if err != nil {
+			fatal(err)
+		}
+		in, done, err := decompress(ifile)
+		if err != nil {
+			fatal(err)
+		}
+		if err := testTarball(in); err != nil {
+			fatal(err)
+		}
+		if err := done(); err != nil {
+			fatal(err)
+		}
+		ifile.Close()
+	}
+
+	if *mountAt != "" {
+		if err := mountTarball(*mountAt); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *serveAt != "" {
+		if err := serveTarball(*serveAt); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *compare {
+		ifile, err := openInput()
+		if err != nil {
+			fatal(err)
+		}
+		in, done, err := decompress(ifile)
+		if err != nil {
+			fatal(err)
+		}
+		n, err := compareTarball(in, flag.Args())
+		if err != nil {
+			fatal(err)
+		}
+		if err := done(); err != nil {
+			fatal(err)
+		}
+		ifile.Close()
+		if n > 0 {
+			os.Exit(exitDiffers)
+		}
+	}
+
+	if (cprog != "" || gzipOut || encrypt) && (*delete || *update || *appendf) {
+		fatal("-I, -z and -e cannot be used with -d, -u or -a")
+	}
+	if volSize > 0 && (writeIdx || signKey != "" || *catenat || *appendf || *update || *delete || *tfile == "-") {
+		fatal("-volume-size needs a tarball file, and cannot be used with -index, -sign, -A, -a, -u or -d")
+	}
+	if writeIdx && encrypt {
+		fatal("-index cannot be used with -e")
+	}
+	if writeIdx && (cprog != "" || *tfile == "-") {
+		fatal("-index needs a tarball file, and cannot be used with -I")
+	}
+	if cprog != "" && gzipOut {
+		fatal("-I and -z cannot be used together")
+	}
+	if zstdDict != "" && *create && !isZstd(cprog) {
+		fatal("-zstd-dict needs -I zstd to compress with the dictionary on -c")
+	}
+	if isRemote(*tfile) && (*appendf || *update || *delete || *catenat) {
+		fatal("A tarball given as a URL can only be read, or uploaded with -c")
+	}
+	if isRemote(*tfile) && (writeIdx || signKey != "" || sortMem || volSize > 0) {
+		fatal("-index, -sign, -sort and -volume-size need a local tarball file")
+	}
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	if (*create || *appendf || *update || *delete || *catenat) && !dryRun && !noLock && *tfile != "-" && !isRemote(*tfile) {
+		lock, err := lockTarball(*tfile)
+		if err != nil {
+			fatal(err)
+		}
+		heldLock = lock
+		defer lock.release()
+	}
+
+	if trainOut != "" {
+		if err := trainDict(trainOut); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if *catenat {
+		if cprog != "" || encrypt || *tfile == "-" {
+			fatal("-A needs a tarball file, and cannot be used with -I or -e")
+		}
+		if err := backupTarball(true); err != nil {
+			fatal(err)
+		}
+		if err := catenate(flag.Args()); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if *delete {
+		if err := backupTarball(false); err != nil {
+			fatal(err)
+		}
+		editor := tarball.NewEditor(*tfile)
+		editor.Report = reporter(os.Stdout, "delete")
+		editor.DryRun = dryRun
+		editor.Select = nameSel
+		editor.Matching = matchOpt
+		if err := editor.Delete(flag.Args()); err != nil {
+			fatalf("Error deleting files from tarball: %s", err)
+		}
+		sortTarball()
+	}
+
+	if *update {
+		if err := backupTarball(false); err != nil {
+			fatal(err)
+		}
+		tot := newTotals()
+		editor := tarball.NewEditor(*tfile)
+		editor.Report = tot.report(reporter(os.Stdout, "update"))
+		editor.DryRun = dryRun
+		editor.Exclude = excludes
+		editor.Matching = matchOpt
+		editor.NoRecursion = noRecurs
+		if err := editor.Update(append(flag.Args(), names...)); err != nil {
+			fatalf("Error updating tarball: %s", err)
+		}
+		sortTarball()
+		tot.print(tarballSize())
+		return
+	}
+
+	if *extract || *stdout {
+		ifile, err := openInput()
+		if err != nil {
+			fatal(err)
+		}
+		defer ifile.Close()
+
+		var in io.Reader = ifile
+		var prg *progress
+		if *showPrg && !dryRun {
+			var total int64
+			if st, err := ifile.Stat(); err == nil && st.Mode().IsRegular() {
+				total = st.Size()
+			}
+			prg = newProgress(os.Stderr, total)
+			in = &progressReader{r: ifile, p: prg}
+		}
+
+		if len(flag.Args()) > 0 {
+			if tarIndex, err = loadIndex(ifile); err != nil {
+				fatal(err)
+			}
+		}
+		var resume *tarball.ResumeState
+		resuming := false
+		if resumeF != "" && !*stdout {
+			if resume, err = tarball.LoadResumeState(resumeF); err != nil {
+				fatal(err)
+			}
+			_, err := os.Stat(resumeF)
+			resuming = err == nil
+		}
+		// Once resuming, part of the tarball is already on disk.
+		if *extract && !dryRun && !noSpace && !resuming && len(flag.Args()) == 0 {
+			if err := checkSpace("."); err != nil {
+				fatal(err)
+			}
+		}
+		in, done, err := decompress(in)
+		if err != nil {
+			fatal(err)
+		}
+		if c := newCheckpoint("read", "x"); c != nil {
+			in = newCheckpointReader(in, c)
+		}
+		e := tarball.NewExtractor(in)
+		e.Index = tarIndex
+		e.Select = nameSel
+		e.Sizes = sizeSel
+		e.Types = typeSel
+		if interact {
+			e.Confirm = confirm("extract")
+		}
+		switch {
+		case keepOld:
+			e.Existing = tarball.ExistingError
+		case skipOld:
+			e.Existing = tarball.ExistingSkip
+		case keepNew:
+			e.Existing = tarball.ExistingKeepNewer
+		}
+		e.UnlinkFirst = unlinkF
+		e.Resume = resume
+		e.Sync = fsyncF
+		e.BufferSize = int(bufSize)
+		e.Matching = matchOpt
+		if *stdout {
+			e.Stdout = os.Stdout
+			e.Report = extractReporter(os.Stderr)
+		} else {
+			e.Report = extractReporter(os.Stdout)
+			e.Whiteout = *wmode
+			e.Fakeroot = fakeroot
+			e.StripComponents = *strip
+			e.Transforms = renames
+			e.AbsoluteNames = absNames
+			e.SameOwner = (sameOwn || os.Geteuid() == 0) && !noSameOw
+			e.PreservePermissions = (samePerm || os.Geteuid() == 0) && !noSameP
+			e.NumericOwner = numOwner
+			e.OwnerMap, e.GroupMap = uidMap, gidMap
+		}
+		e.DryRun = dryRun
+		e.Recover = recoverX
+		e.Incremental = incrFile != ""
+		e.Sparse = sparse
+		e.Xattrs = xattrFilter()
+		e.ACLs = acls
+		if len(flag.Args()) > 0 {
+			if recoverX {
+				fatal("-recover extracts the whole tarball and takes no names")
+			}
+			err = e.Extract(flag.Args())
+		} else {
+			err = e.ExtractAll()
+		}
+		if err != nil {
+			fatal(err)
+		}
+		for _, d := range e.Damaged {
+			fmt.Fprintln(os.Stderr, "Damaged:", d)
+		}
+		reportSkipped(e.Skipped)
+		if err := done(); err != nil {
+			fatal(err)
+		}
+		if prg != nil {
+			prg.finish()
+		}
+		if resume != nil && !dryRun {
+			if err := resume.Remove(); err != nil {
+				fatal(err)
+			}
+		}
+		if fakeroot != nil && !*stdout && !dryRun {
+			if err := fakeroot.Save(*fakedb); err != nil {
+				fatal(err)
+			}
+		}
+		if len(e.Damaged) > 0 {
+			log.Printf("Extracted what could be recovered; damaged parts skipped: %d", len(e.Damaged))
+			exitStatus = exitDiffers
+		}
+
+	} else if *appendf && dryRun {
+		a := tarball.NewArchiver(ioutil.Discard)
+		a.Transforms = renames
+		a.Select = nameSel
+		a.Sizes = sizeSel
+		a.Exclude = excludes
+		a.Matching = matchOpt
+		a.IgnoreFile = ".tarignore"
+		a.ExcludeVCS = excVCS
+		a.VCSIgnores = vcsIgn
+		a.ExcludeCaches = caches
+		a.OneFileSystem = oneFS
+		a.NoRecursion = noRecurs
+		a.Dereference = derefer
+		a.HardDereference = hardDer
+		a.Newer, a.NewerMtime = newer, newerMF != ""
+		a.Report = reporter(os.Stdout, "append")
+		if err := addPaths(a, flag.Args()); err != nil {
+			fatal(err)
+		}
+
+	} else if *appendf {
+		if _, err := os.Stat(*tfile); err == nil {
+			if err := backupTarball(true); err != nil {
+				fatal(err)
+			}
+			tot, before := newTotals(), tarballSize()
+			a, err := tarball.OpenAppend(*tfile)
+			if err != nil {
+				fatal(err)
+			}
+			a.Filter = confirmAppend
+			a.Sync = fsyncF
+			a.Fakeroot = fakeroot
+			a.NumericOwner = numOwner
+			a.OwnerMap, a.GroupMap = uidMap, gidMap
+			a.Owner, a.Group = owner, group
+			a.ModTime, a.ClampModTime = mtime, clampMt
+			a.Sparse = sparse
+			a.Xattrs = xattrFilter()
+			a.ACLs = acls
+			a.Format = format
+			a.Transforms = renames
+			a.Select = nameSel
+			a.Sizes = sizeSel
+			if interact {
+				a.Confirm = confirm("add")
+			}
+			a.Exclude = excludes
+			a.Matching = matchOpt
+			a.IgnoreFile = ".tarignore"
+			a.ExcludeVCS = excVCS
+			a.VCSIgnores = vcsIgn
+			a.ExcludeCaches = caches
+			a.OneFileSystem = oneFS
+			a.NoRecursion = noRecurs
+			a.Dereference = derefer
+			a.HardDereference = hardDer
+			a.Newer, a.NewerMtime = newer, newerMF != ""
+			a.Report = tot.report(reporter(os.Stdout, "append"))
+			a.IgnoreFailedRead = ignRead
+			if err := addPaths(a, flag.Args()); err != nil {
+				fatal(err)
+			}
+			reportSkipped(a.Skipped)
+			if err := a.Close(); err != nil {
+				fatal(err)
+			}
+			sortTarball()
+			tot.print(tarballSize() - before)
+			reportFailed(a.Failed)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s not found\n", *tfile)
+		}
+
+	} else if *create {
+		var h hash.Hash
+		switch *digest {
+		case "":
+		case "sha256":
+			h = sha256.New()
+		case "sha512":
+			h = sha512.New()
+		default:
+			fatalf("Unsupported digest algorithm: %s", *digest)
+		}
+		var out io.WriteCloser = nopWriteCloser{ioutil.Discard}
+		if !dryRun {
+			var err error
+			if out, err = openOutput(*tfile, alsoTo); err != nil {
+				fatal(err)
+			}
+		} else {
+			h = nil
+		}
+		tot := newTotals()
+		written := &countingWriter{w: out}
+		var w io.Writer = written
+		if h != nil {
+			w = io.MultiWriter(w, h)
+		}
+		var key ed25519.PrivateKey
+		var sh hash.Hash
+		if signKey != "" && !dryRun {
+			if *tfile == "-" {
+				fatal("-sign needs a tarball file")
+			}
+			var err error
+			if key, err = loadPrivateKey(signKey); err != nil {
+				fatal(err)
+			}
+			sh = sha512.New()
+			w = io.MultiWriter(w, sh)
+		}
+		var enc *encryptWriter
+		if encrypt && !dryRun {
+			pass, err := passphrase(true)
+			if err != nil {
+				fatal(err)
+			}
+			if enc, err = newEncryptWriter(w, pass); err != nil {
+				fatal(err)
+			}
+			w = enc
+		}
+		var comp io.WriteCloser
+		if cprog != "" && !dryRun {
+			var err error
+			if comp, err = newFilterWriter(filterCommand(cprog), w); err != nil {
+				fatal(err)
+			}
+			w = comp
+		} else if gzipOut && !dryRun {
+			comp = newGzipWriter(w, threads)
+			w = comp
+		}
+		var prg *progress
+		if *showPrg && !dryRun {
+			total, err := estimateSize()
+			if err != nil {
+				fatal(err)
+			}
+			prg = newProgress(os.Stderr, total)
+			w = &progressWriter{w: w, p: prg}
+		}
+		if c := newCheckpoint("write", "c"); c != nil {
+			w = &checkpointWriter{w: w, c: c}
+		}
+		var a *tarball.Archiver
+		if zipOut {
+			a = tarball.NewZipArchiver(w)
+		} else {
+			a = tarball.NewArchiver(w)
+		}
+		a.Fakeroot = fakeroot
+		a.NumericOwner = numOwner
+		a.OwnerMap, a.GroupMap = uidMap, gidMap
+		a.Owner, a.Group = owner, group
+		a.ModTime, a.ClampModTime = mtime, clampMt
+		a.Sparse = sparse
+		a.Xattrs = xattrFilter()
+		a.ACLs = acls
+		a.Format = format
+		a.Transforms = renames
+		a.Select = nameSel
+		a.Sizes = sizeSel
+		if interact {
+			a.Confirm = confirm("add")
+		}
+		a.Exclude = excludes
+		a.Matching = matchOpt
+		a.IgnoreFile = ".tarignore"
+		a.ExcludeVCS = excVCS
+		a.VCSIgnores = vcsIgn
+		a.ExcludeCaches = caches
+		a.OneFileSystem = oneFS
+		a.NoRecursion = noRecurs
+		a.Dereference = derefer
+		a.HardDereference = hardDer
+		a.Newer, a.NewerMtime = newer, newerMF != ""
+		if writeIdx && !dryRun {
+			a.Index = &tarball.Index{}
+		}
+		if baseArc != "" {
+			filter, baseNames, err := newerThan(baseArc)
+			if err != nil {
+				fatal(err)
+			}
+			a.Filter = filter
+			if *oci {
+				a.LayerBase = baseNames
+			}
+		}
+		if incrFile != "" {
+			snap, err := tarball.LoadSnapshot(incrFile)
+			if err != nil {
+				fatal(err)
+			}
+			a.Incremental = snap
+		}
+		if verifyW && !dryRun {
+			if *tfile == "-" {
+				fatal("-W needs a tarball file")
+			}
+			a.Sources = make(map[string]string)
+		}
+		if *tfile == "-" && !dryRun {
+			a.Report = tot.report(reporter(os.Stderr, "add"))
+		} else {
+			a.Report = tot.report(reporter(os.Stdout, "add"))
+		}
+		a.IgnoreFailedRead = ignRead
+		if err := addMembers(a); err != nil {
+			fatal(err)
+		}
+		reportSkipped(a.Skipped)
+		if err := a.Close(); err != nil {
+			fatal(err)
+		}
+		if comp != nil {
+			if err := comp.Close(); err != nil {
+				fatal(err)
+			}
+		}
+		if enc != nil {
+			if err := enc.Close(); err != nil {
+				fatal(err)
+			}
+		}
+		if prg != nil {
+			prg.finish()
+		}
+		if err := out.Close(); err != nil {
+			fatal(err)
+		}
+		tot.print(written.n)
+		if key != nil {
+			if err := writeSignature(key, sh.Sum(nil)); err != nil {
+				fatal(err)
+			}
+		}
+		if a.Index != nil {
+			if err := saveIndex(a.Index, comp); err != nil {
+				fatal(err)
+			}
+		}
+		if a.Incremental != nil && !dryRun {
+			if err := a.Incremental.Save(incrFile); err != nil {
+				fatal(err)
+			}
+		}
+		if a.Sources != nil {
+			if err := verifyTarball(a.Sources); err != nil {
+				fatal(err)
+			}
+		}
+		if h != nil {
+			w := os.Stdout
+			if *tfile == "-" {
+				w = os.Stderr
+			}
+			fmt.Fprintf(w, "%x  %s\n", h.Sum(nil), *tfile)
+		}
+		reportFailed(a.Failed)
+	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseMtime parses a -mtime, -newer or -newer-mtime value: "@seconds"
+// since the epoch, a date
+// as 2006-01-02, 2006-01-02 15:04:05 or RFC 3339, or, starting with '/' or
+// '.', a file whose modification time is used.
+func parseMtime(s string) (time.Time, error) {
+	if strings.HasPrefix(s, "@") {
+		secs, err := strconv.ParseInt(s[1:], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid time %q", s)
+		}
+		return time.Unix(secs, 0), nil
+	}
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, ".") {
+		info, err := os.Stat(s)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return info.ModTime(), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %q; use @seconds, a date or a file", s)
+}
+
+// buildTime returns the time -c stamps on every member: -mtime when given,
+// otherwise $SOURCE_DATE_EPOCH when set, as reproducible builds define it,
+// otherwise the zero time, which keeps the times on disk.
+func buildTime() (time.Time, error) {
+	if mtimeF != "" {
+		return parseMtime(mtimeF)
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid SOURCE_DATE_EPOCH %q", epoch)
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type sink struct {
+	name string
+	w    io.WriteCloser
+	err  error
+}
+
+type teeWriter struct {
+	sinks []*sink
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for _, s := range t.sinks {
+		if s.err != nil {
+			continue
+		}
+		if _, err := s.w.Write(p); err != nil {
+			s.err = err
+			fmt.Fprintf(os.Stderr, "Error writing to %s: %s\n", s.name, err)
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, fmt.Errorf("All output destinations failed")
+	}
+	return len(p), nil
+}
+
+func (t *teeWriter) Close() error {
+	failed := 0
+	for _, s := range t.sinks {
+		err := s.w.Close()
+		if s.err == nil && err != nil {
+			s.err = err
+			fmt.Fprintf(os.Stderr, "Error closing %s: %s\n", s.name, err)
+		}
+		if s.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d output destinations failed", failed, len(t.sinks))
+	}
+	return nil
+}
+
+type httpSink struct {
+	pw   *io.PipeWriter
+	done chan error
+	err  error
+}
+
+func newHTTPSink(url string) *httpSink {
+	pr, pw := io.Pipe()
+	s := &httpSink{pw: pw, done: make(chan error, 1)}
+	go func() {
+		req, err := http.NewRequest(http.MethodPut, url, pr)
+		if err == nil {
+			var resp *http.Response
+			resp, err = http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode/100 != 2 {
+					err = fmt.Errorf("Upload rejected: %s", resp.Status)
+				}
+			}
+		}
+		pr.CloseWithError(err)
+		s.done <- err
+	}()
+	return s
+}
+
+func (s *httpSink) Write(p []byte) (int, error) {
+	n, err := s.pw.Write(p)
+	if err != nil {
+		// The upload ended early; report why instead of the closed pipe.
+		if werr := s.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (s *httpSink) Close() error {
+	s.pw.Close()
+	return s.wait()
+}
+
+func (s *httpSink) wait() error {
+	if s.done != nil {
+		s.err = <-s.done
+		s.done = nil
+	}
+	return s.err
+}
+
+func openOutput(tarballPath string, extra []string) (*teeWriter, error) {
+	t := &teeWriter{}
+	for i, dest := range append([]string{tarballPath}, extra...) {
+		switch {
+		case i == 0 && dest == "-":
+			t.sinks = append(t.sinks, &sink{name: "stdout", w: os.Stdout})
+		case i == 0 && volSize > 0:
+			t.sinks = append(t.sinks, &sink{name: dest, w: newVolumeWriter(dest, volSize)})
+		case isS3(dest):
+			w, err := newS3Writer(dest)
+			if err != nil {
+				t.Close()
+				return nil, err
+			}
+			t.sinks = append(t.sinks, &sink{name: dest, w: w})
+		case strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://"):
+			t.sinks = append(t.sinks, &sink{name: dest, w: newHTTPSink(dest)})
+		default:
+			ofile, err := os.Create(dest)
+			if err != nil {
+				t.Close()
+				return nil, fmt.Errorf("Error creating %s: %s", dest, err)
+			}
+			var w io.WriteCloser = ofile
+			if fsyncF {
+				w = syncedFile{ofile}
+			}
+			t.sinks = append(t.sinks, &sink{name: dest, w: w})
+		}
+	}
+	return t, nil
+}
+
+// syncedFile is an output file flushed to disk, with the directory holding
+// it, when closed, for -fsync.
+type syncedFile struct {
+	*os.File
+}
+
+func (f syncedFile) Close() error {
+	if err := f.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(filepath.Dir(f.Name()))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// closeOutput closes an output file, through syncedFile with -fsync.
+func closeOutput(f *os.File) error {
+	if fsyncF {
+		return syncedFile{f}.Close()
+	}
+	return f.Close()
+}
+
+// sizeFlag is a flag.Value for byte counts such as 650M.
+type sizeFlag struct {
+	n *int64
+}
+
+func (f sizeFlag) String() string {
+	if f.n == nil || *f.n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(*f.n, 10)
+}
+
+func (f sizeFlag) Set(value string) error {
+	n, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	*f.n = n
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/pedroalbanese/tar/pkg/tarball"
+)
+
+const gzipBlockSize = 1 << 20
+
+// pgzipWriter compresses blocks of the tarball concurrently, writing each as
+// a gzip member of its own. A sequence of members is a valid gzip file that
+// gzip -d, and the -x detection, read back as one stream.
+type pgzipWriter struct {
+	w     io.Writer
+	buf   []byte
+	queue chan chan gzipResult
+	done  chan error
+	// mu guards err, the first error of drain, which Write returns so a
+	// failing destination stops the tarball early.
+	mu  sync.Mutex
+	err error
+	// blocks records where each block starts, for -index.
+	blocks []tarball.IndexBlock
+}
+
+type gzipResult struct {
+	data []byte
+	err  error
+}
+
+// newGzipWriter returns a gzip writer using up to threads blocks in
+// parallel, or the plain single-stream writer for a single thread. With
+// -reproducible, blocks are always used, so the output does not depend on
+// the number of CPUs. Neither writer stores a name or time in the header.
+func newGzipWriter(w io.Writer, threads int) io.WriteCloser {
+	if threads <= 1 && !reprod {
+		return gzip.NewWriter(w)
+	}
+	pw := &pgzipWriter{
+		w:     w,
+		buf:   make([]byte, 0, gzipBlockSize),
+		queue: make(chan chan gzipResult, threads),
+		done:  make(chan error, 1),
+	}
+	go pw.drain()
+	return pw
+}
+
+// drain writes the compressed blocks out in the order they were queued.
+func (pw *pgzipWriter) drain() {
+	var err error
+	var written int64
+	for res := range pw.queue {
+		r := <-res
+		if err != nil {
+			continue
+		}
+		if r.err != nil {
+			err = r.err
+			pw.fail(err)
+			continue
+		}
+		pw.blocks = append(pw.blocks, tarball.IndexBlock{
+			Offset:    written,
+			RawOffset: int64(len(pw.blocks)) * gzipBlockSize,
+		})
+		n, werr := pw.w.Write(r.data)
+		written += int64(n)
+		if werr != nil {
+			err = werr
+			pw.fail(err)
+		}
+	}
+	pw.done <- err
+}
+
+func (pw *pgzipWriter) fail(err error) {
+	pw.mu.Lock()
+	pw.err = err
+	pw.mu.Unlock()
+}
+
+func (pw *pgzipWriter) failed() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+func (pw *pgzipWriter) Write(p []byte) (int, error) {
+	if err := pw.failed(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		space := gzipBlockSize - len(pw.buf)
+		if space > len(p) {
+			space = len(p)
+		}
+		pw.buf = append(pw.buf, p[:space]...)
+		p = p[space:]
+		if len(pw.buf) == gzipBlockSize {
+			pw.flush()
+		}
+	}
+	return n, nil
+}
+
+func (pw *pgzipWriter) flush() {
+	if len(pw.buf) == 0 {
+		return
+	}
+	block := pw.buf
+	pw.buf = make([]byte, 0, gzipBlockSize)
+	res := make(chan gzipResult, 1)
+	pw.queue <- res
+	go func() {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		_, err := zw.Write(block)
+		if err == nil {
+			err = zw.Close()
+		}
+		res <- gzipResult{data: b.Bytes(), err: err}
+	}()
+}
+
+// Close compresses what is left and waits for every block to be written.
+func (pw *pgzipWriter) Close() error {
+	pw.flush()
+	close(pw.queue)
+	return <-pw.done
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const progressWidth = 30
+
+// progress renders a progress bar with throughput and ETA for -progress.
+// A total of zero means the size is unknown, in which case only the byte
+// count and throughput are shown.
+type progress struct {
+	w     io.Writer
+	total int64
+	done  int64
+	start time.Time
+	last  time.Time
+}
+
+func newProgress(w io.Writer, total int64) *progress {
+	now := time.Now()
+	return &progress{w: w, total: total, start: now, last: now}
+}
+
+func (p *progress) add(n int) {
+	p.done += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= 200*time.Millisecond {
+		p.last = now
+		p.render()
+	}
+}
+
+func (p *progress) render() {
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+	if p.total <= 0 {
+		fmt.Fprintf(p.w, "\r%s %s/s   ", humanSize(p.done), humanSize(int64(rate)))
+		return
+	}
+
+	done := p.done
+	if done > p.total {
+		done = p.total
+	}
+	filled := int(done * progressWidth / p.total)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+	eta := "--:--"
+	if rate > 0 {
+		eta = formatDuration(time.Duration(float64(p.total-done) / rate * float64(time.Second)))
+	}
+	fmt.Fprintf(p.w, "\r[%s] %3d%% %s %s/s ETA %s   ", bar, done*100/p.total, humanSize(p.done), humanSize(int64(rate)), eta)
+}
+
+// finish draws the final state and ends the progress line.
+func (p *progress) finish() {
+	if p.total > 0 && p.done < p.total {
+		p.done = p.total
+	}
+	p.render()
+	fmt.Fprintln(p.w)
+}
+
+func formatDuration(d time.Duration) string {
+	secs := int64(d.Round(time.Second) / time.Second)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.add(n)
+	return n, err
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.add(n)
+	return n, err
+}
+
+// Seek lets a progressReader stand in for a seekable tarball, restarting
+// the count when the tarball is rewound.
+func (pr *progressReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := pr.r.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("Cannot seek in the tarball")
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err == nil {
+		pr.p.done = pos
+	}
+	return pos, err
+}
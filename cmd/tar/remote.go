@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first Range request of a sequential read fetches remoteWindow
+// bytes; each following one twice as many, up to remoteMaxWindow.
+const (
+	remoteWindow    = 32 << 10
+	remoteMaxWindow = 8 << 20
+)
+
+// isRemote reports whether the -f name is an http:// or https:// URL or
+// an s3:// URI.
+func isRemote(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") || isS3(name)
+}
+
+// remoteFile reads a tarball over HTTP with Range requests, so that
+// seeking skips the parts that are not needed instead of downloading them.
+type remoteFile struct {
+	url  string
+	sign func(*http.Request)
+	info remoteInfo
+	pos  int64
+	// buf holds the bytes last fetched, from bufOff on, and window is how
+	// many to fetch next.
+	buf    []byte
+	bufOff int64
+	window int
+}
+
+// remoteStream reads a tarball from a server that ignores Range requests,
+// which can only be read through.
+type remoteStream struct {
+	io.ReadCloser
+	info remoteInfo
+}
+
+// openRemote opens the tarball at url for reading, signing the requests
+// with sign when it is not nil.
+func openRemote(url string, sign func(*http.Request)) (tarballFile, error) {
+	resp, err := fetchRange(url, sign, 0, remoteWindow)
+	if err != nil {
+		return nil, err
+	}
+	info := remoteInfo{name: path.Base(resp.Request.URL.Path), size: resp.ContentLength}
+	info.mtime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if resp.StatusCode == http.StatusOK {
+		return &remoteStream{ReadCloser: resp.Body, info: info}, nil
+	}
+	defer resp.Body.Close()
+	if info.size, err = rangeTotal(resp); err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s: %s", url, err)
+	}
+	return &remoteFile{url: url, sign: sign, info: info, buf: buf, window: remoteWindow}, nil
+}
+
+// fetchRange requests n bytes of url from off on. The response is a 206
+// with the range, or a 200 with the whole file when off is 0 and the
+// server does not support ranges.
+func fetchRange(url string, sign func(*http.Request), off int64, n int) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s: %s", url, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(n)-1))
+	if sign != nil {
+		sign(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s: %s", url, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp, nil
+	case resp.StatusCode == http.StatusOK && off == 0:
+		return resp, nil
+	case resp.StatusCode == http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("Error fetching %s: the server does not support Range requests", url)
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("Error fetching %s: %s", url, resp.Status)
+}
+
+// rangeTotal returns the size of the whole file from the Content-Range
+// header of a 206 response.
+func rangeTotal(resp *http.Response) (int64, error) {
+	cr := resp.Header.Get("Content-Range")
+	i := strings.LastIndexByte(cr, '/')
+	if i < 0 {
+		return 0, fmt.Errorf("Error fetching %s: invalid Content-Range %q", resp.Request.URL, cr)
+	}
+	size, err := strconv.ParseInt(cr[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error fetching %s: invalid Content-Range %q", resp.Request.URL, cr)
+	}
+	return size, nil
+}
+
+// fetch returns up to n bytes of the file from off on.
+func (f *remoteFile) fetch(off int64, n int) ([]byte, error) {
+	if off >= f.info.size {
+		return nil, nil
+	}
+	if rest := f.info.size - off; int64(n) > rest {
+		n = int(rest)
+	}
+	resp, err := fetchRange(f.url, f.sign, off, n)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		// A whole file for a range at 0: keep only what was asked.
+		return ioutil.ReadAll(io.LimitReader(resp.Body, int64(n)))
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s: %s", f.url, err)
+	}
+	return data, nil
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if f.pos >= f.info.size {
+		return 0, io.EOF
+	}
+	end := f.bufOff + int64(len(f.buf))
+	if f.pos < f.bufOff || f.pos >= end {
+		// Fetch more at a time while reading through, and start small
+		// again after a seek.
+		if f.pos == end && f.window < remoteMaxWindow {
+			f.window *= 2
+		} else if f.pos != end {
+			f.window = remoteWindow
+		}
+		data, err := f.fetch(f.pos, f.window)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		f.buf, f.bufOff = data, f.pos
+	}
+	n := copy(p, f.buf[f.pos-f.bufOff:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+// ReadAt fetches the range asked for on its own, leaving the position
+// of Read alone, so it can be called concurrently.
+func (f *remoteFile) ReadAt(p []byte, off int64) (int, error) {
+	data, err := f.fetch(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid seek offset %d", offset)
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *remoteFile) Close() error {
+	f.buf = nil
+	return nil
+}
+
+func (f *remoteFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (s *remoteStream) Seek(offset int64, whence int) (int64, error) {
+	return 0, fmt.Errorf("Cannot seek: the server does not support Range requests")
+}
+
+func (s *remoteStream) Stat() (os.FileInfo, error) {
+	return s.info, nil
+}
+
+// remoteInfo describes a remote tarball. Its size is -1 when it is read
+// through a remoteStream and the server sent no Content-Length.
+type remoteInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+func (ri remoteInfo) Name() string       { return ri.name }
+func (ri remoteInfo) Size() int64        { return ri.size }
+func (ri remoteInfo) Mode() os.FileMode  { return 0444 }
+func (ri remoteInfo) ModTime() time.Time { return ri.mtime }
+func (ri remoteInfo) IsDir() bool        { return false }
+func (ri remoteInfo) Sys() interface{}   { return nil }
+
+// readSidecar reads the file written next to the -f tarball under name,
+// such as its index or signature, fetching it when the tarball is remote.
+// A missing file is reported with an error satisfying os.IsNotExist.
+func readSidecar(name string) ([]byte, error) {
+	if !isRemote(name) {
+		return ioutil.ReadFile(name)
+	}
+	req, err := http.NewRequest(http.MethodGet, name, nil)
+	if isS3(name) {
+		var o *s3Object
+		if o, err = openS3(name); err != nil {
+			return nil, err
+		}
+		req, err = http.NewRequest(http.MethodGet, o.url("", nil), nil)
+		if err == nil {
+			o.signEmpty(req)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s: %s", name, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s: %s", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: "get", Path: name, Err: os.ErrNotExist}
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching %s: %s", name, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of the first parts of a multipart upload. It
+// doubles every 1000 parts, so that the 10000 parts S3 allows hold
+// tarballs of any size.
+const s3PartSize = 8 << 20
+
+// emptyHash is the SHA-256 of an empty payload.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// isS3 reports whether name is an s3://bucket/key URI.
+func isS3(name string) bool {
+	return strings.HasPrefix(name, "s3://")
+}
+
+// s3Object is an object in S3 or S3-compatible storage, with the
+// credentials to reach it.
+type s3Object struct {
+	bucket string
+	key    string
+	region string
+	creds  s3Credentials
+	// endpoint is AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL, whose buckets
+	// are addressed in the path, or nil for AWS.
+	endpoint *url.URL
+}
+
+type s3Credentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+}
+
+// openS3 parses an s3://bucket/key URI and finds the credentials, region
+// and endpoint to use from the standard AWS environment variables, the
+// shared config and credentials files, and the container or instance
+// metadata service.
+func openS3(uri string) (*s3Object, error) {
+	rest := strings.TrimPrefix(uri, "s3://")
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 {
+		return nil, fmt.Errorf("Invalid S3 URI %s: expected s3://bucket/key", uri)
+	}
+	o := &s3Object{bucket: rest[:i], key: rest[i+1:]}
+	profile := awsProfile()
+	config, err := readAWSFile("AWS_CONFIG_FILE", "config", "profile "+profile)
+	if err != nil {
+		return nil, err
+	}
+	if profile == "default" && config == nil {
+		if config, err = readAWSFile("AWS_CONFIG_FILE", "config", "default"); err != nil {
+			return nil, err
+		}
+	}
+	o.region = firstOf(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), config["region"], "us-east-1")
+	if ep := firstOf(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), config["endpoint_url"]); ep != "" {
+		if o.endpoint, err = url.Parse(ep); err != nil || o.endpoint.Host == "" {
+			return nil, fmt.Errorf("Invalid S3 endpoint %s", ep)
+		}
+	}
+	if o.creds, err = awsCredentials(profile, config); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func awsProfile() string {
+	return firstOf(os.Getenv("AWS_PROFILE"), os.Getenv("AWS_DEFAULT_PROFILE"), "default")
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// readAWSFile returns the keys of section in the AWS file named by the
+// environment variable env, or else ~/.aws/name, or nil when there is no
+// such file or section.
+func readAWSFile(env, name, section string) (map[string]string, error) {
+	p := os.Getenv(env)
+	if p == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		p = filepath.Join(home, ".aws", name)
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", p, err)
+	}
+	defer f.Close()
+	var keys map[string]string
+	in := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			in = strings.TrimSpace(line[1:len(line)-1]) == section
+			if in && keys == nil {
+				keys = make(map[string]string)
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, '='); in && i > 0 {
+			keys[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", p, err)
+	}
+	return keys, nil
+}
+
+// awsCredentials looks for credentials in the order the AWS tools do.
+func awsCredentials(profile string, config map[string]string) (s3Credentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return s3Credentials{id, secret, os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	shared, err := readAWSFile("AWS_SHARED_CREDENTIALS_FILE", "credentials", profile)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	for _, keys := range []map[string]string{shared, config} {
+		if keys["aws_access_key_id"] != "" && keys["aws_secret_access_key"] != "" {
+			return s3Credentials{keys["aws_access_key_id"], keys["aws_secret_access_key"], keys["aws_session_token"]}, nil
+		}
+	}
+	if creds, ok := containerCredentials(); ok {
+		return creds, nil
+	}
+	if creds, ok := instanceCredentials(); ok {
+		return creds, nil
+	}
+	return s3Credentials{}, fmt.Errorf("No AWS credentials found for profile %s", profile)
+}
+
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+// containerCredentials asks the ECS or EKS agent named by the environment.
+func containerCredentials() (s3Credentials, bool) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		endpoint = "http://169.254.170.2" + rel
+	}
+	if endpoint == "" {
+		return s3Credentials{}, false
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return s3Credentials{}, false
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		if data, err := ioutil.ReadFile(file); err == nil {
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return metadataCredentials(req)
+}
+
+// instanceCredentials asks the EC2 instance metadata service, with a
+// session token as IMDSv2 requires.
+func instanceCredentials() (s3Credentials, bool) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return s3Credentials{}, false
+	}
+	const base = "http://169.254.169.254/latest/"
+	req, _ := http.NewRequest(http.MethodPut, base+"api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return s3Credentials{}, false
+	}
+	token, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Credentials{}, false
+	}
+	req, _ = http.NewRequest(http.MethodGet, base+"meta-data/iam/security-credentials/", nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	if resp, err = metadataClient.Do(req); err != nil {
+		return s3Credentials{}, false
+	}
+	roles, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if resp.StatusCode != http.StatusOK || role == "" {
+		return s3Credentials{}, false
+	}
+	req, _ = http.NewRequest(http.MethodGet, base+"meta-data/iam/security-credentials/"+role, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	return metadataCredentials(req)
+}
+
+func metadataCredentials(req *http.Request) (s3Credentials, bool) {
+	var creds s3Credentials
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return s3Credentials{}, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&creds) != nil {
+		return s3Credentials{}, false
+	}
+	return creds, creds.AccessKeyID != ""
+}
+
+// url returns the URL of the object, or of o.key+suffix, with query.
+func (o *s3Object) url(suffix string, query url.Values) string {
+	u := url.URL{Scheme: "https", Host: "s3." + o.region + ".amazonaws.com"}
+	escaped := "/" + s3Escape(o.key+suffix, true)
+	if o.endpoint != nil {
+		u.Scheme, u.Host = o.endpoint.Scheme, o.endpoint.Host
+		escaped = strings.TrimSuffix(o.endpoint.EscapedPath(), "/") + "/" + s3Escape(o.bucket, false) + escaped
+	} else if strings.Contains(o.bucket, ".") {
+		// Virtual-hosted names with dots do not match the certificate.
+		escaped = "/" + s3Escape(o.bucket, false) + escaped
+	} else {
+		u.Host = o.bucket + "." + u.Host
+	}
+	u.Path, _ = url.PathUnescape(escaped)
+	u.RawPath = escaped
+	u.RawQuery = s3Query(query)
+	return u.String()
+}
+
+// s3Escape percent-encodes s as Signature Version 4 requires, keeping
+// slashes when slash is set.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && slash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query sorted by name, as signing needs it.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, v := range query[name] {
+			parts = append(parts, s3Escape(name, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sign adds a Signature Version 4 authorization to req, whose payload
+// has the SHA-256 payloadHash.
+func (o *s3Object) sign(req *http.Request, payloadHash string) {
+	o.signAt(req, payloadHash, time.Now().UTC())
+}
+
+func (o *s3Object) signAt(req *http.Request, payloadHash string, now time.Time) {
+	stamp := now.Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if o.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", o.creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payloadHash)
+
+	scope := day + "/" + o.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + o.creds.SecretAccessKey)
+	for _, part := range []string{day, o.region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		o.creds.AccessKeyID, scope, signed, key))
+}
+
+// signEmpty signs a request without a payload, for fetchRange.
+func (o *s3Object) signEmpty(req *http.Request) {
+	o.sign(req, emptyHash)
+}
+
+// do sends a signed request with body, returning an error that includes
+// the S3 error message unless the response is a success.
+func (o *s3Object) do(method, rawurl string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	o.sign(req, hex.EncodeToString(sum[:]))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp, nil
+}
+
+func s3Error(resp *http.Response) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("%s: %s: %s", resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
+
+// openS3Input opens the s3:// tarball for reading with ranged GETs.
+func openS3Input(uri string) (tarballFile, error) {
+	o, err := openS3(uri)
+	if err != nil {
+		return nil, err
+	}
+	return openRemote(o.url("", nil), o.signEmpty)
+}
+
+// s3Writer uploads a tarball as it is written: a single PUT when it fits
+// in one part, and a multipart upload of parts sent in turn otherwise, so
+// only one part is held in memory.
+type s3Writer struct {
+	obj      *s3Object
+	uri      string
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+	err      error
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func newS3Writer(uri string) (*s3Writer, error) {
+	o, err := openS3(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{obj: o, uri: uri}, nil
+}
+
+func (w *s3Writer) partSize() int {
+	return s3PartSize << uint(len(w.parts)/1000)
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= w.partSize() {
+		size := w.partSize()
+		if w.err = w.upload(w.buf[:size]); w.err != nil {
+			return 0, w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[size:]...)
+	}
+	return len(p), nil
+}
+
+// upload sends part as the next part of the multipart upload, starting
+// the upload first if need be.
+func (w *s3Writer) upload(part []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.obj.do(http.MethodPost, w.obj.url("", url.Values{"uploads": {""}}), nil)
+		if err != nil {
+			return fmt.Errorf("Error starting the upload to %s: %s", w.uri, err)
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || result.UploadID == "" {
+			return fmt.Errorf("Error starting the upload to %s: no upload id", w.uri)
+		}
+		w.uploadID = result.UploadID
+	}
+	n := len(w.parts) + 1
+	query := url.Values{"partNumber": {fmt.Sprint(n)}, "uploadId": {w.uploadID}}
+	resp, err := w.obj.do(http.MethodPut, w.obj.url("", query), part)
+	if err != nil {
+		return fmt.Errorf("Error uploading part %d to %s: %s", n, w.uri, err)
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{n, resp.Header.Get("ETag")})
+	return nil
+}
+
+// Close sends what is left and completes the upload, or aborts it after
+// an error, so no partial object is left behind.
+func (w *s3Writer) Close() error {
+	if w.err == nil && w.uploadID == "" {
+		resp, err := w.obj.do(http.MethodPut, w.obj.url("", nil), w.buf)
+		if err != nil {
+			return fmt.Errorf("Error uploading to %s: %s", w.uri, err)
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if w.err == nil && len(w.buf) > 0 {
+		w.err = w.upload(w.buf)
+	}
+	if w.err == nil {
+		w.err = w.complete()
+	}
+	if w.err != nil && w.uploadID != "" {
+		if resp, err := w.obj.do(http.MethodDelete, w.obj.url("", url.Values{"uploadId": {w.uploadID}}), nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+	return w.err
+}
+
+func (w *s3Writer) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := w.obj.do(http.MethodPost, w.obj.url("", url.Values{"uploadId": {w.uploadID}}), body)
+	if err != nil {
+		return fmt.Errorf("Error completing the upload to %s: %s", w.uri, err)
+	}
+	defer resp.Body.Close()
+	// S3 may report a failure in the body of a 200 response.
+	data, _ := ioutil.ReadAll(resp.Body)
+	if bytes.Contains(data, []byte("<Error>")) {
+		var e struct{ Code, Message string }
+		xml.Unmarshal(data, &e)
+		return fmt.Errorf("Error completing the upload to %s: %s: %s", w.uri, e.Code, e.Message)
+	}
+	return nil
+}
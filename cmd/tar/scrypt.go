@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+)
+
+// pbkdf2 derives keyLen bytes from pass and salt with PBKDF2-HMAC-SHA256.
+func pbkdf2(pass, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, pass)
+	key := make([]byte, 0, keyLen+sha256.Size)
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// scrypt derives keyLen bytes from pass and salt as RFC 7914 describes,
+// with cost 1<<logN, block size r and parallelization p. It needs 128*r
+// bytes times 1<<logN of memory, which makes guessing passphrases on
+// dedicated hardware expensive.
+func scrypt(pass, salt []byte, logN, r, p, keyLen int) []byte {
+	b := pbkdf2(pass, salt, 1, p*128*r)
+	x := make([]uint32, 32*r)
+	v := make([]uint32, 32*r<<uint(logN))
+	y := make([]uint32, 32*r)
+	for i := 0; i < p; i++ {
+		block := b[i*128*r : (i+1)*128*r]
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(block[4*j:])
+		}
+		roMix(x, v, y, logN, r)
+		for j, w := range x {
+			binary.LittleEndian.PutUint32(block[4*j:], w)
+		}
+	}
+	return pbkdf2(pass, b, 1, keyLen)
+}
+
+// roMix mixes x in place through the 1<<logN blocks of v, using y as
+// scratch.
+func roMix(x, v, y []uint32, logN, r int) {
+	n := 1 << uint(logN)
+	words := 32 * r
+	for i := 0; i < n; i++ {
+		copy(v[i*words:], x)
+		blockMix(x, y, r)
+	}
+	for i := 0; i < n; i++ {
+		j := int(x[words-16] & uint32(n-1))
+		for k := range x {
+			x[k] ^= v[j*words+k]
+		}
+		blockMix(x, y, r)
+	}
+}
+
+// blockMix is the scrypt BlockMix of the 2*r blocks of 16 words in b,
+// using y as scratch.
+func blockMix(b, y []uint32, r int) {
+	var t [16]uint32
+	copy(t[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := range t {
+			t[k] ^= b[i*16+k]
+		}
+		salsa8(&t)
+		// Even blocks go to the first half, odd ones to the second.
+		copy(y[(i/2+(i%2)*r)*16:], t[:])
+	}
+	copy(b, y)
+}
+
+// salsa8 applies the Salsa20/8 core to b.
+func salsa8(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
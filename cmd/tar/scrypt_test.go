@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The test vectors of RFC 7914, sections 11 and 12, but the one needing
+// 1 GiB.
+func TestScrypt(t *testing.T) {
+	tests := []struct {
+		pass, salt string
+		logN, r, p int
+		want       string
+	}{
+		{"", "", 4, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 10, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 14, 8, 1, "7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(scrypt([]byte(tt.pass), []byte(tt.salt), tt.logN, tt.r, tt.p, 64))
+		if got != tt.want {
+			t.Errorf("scrypt(%q, %q) = %s, want %s", tt.pass, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// From RFC 7914, section 11.
+	got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != want {
+		t.Errorf("pbkdf2 = %s, want %s", got, want)
+	}
+}
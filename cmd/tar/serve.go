@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// serveEntry describes a member in a JSON directory listing.
+type serveEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// serveTarball serves the members of the -f tarball over HTTP at addr:
+// directories as HTML or JSON listings, and file contents with support
+// for Range requests.
+func serveTarball(addr string) error {
+	t, err := loadTree()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Serving %s at http://%s/\n", *tfile, addr)
+	return http.ListenAndServe(addr, t)
+}
+
+func (t *archiveTree) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := path.Clean("/" + r.URL.Path)
+	n := t.lookupPath(p)
+	// Follow symbolic links within the tarball.
+	for i := 0; n != nil && n.hdr.Typeflag == tar.TypeSymlink; i++ {
+		if i == 40 {
+			n = nil
+			break
+		}
+		target := n.hdr.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		p = path.Clean("/" + target)
+		n = t.lookupPath(p)
+		if n != nil && n.children != nil {
+			http.Redirect(w, r, (&url.URL{Path: strings.TrimSuffix(p, "/") + "/"}).String(), http.StatusFound)
+			return
+		}
+	}
+	switch {
+	case n == nil:
+		http.NotFound(w, r)
+	case n.children != nil:
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, (&url.URL{Path: r.URL.Path + "/", RawQuery: r.URL.RawQuery}).String(), http.StatusMovedPermanently)
+			return
+		}
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			t.listJSON(w, n)
+		} else {
+			t.listHTML(w, n, p)
+		}
+	case n.hdr.Typeflag == tar.TypeReg || n.hdr.Typeflag == tar.TypeGNUSparse:
+		if err := t.open(n); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer t.release(n)
+		content := io.NewSectionReader(nodeReader{t, n}, 0, n.hdr.Size)
+		http.ServeContent(w, r, path.Base(p), n.hdr.ModTime, content)
+	default:
+		http.Error(w, "403 not a regular file", http.StatusForbidden)
+	}
+}
+
+func (t *archiveTree) entries(dir *treeNode) []serveEntry {
+	list := make([]serveEntry, 0, len(dir.names))
+	for _, name := range dir.names {
+		hdr := dir.children[name].hdr
+		e := serveEntry{Name: name, Type: "file", Size: hdr.Size, Mode: hdr.FileInfo().Mode().String(), ModTime: hdr.ModTime}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e.Type, e.Size = "dir", 0
+		case tar.TypeSymlink:
+			e.Type, e.Link = "symlink", hdr.Linkname
+		case tar.TypeChar, tar.TypeBlock:
+			e.Type = "device"
+		case tar.TypeFifo:
+			e.Type = "fifo"
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+func (t *archiveTree) listJSON(w http.ResponseWriter, dir *treeNode) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(t.entries(dir))
+}
+
+func (t *archiveTree) listHTML(w http.ResponseWriter, dir *treeNode, p string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	title := html.EscapeString(p)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body>\n<h1>%s</h1>\n<pre>\n", title, title)
+	if p != "/" {
+		fmt.Fprintln(w, `<a href="../">../</a>`)
+	}
+	for _, e := range t.entries(dir) {
+		name := e.Name
+		if e.Type == "dir" {
+			name += "/"
+		}
+		href := (&url.URL{Path: "./" + name}).String()
+		fmt.Fprintf(w, "%s %12d %s <a href=\"%s\">%s</a>", e.Mode, e.Size, e.ModTime.Format("2006-01-02 15:04"), html.EscapeString(href), html.EscapeString(name))
+		if e.Link != "" {
+			fmt.Fprintf(w, " -&gt; %s", html.EscapeString(e.Link))
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "</pre>\n</body></html>")
+}
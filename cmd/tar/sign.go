@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Signatures are Ed25519 over the SHA-512 digest of the tarball file, so
+// they can be made while the tarball is streamed out. They are stored in
+// base64 next to the tarball.
+
+func signaturePath(tarballPath string) string {
+	return tarballPath + ".sig"
+}
+
+func readPEM(keyPath, what string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the %s: %s", what, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("The %s is not PEM encoded", what)
+	}
+	return block.Bytes, nil
+}
+
+// loadPrivateKey reads a PKCS #8 Ed25519 private key, as written by
+// 'openssl genpkey -algorithm ed25519'.
+func loadPrivateKey(keyPath string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(keyPath, "signing key")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the signing key: %s", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("The signing key is not an Ed25519 key")
+	}
+	return priv, nil
+}
+
+// loadPublicKey reads a PKIX Ed25519 public key, as written by
+// 'openssl pkey -pubout'.
+func loadPublicKey(keyPath string) (ed25519.PublicKey, error) {
+	der, err := readPEM(keyPath, "public key")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the public key: %s", err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("The public key is not an Ed25519 key")
+	}
+	return pub, nil
+}
+
+// writeSignature signs the SHA-512 digest of the tarball and stores the
+// signature next to it.
+func writeSignature(key ed25519.PrivateKey, digest []byte) error {
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))
+	if err := ioutil.WriteFile(signaturePath(*tfile), []byte(sig+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing the signature: %s", err)
+	}
+	return nil
+}
+
+// verifiedInput is the -f tarball whose signature -verify-sig checked.
+// openInput returns it from then on, so what is read is what was verified,
+// not the tarball fetched or read again. spoolPath is the temporary copy
+// it may be, left to remove where an open file cannot be.
+var (
+	verifiedInput tarballFile
+	spoolPath     string
+)
+
+// verifiedFile is verifiedInput as returned by openInput, which stays open
+// for the next caller.
+type verifiedFile struct {
+	tarballFile
+}
+
+func (verifiedFile) Close() error { return nil }
+
+// closeVerifiedInput closes verifiedInput, removing it if a copy.
+func closeVerifiedInput() {
+	if verifiedInput != nil {
+		verifiedInput.Close()
+		verifiedInput = nil
+	}
+	if spoolPath != "" {
+		os.Remove(spoolPath)
+		spoolPath = ""
+	}
+}
+
+// regularInput reports whether f is read from regular files, which hold
+// their bytes once opened. Anything else, such as a pipe or a URL, may
+// give other bytes when read again.
+func regularInput(f tarballFile) bool {
+	if _, ok := f.(*volumeReader); ok {
+		return true
+	}
+	file, ok := f.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
+
+// verifySignature checks the -f tarball against its signature file, and
+// keeps it as verifiedInput. A tarball that is not a regular file is
+// copied to a temporary file as it is checked, and read from there.
+func verifySignature(pubPath string) error {
+	if *tfile == "-" {
+		return fmt.Errorf("-verify-sig needs a tarball file")
+	}
+	pub, err := loadPublicKey(pubPath)
+	if err != nil {
+		return err
+	}
+	data, err := readSidecar(signaturePath(*tfile))
+	if err != nil {
+		return fmt.Errorf("Error reading the signature: %s", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("Error decoding the signature: %s", err)
+	}
+
+	f, err := openInput()
+	if err != nil {
+		return err
+	}
+	h := sha512.New()
+	if !regularInput(f) {
+		spool, err := ioutil.TempFile("", "tar-verify-")
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("Error creating a copy of the tarball: %s", err)
+		}
+		if err := os.Remove(spool.Name()); err != nil {
+			spoolPath = spool.Name()
+		}
+		_, err = io.Copy(io.MultiWriter(h, spool), f)
+		f.Close()
+		verifiedInput = spool
+		if err != nil {
+			return fmt.Errorf("Error reading the tarball: %s", err)
+		}
+	} else {
+		verifiedInput = f
+		if _, err := io.Copy(h, f); err != nil {
+			return fmt.Errorf("Error reading the tarball: %s", err)
+		}
+	}
+	if !ed25519.Verify(pub, h.Sum(nil), sig) {
+		return fmt.Errorf("The signature of %s does not match", *tfile)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+//go:build darwin || dragonfly || freebsd || linux
+// +build darwin dragonfly freebsd linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// signedTarball writes the public key to dir and the signature of data
+// next to name, returning the key path.
+func signedTarball(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath := filepath.Join(dir, "key.pub")
+	if err := ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha512.Sum512(data)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, digest[:]))
+	if err := ioutil.WriteFile(signaturePath(name), []byte(sig+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return pubPath
+}
+
+// readInput reads the -f tarball as extraction would after verifying it.
+func readInput(t *testing.T) []byte {
+	t.Helper()
+	read := make(chan []byte, 1)
+	go func() {
+		f, err := openInput()
+		if err != nil {
+			read <- nil
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		read <- data
+	}()
+	select {
+	case data := <-read:
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tarball could not be read again")
+		return nil
+	}
+}
+
+func TestVerifySignatureReadsOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(saved string) { *tfile = saved }(*tfile)
+	signed := bytes.Repeat([]byte("signed"), 2000)
+
+	t.Run("pipe", func(t *testing.T) {
+		defer closeVerifiedInput()
+		*tfile = filepath.Join(dir, "fifo")
+		if err := syscall.Mkfifo(*tfile, 0600); err != nil {
+			t.Skip(err)
+		}
+		pubPath := signedTarball(t, dir, *tfile, signed)
+		go func() {
+			if f, err := os.OpenFile(*tfile, os.O_WRONLY, 0); err == nil {
+				f.Write(signed)
+				f.Close()
+			}
+		}()
+		if err := verifySignature(pubPath); err != nil {
+			t.Fatal(err)
+		}
+		if got := readInput(t); !bytes.Equal(got, signed) {
+			t.Errorf("read %d bytes after verifying, want the %d signed", len(got), len(signed))
+		}
+	})
+
+	t.Run("replaced file", func(t *testing.T) {
+		defer closeVerifiedInput()
+		*tfile = filepath.Join(dir, "t.tar")
+		if err := ioutil.WriteFile(*tfile, signed, 0644); err != nil {
+			t.Fatal(err)
+		}
+		pubPath := signedTarball(t, dir, *tfile, signed)
+		if err := verifySignature(pubPath); err != nil {
+			t.Fatal(err)
+		}
+		other := filepath.Join(dir, "other.tar")
+		if err := ioutil.WriteFile(other, []byte("unsigned"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(other, *tfile); err != nil {
+			t.Fatal(err)
+		}
+		if got := readInput(t); !bytes.Equal(got, signed) {
+			t.Errorf("read %q after verifying, want the signed tarball", got)
+		}
+	})
+}
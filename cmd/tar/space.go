@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pedroalbanese/tar/pkg/tarball"
+)
+
+// checkSpace fails when the filesystem holding dir has less room than the
+// regular files of the -f tarball take, so that -x stops before extracting
+// anything rather than halfway through. The tarball is read through once
+// for its size, so only a regular file, which can be read again, is
+// checked: not standard input, a pipe or a tarball over the network.
+func checkSpace(dir string) error {
+	if *tfile == "-" || isRemote(*tfile) {
+		return nil
+	}
+	// Even opening a FIFO could lose what its writer sends; split volumes
+	// are named after a base that need not exist.
+	if info, err := os.Stat(*tfile); err == nil && !info.Mode().IsRegular() {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("Error getting the free space of %s: %s", dir, err)
+	}
+	if free < 0 {
+		return nil
+	}
+	ifile, err := openInput()
+	if err != nil {
+		return err
+	}
+	defer ifile.Close()
+	in, done, err := decompress(ifile)
+	if err != nil {
+		return err
+	}
+	st, err := tarball.NewLister(in).Stats()
+	if err != nil {
+		done()
+		return fmt.Errorf("Error checking the free space: %s", err)
+	}
+	if err := done(); err != nil {
+		return err
+	}
+	if st.Size > free {
+		return fmt.Errorf("Not enough free space: the tarball holds %s of files and %s is free where it would be extracted; use -no-check-space to extract anyway", humanSize(st.Size), humanSize(free))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build darwin || dragonfly || freebsd || linux
+// +build darwin dragonfly freebsd linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCheckSpaceLeavesPipes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skip(err)
+	}
+	defer func(saved string) { *tfile = saved }(*tfile)
+	*tfile = fifo
+
+	data := make([]byte, 10240)
+	go func() {
+		if f, err := os.OpenFile(fifo, os.O_WRONLY, 0); err == nil {
+			f.Write(data)
+			f.Close()
+		}
+	}()
+	if err := checkSpace(dir); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan int, 1)
+	go func() {
+		f, err := os.Open(fifo)
+		if err != nil {
+			read <- 0
+			return
+		}
+		got, _ := ioutil.ReadAll(f)
+		f.Close()
+		read <- len(got)
+	}()
+	select {
+	case n := <-read:
+		if n != len(data) {
+			t.Errorf("read %d bytes from the pipe after the check, want %d", n, len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the check read the pipe")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// totalsFlag is a flag.Value for -totals, which may be given alone for a
+// line of text or as -totals=json.
+type totalsFlag struct {
+	format *string
+}
+
+func (f totalsFlag) IsBoolFlag() bool { return true }
+
+func (f totalsFlag) String() string {
+	if f.format == nil {
+		return ""
+	}
+	return *f.format
+}
+
+func (f totalsFlag) Set(value string) error {
+	switch value {
+	case "true", "text":
+		*f.format = "text"
+	case "json":
+		*f.format = "json"
+	default:
+		return fmt.Errorf("Invalid totals format %q: expected text or json", value)
+	}
+	return nil
+}
+
+// totals measures what -c, -a and -u read and write, for -totals.
+type totals struct {
+	format string
+	start  time.Time
+	read   int64
+}
+
+// newTotals starts measuring, or returns nil without -totals.
+func newTotals() *totals {
+	if totalsF == "" || dryRun {
+		return nil
+	}
+	return &totals{format: totalsF, start: time.Now()}
+}
+
+// report wraps the reporter r of an Archiver or Editor to add up the sizes
+// of the files read.
+func (t *totals) report(r func(*tar.Header)) func(*tar.Header) {
+	if t == nil {
+		return r
+	}
+	return func(hdr *tar.Header) {
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeGNUSparse {
+			t.read += hdr.Size
+		}
+		if r != nil {
+			r(hdr)
+		}
+	}
+}
+
+// print writes the summary to stderr, with written the bytes of tarball
+// written once compressed.
+func (t *totals) print(written int64) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(t.start).Seconds()
+	var ratio, rate float64
+	if written > 0 {
+		ratio = float64(t.read) / float64(written)
+	}
+	if elapsed > 0 {
+		rate = float64(t.read) / elapsed
+	}
+	if t.format == "json" {
+		json.NewEncoder(os.Stderr).Encode(struct {
+			Read    int64   `json:"bytes_read"`
+			Written int64   `json:"bytes_written"`
+			Ratio   float64 `json:"ratio"`
+			Seconds float64 `json:"seconds"`
+			Rate    float64 `json:"bytes_per_second"`
+		}{t.read, written, ratio, elapsed, rate})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Total bytes read: %d (%s), written: %d (%s), ratio %.2f, in %.2fs (%s/s)\n",
+		t.read, humanSize(t.read), written, humanSize(written), ratio, elapsed, humanSize(int64(rate)))
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// tarballSize returns the size of the -f tarball on disk, or 0 when it
+// cannot be found.
+func tarballSize() int64 {
+	info, err := os.Stat(*tfile)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// treeNode is a file or directory of a mounted or served tarball.
+type treeNode struct {
+	ino uint64
+	hdr *tar.Header
+	// offset is where the content starts in a plain tarball file, or -1
+	// when it has to be read by decompressing up to member number index.
+	offset int64
+	index  int
+	nlink  uint32
+	// children and names, kept sorted, list the entries of a directory.
+	children map[string]*treeNode
+	names    []string
+}
+
+// archiveTree is the in-memory index of the members of the -f tarball that
+// -mount and -serve expose. Contents are read on demand.
+type archiveTree struct {
+	nodes []*treeNode
+	// file is the -f tarball when it is a plain tar file, read in place.
+	file io.ReaderAt
+	// cache holds the contents of the open members read by decompressing,
+	// with the number of times each is open, guarded by mu.
+	mu    sync.Mutex
+	cache map[uint64][]byte
+	refs  map[uint64]int
+}
+
+// loadTree reads the headers of the -f tarball into a tree.
+func loadTree() (*archiveTree, error) {
+	t := &archiveTree{cache: make(map[uint64][]byte), refs: make(map[uint64]int)}
+	t.newNode(&tar.Header{Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Now()})
+
+	ifile, err := openInput()
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := ifile.(io.ReaderAt); ok && t.plain(ifile) {
+		t.file = f
+		return t, t.load(ifile, ifile)
+	}
+	defer ifile.Close()
+	in, done, err := decompress(ifile)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.load(in, nil); err != nil {
+		done()
+		return nil, err
+	}
+	return t, done()
+}
+
+// plain reports whether f is an uncompressed, unencrypted tar file whose
+// members can be read at their offsets.
+func (t *archiveTree) plain(f tarballFile) bool {
+	if *tfile == "-" || cprog != "" || nested != "" {
+		return false
+	}
+	r, head, err := peek(f, len(encMagic))
+	if err != nil || string(head) == encMagic {
+		return false
+	}
+	_, format, err := sniff(r)
+	return err == nil && format == ""
+}
+
+// load adds the members read from r to t. When seeker is the file r reads
+// from, the offsets of their contents are recorded.
+func (t *archiveTree) load(r io.Reader, seeker io.Seeker) error {
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Error reading the tarball: %s", err)
+		}
+		offset := int64(-1)
+		if seeker != nil && hdr.Typeflag == tar.TypeReg && !isSparseHeader(hdr) {
+			if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+				return fmt.Errorf("Error reading the tarball: %s", err)
+			}
+		}
+		t.add(hdr, offset, index)
+	}
+}
+
+func isSparseHeader(hdr *tar.Header) bool {
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return hdr.Typeflag == tar.TypeGNUSparse
+}
+
+func (t *archiveTree) newNode(hdr *tar.Header) *treeNode {
+	n := &treeNode{ino: uint64(len(t.nodes) + 1), hdr: hdr, offset: -1, nlink: 1}
+	if hdr.Typeflag == tar.TypeDir {
+		n.children, n.nlink = make(map[string]*treeNode), 2
+	}
+	t.nodes = append(t.nodes, n)
+	return n
+}
+
+// add places the member hdr in the tree, creating the directories above
+// it that the tarball does not hold. A later member replaces an earlier
+// one of the same name, as extracting would.
+func (t *archiveTree) add(hdr *tar.Header, offset int64, index int) {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return
+	}
+	dir := t.dir(path.Dir(name))
+	base := path.Base(name)
+	if hdr.Typeflag == tar.TypeLink {
+		if target := t.lookupPath(path.Clean("/" + hdr.Linkname)); target != nil && target.children == nil {
+			target.nlink++
+			dir.link(base, target)
+		}
+		return
+	}
+	if old := dir.children[base]; old != nil && (old.children != nil) == (hdr.Typeflag == tar.TypeDir) {
+		// Keep the inode, and the entries of a directory.
+		old.hdr, old.offset, old.index = hdr, offset, index
+		return
+	}
+	n := t.newNode(hdr)
+	n.offset, n.index = offset, index
+	dir.link(base, n)
+}
+
+// dir returns the directory node at p, creating it and its parents.
+func (t *archiveTree) dir(p string) *treeNode {
+	n := t.nodes[0]
+	if p == "/" {
+		return n
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		child := n.children[part]
+		if child == nil || child.children == nil {
+			child = t.newNode(&tar.Header{Typeflag: tar.TypeDir, Mode: 0755, ModTime: n.hdr.ModTime})
+			n.link(part, child)
+		}
+		n = child
+	}
+	return n
+}
+
+func (t *archiveTree) lookupPath(p string) *treeNode {
+	n := t.nodes[0]
+	if p == "/" {
+		return n
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		if n = n.children[part]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (n *treeNode) link(name string, child *treeNode) {
+	if _, ok := n.children[name]; !ok {
+		i := sort.SearchStrings(n.names, name)
+		n.names = append(n.names, "")
+		copy(n.names[i+1:], n.names[i:])
+		n.names[i] = name
+	}
+	n.children[name] = child
+}
+
+func (t *archiveTree) node(ino uint64) *treeNode {
+	if ino == 0 || ino > uint64(len(t.nodes)) {
+		return nil
+	}
+	return t.nodes[ino-1]
+}
+
+// open makes the content of n readable, decompressing it into memory
+// when the tarball cannot be read in place.
+func (t *archiveTree) open(n *treeNode) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refs[n.ino]++
+	if n.offset >= 0 || t.cache[n.ino] != nil {
+		return nil
+	}
+	data, err := t.readMember(n.index)
+	if err != nil {
+		t.refs[n.ino]--
+		return err
+	}
+	t.cache[n.ino] = data
+	return nil
+}
+
+func (t *archiveTree) release(n *treeNode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.refs[n.ino]--; t.refs[n.ino] <= 0 {
+		t.refs[n.ino], t.cache[n.ino] = 0, nil
+	}
+}
+
+// readAt reads the content of the open node n at off.
+func (t *archiveTree) readAt(n *treeNode, buf []byte, off int64) (int, error) {
+	if off >= n.hdr.Size {
+		return 0, nil
+	}
+	if int64(len(buf)) > n.hdr.Size-off {
+		buf = buf[:n.hdr.Size-off]
+	}
+	if n.offset >= 0 {
+		k, err := t.file.ReadAt(buf, n.offset+off)
+		if err == io.EOF {
+			err = nil
+		}
+		return k, err
+	}
+	t.mu.Lock()
+	data := t.cache[n.ino]
+	t.mu.Unlock()
+	return copy(buf, data[off:]), nil
+}
+
+// nodeReader reads the content of an open node as an io.ReaderAt.
+type nodeReader struct {
+	t *archiveTree
+	n *treeNode
+}
+
+func (r nodeReader) ReadAt(buf []byte, off int64) (int, error) {
+	k, err := r.t.readAt(r.n, buf, off)
+	if err == nil && k < len(buf) {
+		err = io.EOF
+	}
+	return k, err
+}
+
+// readMember reads the content of member number index by decompressing
+// the tarball up to it.
+func (t *archiveTree) readMember(index int) ([]byte, error) {
+	ifile, err := openInput()
+	if err != nil {
+		return nil, err
+	}
+	defer ifile.Close()
+	in, done, err := decompress(ifile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	tr := tar.NewReader(in)
+	for i := 0; i <= index; i++ {
+		if _, err := tr.Next(); err != nil {
+			return nil, fmt.Errorf("Error reading the tarball: %s", err)
+		}
+	}
+	return ioutil.ReadAll(tr)
+}
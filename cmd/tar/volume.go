@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tarballFile is the -f tarball opened for reading: a single file, stdin,
+// or a set of volumes read as one.
+type tarballFile interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+func volumeName(base string, n int) string {
+	return fmt.Sprintf("%s.%03d", base, n)
+}
+
+// parseSize parses a byte count with an optional K, M, G or T suffix, in
+// powers of 1024.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("Invalid size: empty")
+	}
+	digits, mult := s, int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("Invalid size: %s", s)
+	}
+	return n * mult, nil
+}
+
+// volumeWriter splits the tarball into volumes of a fixed size named
+// base.001, base.002 and so on. Members may span volumes.
+type volumeWriter struct {
+	base string
+	size int64
+	cur  *os.File
+	n    int64
+	num  int
+}
+
+func newVolumeWriter(base string, size int64) *volumeWriter {
+	return &volumeWriter{base: base, size: size}
+}
+
+func (vw *volumeWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if vw.cur == nil || vw.n == vw.size {
+			if err := vw.next(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if room := vw.size - vw.n; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := vw.cur.Write(chunk)
+		written += n
+		vw.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (vw *volumeWriter) next() error {
+	if vw.cur != nil {
+		if err := closeOutput(vw.cur); err != nil {
+			return err
+		}
+	}
+	vw.num++
+	f, err := os.Create(volumeName(vw.base, vw.num))
+	if err != nil {
+		return err
+	}
+	vw.cur, vw.n = f, 0
+	return nil
+}
+
+// Close closes the last volume and removes the volumes following it left
+// by an earlier, larger tarball, which openVolumes would read back as part
+// of this one.
+func (vw *volumeWriter) Close() error {
+	if vw.cur == nil {
+		// Nothing was written; still leave an empty first volume.
+		if err := vw.next(); err != nil {
+			return err
+		}
+	}
+	if err := closeOutput(vw.cur); err != nil {
+		return err
+	}
+	for n := vw.num + 1; ; n++ {
+		err := os.Remove(volumeName(vw.base, n))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error removing the stale volume %s: %s", volumeName(vw.base, n), err)
+		}
+	}
+}
+
+// volumeReader reads volumes back as a single seekable stream.
+type volumeReader struct {
+	files []*os.File
+	sizes []int64
+	total int64
+	pos   int64
+}
+
+// openVolumes opens base.001 and the volumes following it.
+func openVolumes(base string) (*volumeReader, error) {
+	vr := &volumeReader{}
+	for n := 1; ; n++ {
+		f, err := os.Open(volumeName(base, n))
+		if os.IsNotExist(err) && n > 1 {
+			break
+		}
+		if err != nil {
+			vr.Close()
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			vr.Close()
+			return nil, err
+		}
+		vr.files = append(vr.files, f)
+		vr.sizes = append(vr.sizes, info.Size())
+		vr.total += info.Size()
+	}
+	return vr, nil
+}
+
+func (vr *volumeReader) Read(p []byte) (int, error) {
+	start := int64(0)
+	for i, f := range vr.files {
+		if vr.pos < start+vr.sizes[i] {
+			n, err := f.ReadAt(p[:min64(int64(len(p)), start+vr.sizes[i]-vr.pos)], vr.pos-start)
+			vr.pos += int64(n)
+			if err == io.EOF {
+				err = nil
+			}
+			if n == 0 && err == nil {
+				return 0, fmt.Errorf("Volume %s changed while reading", f.Name())
+			}
+			return n, err
+		}
+		start += vr.sizes[i]
+	}
+	return 0, io.EOF
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (vr *volumeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += vr.pos
+	case io.SeekEnd:
+		offset += vr.total
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid seek offset")
+	}
+	vr.pos = offset
+	return offset, nil
+}
+
+func (vr *volumeReader) Close() error {
+	for _, f := range vr.files {
+		f.Close()
+	}
+	return nil
+}
+
+// Stat describes the first volume, with the size of all of them.
+func (vr *volumeReader) Stat() (os.FileInfo, error) {
+	info, err := vr.files[0].Stat()
+	if err != nil {
+		return nil, err
+	}
+	return volumeInfo{info, vr.total}, nil
+}
+
+type volumeInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (vi volumeInfo) Size() int64 {
+	return vi.size
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"512", 512},
+		{"10K", 10 << 10},
+		{"3m", 3 << 20},
+		{"1T", 1 << 40},
+		{"8388607T", 8388607 << 40},
+		{"8388608T", -1},
+		{"9223372036854775808", -1},
+		{"", -1},
+		{"0", -1},
+		{"-1K", -1},
+		{"K", -1},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.s)
+		if tt.want < 0 {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+}
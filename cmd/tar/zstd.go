@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pedroalbanese/tar/pkg/tarball"
+)
+
+// maxDictSamples bounds the files handed to zstd --train; more samples
+// slow training down without improving the dictionary much.
+const maxDictSamples = 10000
+
+// isZstd reports whether the -I program prog runs zstd.
+func isZstd(prog string) bool {
+	args := strings.Fields(prog)
+	if len(args) == 0 {
+		return false
+	}
+	name := strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+	return name == "zstd" || name == "zstdmt"
+}
+
+// zstdDictArgs returns the zstd arguments for the -zstd-dict dictionary,
+// kept as one argument whatever its path holds.
+func zstdDictArgs() []string {
+	if zstdDict == "" {
+		return nil
+	}
+	return []string{"-D", zstdDict}
+}
+
+// filterCommand splits the -I program into its arguments, adding the
+// -zstd-dict dictionary when it runs zstd.
+func filterCommand(prog string) []string {
+	args := strings.Fields(prog)
+	if isZstd(prog) {
+		args = append(args, zstdDictArgs()...)
+	}
+	return args
+}
+
+// trainDict builds a zstd dictionary in dictPath from the regular files
+// the named paths would add to a tarball, honoring -exclude and .tarignore.
+func trainDict(dictPath string) error {
+	if *mfile != "" || *oci {
+		return fmt.Errorf("-train-dict cannot be used with -manifest or -oci")
+	}
+	var samples []string
+	a := tarball.NewArchiver(ioutil.Discard)
+	a.Exclude = excludes
+	a.Matching = matchOpt
+	a.IgnoreFile = ".tarignore"
+	a.ExcludeVCS = excVCS
+	a.VCSIgnores = vcsIgn
+	a.ExcludeCaches = caches
+	a.OneFileSystem = oneFS
+	a.NoRecursion = noRecurs
+	a.Dereference = derefer
+	a.HardDereference = hardDer
+	a.Newer, a.NewerMtime = newer, newerMF != ""
+	a.Filter = func(hdr *tar.Header) bool {
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 && len(samples) < maxDictSamples {
+			samples = append(samples, hdr.Name)
+		}
+		return false
+	}
+	if err := addPaths(a, flag.Args()); err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("No files to train the dictionary on")
+	}
+
+	cmd := exec.Command("zstd", append([]string{"--train", "-q", "-o", dictPath}, samples...)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error training the zstd dictionary: %s", err)
+	}
+	return nil
+}
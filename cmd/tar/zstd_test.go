@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilterCommand(t *testing.T) {
+	defer func(saved string) { zstdDict = saved }(zstdDict)
+	zstdDict = "/my dicts/json dict"
+	tests := []struct {
+		prog string
+		want []string
+	}{
+		{"zstd", []string{"zstd", "-D", zstdDict}},
+		{"/usr/bin/zstd -19 -T0", []string{"/usr/bin/zstd", "-19", "-T0", "-D", zstdDict}},
+		{"xz -9", []string{"xz", "-9"}},
+	}
+	for _, tt := range tests {
+		if got := filterCommand(tt.prog); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("filterCommand(%q) = %q, want %q", tt.prog, got, tt.want)
+		}
+	}
+}
+
+func TestZstdDictRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+	dir, err := ioutil.TempDir("", "tar dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var samples []string
+	for i := 0; i < 200; i++ {
+		sample := filepath.Join(dir, fmt.Sprintf("s%d.json", i))
+		data := fmt.Sprintf(`{"id": %d, "name": "member %d", "kind": "sample", "tags": ["a", "b"]}`, i, i*7)
+		if err := ioutil.WriteFile(sample, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, sample)
+	}
+	defer func(saved string) { zstdDict = saved }(zstdDict)
+	zstdDict = filepath.Join(dir, "json dict")
+	train := exec.Command("zstd", append([]string{"--train", "-q", "--maxdict=4096", "-o", zstdDict}, samples...)...)
+	if out, err := train.CombinedOutput(); err != nil {
+		t.Skipf("zstd --train failed: %s: %s", err, out)
+	}
+
+	plain := []byte(`{"id": 1000, "name": "member 7000", "kind": "sample", "tags": ["a", "b"]}`)
+	var sealed bytes.Buffer
+	zw, err := newFilterWriter(filterCommand("zstd -q"), &sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(plain)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, done, err := openDecompressor(&sealed, "zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := done(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("got %q back, want %q", got, plain)
+	}
+}
@@ -0,0 +1,232 @@
+package tarball
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// POSIX.1e ACLs are stored in the text form GNU tar and star use, one
+// entry per line, under these PAX records. On Linux they are read from and
+// written to the extended attributes holding them.
+const (
+	aclAccessKey  = "SCHILY.acl.access"
+	aclDefaultKey = "SCHILY.acl.default"
+
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// Tags of ACL entries in the kernel's binary form, in the order entries
+// must come.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclVersion   = 2
+	aclUndefined = 0xffffffff
+)
+
+var aclTagNames = map[uint16]string{
+	aclUserObj:  "user",
+	aclUser:     "user",
+	aclGroupObj: "group",
+	aclGroup:    "group",
+	aclMask:     "mask",
+	aclOther:    "other",
+}
+
+type aclEntry struct {
+	tag, perm uint16
+	id        uint32
+}
+
+// addACLs stores the access ACL of src, and the default ACL of a
+// directory, in header. Access ACLs no richer than the mode are left out.
+func (a *Archiver) addACLs(header *tar.Header, src string) error {
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	records := []struct{ key, xattr string }{{aclAccessKey, aclAccessXattr}}
+	if header.Typeflag == tar.TypeDir {
+		records = append(records, struct{ key, xattr string }{aclDefaultKey, aclDefaultXattr})
+	}
+	for _, r := range records {
+		value, err := getXattr(src, r.xattr)
+		if err != nil {
+			return fmt.Errorf("Error reading the ACL of %s: %s", src, err)
+		}
+		if value == nil {
+			continue
+		}
+		entries, err := parseACLBinary(value)
+		if err != nil {
+			return fmt.Errorf("Error reading the ACL of %s: %s", src, err)
+		}
+		if r.key == aclAccessKey && len(entries) <= 3 {
+			continue
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[r.key] = aclText(entries, a.NumericOwner)
+	}
+	return nil
+}
+
+// setACLs applies the ACLs stored in hdr to destPath. Those that cannot
+// be applied are listed in e.Skipped.
+func (e *Extractor) setACLs(hdr *tar.Header, destPath string) {
+	for _, r := range []struct{ key, xattr string }{{aclAccessKey, aclAccessXattr}, {aclDefaultKey, aclDefaultXattr}} {
+		text, ok := hdr.PAXRecords[r.key]
+		if !ok || text == "" {
+			continue
+		}
+		value, err := e.parseACLText(text)
+		if err == nil {
+			err = setXattr(destPath, r.xattr, string(value))
+		}
+		if err != nil {
+			e.Skipped = append(e.Skipped, fmt.Sprintf("%s: ACL: %s", hdr.Name, err))
+		}
+	}
+}
+
+func parseACLBinary(b []byte) ([]aclEntry, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 || binary.LittleEndian.Uint32(b) != aclVersion {
+		return nil, errors.New("unknown ACL format")
+	}
+	var entries []aclEntry
+	for b = b[4:]; len(b) > 0; b = b[8:] {
+		entries = append(entries, aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return entries, nil
+}
+
+// aclText formats entries one per line, naming the users and groups that
+// exist here unless numeric is set.
+func aclText(entries []aclEntry, numeric bool) string {
+	var b strings.Builder
+	for _, en := range entries {
+		qualifier := ""
+		if en.tag == aclUser || en.tag == aclGroup {
+			qualifier = strconv.FormatUint(uint64(en.id), 10)
+			if !numeric {
+				if en.tag == aclUser {
+					if u, err := user.LookupId(qualifier); err == nil {
+						qualifier = u.Username
+					}
+				} else if g, err := user.LookupGroupId(qualifier); err == nil {
+					qualifier = g.Name
+				}
+			}
+		}
+		perm := []byte("---")
+		for i, c := range "rwx" {
+			if en.perm&(4>>uint(i)) != 0 {
+				perm[i] = byte(c)
+			}
+		}
+		fmt.Fprintf(&b, "%s:%s:%s\n", aclTagNames[en.tag], qualifier, perm)
+	}
+	return b.String()
+}
+
+// parseACLText parses an ACL in text form, with entries separated by
+// newlines or commas, into the kernel's binary form. Qualifiers are names
+// or ids; star's trailing id field is used when the name is unknown.
+func (e *Extractor) parseACLText(text string) ([]byte, error) {
+	var entries []aclEntry
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("invalid ACL entry %q", line)
+		}
+		en := aclEntry{id: aclUndefined}
+		switch fields[0] {
+		case "user", "u":
+			en.tag = aclUserObj
+		case "group", "g":
+			en.tag = aclGroupObj
+		case "mask", "m":
+			en.tag = aclMask
+		case "other", "o":
+			en.tag = aclOther
+		default:
+			return nil, fmt.Errorf("invalid ACL entry %q", line)
+		}
+		if q := fields[1]; q != "" {
+			if en.tag != aclUserObj && en.tag != aclGroupObj {
+				return nil, fmt.Errorf("invalid ACL entry %q", line)
+			}
+			en.tag <<= 1
+			id, err := strconv.Atoi(q)
+			if err != nil {
+				fallback := -1
+				if len(fields) == 4 {
+					fallback, _ = strconv.Atoi(fields[3])
+				}
+				if e.NumericOwner && fallback >= 0 {
+					id = fallback
+				} else if en.tag == aclUser {
+					id = e.ids.uid(q, fallback)
+				} else {
+					id = e.ids.gid(q, fallback)
+				}
+				if id < 0 {
+					return nil, fmt.Errorf("unknown user or group %s", q)
+				}
+			}
+			en.id = uint32(id)
+		}
+		for _, c := range fields[2] {
+			switch c {
+			case 'r':
+				en.perm |= 4
+			case 'w':
+				en.perm |= 2
+			case 'x':
+				en.perm |= 1
+			case '-':
+			default:
+				return nil, fmt.Errorf("invalid ACL entry %q", line)
+			}
+		}
+		entries = append(entries, en)
+	}
+	// The kernel takes the entries by tag, and then by id.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	b := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(b, aclVersion)
+	for i, en := range entries {
+		binary.LittleEndian.PutUint16(b[4+8*i:], en.tag)
+		binary.LittleEndian.PutUint16(b[6+8*i:], en.perm)
+		binary.LittleEndian.PutUint32(b[8+8*i:], en.id)
+	}
+	return b, nil
+}
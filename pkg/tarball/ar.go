@@ -0,0 +1,110 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArMagic starts Unix ar archives, among them Debian packages.
+const ArMagic = "!<arch>\n"
+
+// ArStream returns a tar stream of the members of the ar archive read
+// from r, in the System V (GNU) or BSD variant, so ar archives and Debian
+// packages can be listed and extracted like tarballs. Symbol tables are
+// left out. Closing the stream stops the conversion.
+func ArStream(r io.Reader) io.ReadCloser {
+	return convert(func(w io.Writer) error { return arToTar(r, w) })
+}
+
+func arToTar(r io.Reader, w io.Writer) error {
+	magic := make([]byte, len(ArMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != ArMagic {
+		return fmt.Errorf("Error reading the ar archive: not an ar archive")
+	}
+	tw := tar.NewWriter(w)
+	var longNames []byte
+	raw := make([]byte, 60)
+	for {
+		if _, err := io.ReadFull(r, raw); err == io.EOF {
+			return tw.Close()
+		} else if err != nil {
+			return fmt.Errorf("Error reading the ar archive: %s", err)
+		}
+		if string(raw[58:60]) != "`\n" {
+			return fmt.Errorf("Error reading the ar archive: invalid member header")
+		}
+		field := func(from, to int) string { return strings.TrimSpace(string(raw[from:to])) }
+		size, err := strconv.ParseInt(field(48, 58), 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("Error reading the ar archive: invalid member size")
+		}
+		padded := size%2 == 1
+		body := io.LimitReader(r, size)
+		name := field(0, 16)
+		switch {
+		case name == "//":
+			// The GNU table of the names too long for the header.
+			if longNames, err = ioutil.ReadAll(body); err != nil {
+				return fmt.Errorf("Error reading the ar archive: %s", err)
+			}
+		case name == "/" || name == "/SYM64/" || strings.HasPrefix(name, "__.SYMDEF"):
+			// Symbol tables are for the linker.
+		default:
+			if strings.HasPrefix(name, "#1/") {
+				// BSD ar stores long names before the content.
+				n, _ := strconv.Atoi(name[3:])
+				b := make([]byte, n)
+				if _, err := io.ReadFull(body, b); err != nil {
+					return fmt.Errorf("Error reading the ar archive: %s", err)
+				}
+				name, size = string(bytes.TrimRight(b, "\x00")), size-int64(n)
+			} else if strings.HasPrefix(name, "/") {
+				off, err := strconv.Atoi(name[1:])
+				if err != nil || off >= len(longNames) {
+					return fmt.Errorf("Error reading the ar archive: invalid long name %s", name)
+				}
+				name = string(longNames[off:])
+				if i := strings.Index(name, "/\n"); i >= 0 {
+					name = name[:i]
+				}
+			} else {
+				name = strings.TrimSuffix(name, "/")
+			}
+			mtime, _ := strconv.ParseInt(field(16, 28), 10, 64)
+			uid, _ := strconv.Atoi(field(28, 34))
+			gid, _ := strconv.Atoi(field(34, 40))
+			mode, _ := strconv.ParseInt(field(40, 48), 8, 64)
+			header := &tar.Header{
+				Name:     name,
+				Typeflag: tar.TypeReg,
+				Mode:     mode & 07777,
+				Uid:      uid,
+				Gid:      gid,
+				Size:     size,
+				ModTime:  time.Unix(mtime, 0),
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("Error converting %s from the ar archive: %s", name, err)
+			}
+			if _, err := io.Copy(tw, body); err != nil {
+				return fmt.Errorf("Error reading the ar archive: %s", err)
+			}
+		}
+		// Skip what is left of the member and the padding to an even
+		// offset.
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return fmt.Errorf("Error reading the ar archive: %s", err)
+		}
+		if padded {
+			if _, err := io.ReadFull(r, raw[:1]); err != nil && err != io.EOF {
+				return fmt.Errorf("Error reading the ar archive: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,654 @@
+package tarball
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Archiver writes files from disk into a tar stream.
+type Archiver struct {
+	// Report, if set, is called with the header of every member written.
+	Report func(hdr *tar.Header)
+	// Fakeroot, if set, supplies ownership, modes and device types for the
+	// members it has records of.
+	Fakeroot FakerootDB
+	// Filter, if set, is called with every header before it is written. It
+	// may modify the header, and returns false to leave the member out.
+	Filter func(hdr *tar.Header) bool
+	// Transforms rename members and the targets of links, in turn.
+	Transforms []*Transform
+	// Select, if set, leaves out the members whose names it does not
+	// select.
+	Select *RegexpFilter
+	// Sizes, if set, leaves out the regular files whose sizes it does not
+	// select.
+	Sizes *SizeFilter
+	// Confirm, if set, is asked about every file AddPath would add, and
+	// returns false to leave it out, with what it holds for a directory.
+	Confirm func(hdr *tar.Header) bool
+	// Exclude lists glob patterns for files to leave out. They are matched
+	// against the path on disk and every trailing part of it.
+	Exclude []string
+	// Matching, if set, changes how Exclude patterns match.
+	Matching *MatchOptions
+	// IgnoreFile, if set, names a file such as ".tarignore" whose
+	// gitignore-style rules apply to the directory it is found in and
+	// everything below it.
+	IgnoreFile string
+	// ExcludeVCS leaves out the directories and files of version control
+	// systems, such as .git, .hg, .svn and CVS, wherever they are found.
+	ExcludeVCS bool
+	// VCSIgnores applies the .gitignore files found in the tree as it
+	// does IgnoreFile.
+	VCSIgnores bool
+	// ExcludeCaches selects how directories tagged with CACHEDIR.TAG are
+	// archived: ExcludeCachesTag, ExcludeCachesUnder, ExcludeCachesAll,
+	// or "" to archive them like any other.
+	ExcludeCaches string
+	// OneFileSystem keeps walks on the file system of the path they start
+	// from: directories on others, such as /proc or network mounts, are
+	// archived without what they hold.
+	OneFileSystem bool
+	// NoRecursion adds the directories named without what they hold.
+	NoRecursion bool
+	// Dereference archives what symbolic links point to instead of the
+	// links, walking linked directories. Links that point nowhere are
+	// kept as links.
+	Dereference bool
+	// HardDereference stores every hard linked file with its contents
+	// instead of as a link to the first one.
+	HardDereference bool
+	// Newer, if set, leaves out the files other than directories that have
+	// not changed since: neither their contents nor, unless NewerMtime is
+	// set, their status.
+	Newer      time.Time
+	NewerMtime bool
+	// Sync flushes a tarball opened with OpenAppend to disk when closed.
+	Sync bool
+	// Index, if set, receives the offset of every member written. Offsets
+	// count from the first byte written by this Archiver.
+	Index *Index
+	// Sources, if set, receives the path on disk of every member written,
+	// keyed by member name.
+	Sources map[string]string
+	// Incremental, if set, makes AddPath leave out the files unchanged
+	// since the snapshot was taken and record the state of every file it
+	// sees. Directories are always written, listing their entries.
+	Incremental *Snapshot
+	// NumericOwner leaves user and group names out of the headers of files
+	// added from disk, keeping only the numeric ids.
+	NumericOwner bool
+	// OwnerMap and GroupMap translate the ids of files added from disk.
+	// The names of translated ids are left out, as they belong to the
+	// original ids.
+	OwnerMap IDMap
+	GroupMap IDMap
+	// Owner and Group, if set, replace the owner and group of every file
+	// added from disk.
+	Owner *Owner
+	Group *Owner
+	// ModTime, if not zero, replaces the modification time of every file
+	// added from disk, and access and change times are left out, so that
+	// builds produce the same tarball each time.
+	ModTime time.Time
+	// ClampModTime makes ModTime replace only the modification times
+	// later than it, leaving older ones as they are.
+	ClampModTime bool
+	// Skipped lists the files AddPath left out because tar cannot store
+	// them, such as sockets, or with IgnoreFailedRead, could not read.
+	Skipped []string
+	// Failed lists the files AddPath could not read. They are left out,
+	// or padded with zeros when they could not be read to the end, and the
+	// rest of the files are added.
+	Failed []string
+	// IgnoreFailedRead lists the files that could not be read in Skipped
+	// instead of Failed.
+	IgnoreFailedRead bool
+	// Sparse stores the holes of sparse files as a map instead of as
+	// zeros, in the GNU sparse format 1.0.
+	Sparse bool
+	// Xattrs, when set, stores the extended attributes it selects as
+	// SCHILY.xattr PAX records.
+	Xattrs *XattrFilter
+	// ACLs stores the POSIX.1e access ACLs of files and default ACLs of
+	// directories as SCHILY.acl PAX records.
+	ACLs bool
+	// Format is the format members are written in. The zero Format writes
+	// ustar headers, and PAX ones for the members ustar cannot store.
+	Format tar.Format
+	// LayerBase lists the members of the layers below the one AddLayer
+	// writes, so that those deleted since get whiteouts.
+	LayerBase []string
+
+	tw     *tar.Writer
+	zw     *zip.Writer
+	cw     *countingWriter
+	closer io.Closer
+	// links maps the device and inode of files with several hard links to
+	// the member the first of them was stored as.
+	links map[[2]uint64]string
+	// emitted is the header emit last wrote, or nil if it was left out.
+	emitted *tar.Header
+}
+
+// NewArchiver returns an Archiver writing a new tarball to w.
+func NewArchiver(w io.Writer) *Archiver {
+	cw := &countingWriter{w: w}
+	return &Archiver{tw: tar.NewWriter(cw), cw: cw}
+}
+
+// OpenAppend returns an Archiver that adds members to the end of an
+// existing tarball, overwriting its end-of-archive blocks, so only the new
+// members are written. Closing the Archiver closes the file.
+func OpenAppend(tarballPath string) (*Archiver, error) {
+	ofile, err := os.OpenFile(tarballPath, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the tarball file: %s", err)
+	}
+	end, err := archiveEnd(ofile)
+	if err == nil {
+		err = ofile.Truncate(end)
+	}
+	if err == nil {
+		_, err = ofile.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		ofile.Close()
+		return nil, fmt.Errorf("Error seeking to the end of the tarball: %s", err)
+	}
+	a := NewArchiver(ofile)
+	a.closer = ofile
+	return a, nil
+}
+
+// archiveEnd returns the offset of the end-of-archive blocks of f, past
+// the last member. Headers are read and contents skipped by seeking, and
+// any padding after the two zero blocks, as other tar programs write to
+// fill a record, is ignored.
+func archiveEnd(f *os.File) (int64, error) {
+	tr := tar.NewReader(f)
+	last := int64(0)
+	for {
+		_, err := tr.Next()
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		pos, serr := f.Seek(0, io.SeekCurrent)
+		if serr != nil {
+			return 0, serr
+		}
+		if err == nil {
+			last = pos
+			continue
+		}
+		// The reader stops after the two zero blocks, or at the end of a
+		// tarball written without them.
+		if pos-1024 < last {
+			return pos, nil
+		}
+		trailer := make([]byte, 1024)
+		if _, err := f.ReadAt(trailer, pos-1024); err != nil {
+			return 0, err
+		}
+		for _, b := range trailer {
+			if b != 0 {
+				return pos, nil
+			}
+		}
+		return pos - 1024, nil
+	}
+}
+
+// AddPath adds root and, if it is a directory, everything below it unless
+// NoRecursion is set. Members are named after their path on disk. Files
+// hard linked to one already added are stored as links to it.
+func (a *Archiver) AddPath(root string) error {
+	return a.walk(root, func(p string, info os.FileInfo, err error) error {
+		if info.Mode()&os.ModeSocket != 0 {
+			a.Skipped = append(a.Skipped, fmt.Sprintf("%s: socket ignored", p))
+			return nil
+		}
+		if a.Incremental != nil && !a.Incremental.changed(p, info) && !info.IsDir() {
+			return nil
+		}
+		if !a.Newer.IsZero() && !info.IsDir() && !a.newer(info) {
+			return nil
+		}
+		header, err := a.header(p, p, info)
+		if err != nil {
+			return err
+		}
+		if a.Confirm != nil && a.Select.Match(header.Name) && a.Sizes.Match(header) && !a.Confirm(header) {
+			return skipExcluded(info)
+		}
+		if a.Incremental != nil && info.IsDir() {
+			if err := addDumpdir(header, p); err != nil {
+				return err
+			}
+		}
+		if a.zw != nil || a.HardDereference || !info.Mode().IsRegular() || linkCount(info) < 2 {
+			return a.write(p, header)
+		}
+		dev, ino := fileID(info)
+		key := [2]uint64{dev, ino}
+		if first, ok := a.links[key]; ok {
+			header.Typeflag, header.Linkname, header.Size = tar.TypeLink, first, 0
+			return a.write(p, header)
+		}
+		if err := a.write(p, header); err != nil {
+			return err
+		}
+		if a.emitted != nil {
+			if a.links == nil {
+				a.links = make(map[[2]uint64]string)
+			}
+			a.links[key] = a.emitted.Name
+		}
+		return nil
+	})
+}
+
+// Close writes the end-of-archive blocks, or the central directory of a
+// zip file, and closes the underlying file when the Archiver was opened
+// with OpenAppend.
+func (a *Archiver) Close() error {
+	finish := a.tw.Close
+	if a.zw != nil {
+		finish = a.zw.Close
+	}
+	if err := finish(); err != nil {
+		if a.closer != nil {
+			a.closer.Close()
+		}
+		return fmt.Errorf("Error closing the tarball writer: %s", err)
+	}
+	if f, ok := a.closer.(*os.File); ok && a.Sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("Error writing the tarball file: %s", err)
+		}
+	}
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+// newer reports whether the file described by info was modified after
+// Newer or, unless NewerMtime is set, had its status changed after it.
+func (a *Archiver) newer(info os.FileInfo) bool {
+	if info.ModTime().After(a.Newer) {
+		return true
+	}
+	if a.NewerMtime {
+		return false
+	}
+	// archive/tar reads the change time where the system records one.
+	hdr, err := tar.FileInfoHeader(info, "")
+	return err == nil && hdr.ChangeTime.After(a.Newer)
+}
+
+// walk visits root like filepath.Walk, leaving out the paths matched by
+// Exclude, ExcludeVCS, ExcludeCaches or ignore files, and staying on one
+// file system with OneFileSystem. With Dereference, it follows symbolic
+// links.
+func (a *Archiver) walk(root string, fn filepath.WalkFunc) error {
+	var names []string
+	if a.VCSIgnores {
+		names = append(names, ".gitignore")
+	}
+	if a.IgnoreFile != "" {
+		names = append(names, a.IgnoreFile)
+	}
+	var ignores *ignoreRules
+	if len(names) > 0 {
+		ignores = newIgnoreRules(names...)
+	}
+	walk := filepath.Walk
+	if a.Dereference {
+		walk = walkFollow
+	}
+	var rootDev uint64
+	return walk(root, func(p string, info os.FileInfo, err error) error {
+		// A directory that cannot be read is added without what it holds.
+		unreadable := err != nil && info != nil && info.IsDir()
+		if err != nil {
+			a.failed(p, err)
+			if !unreadable {
+				return nil
+			}
+		}
+		if a.ExcludeVCS && vcsNames[info.Name()] {
+			return skipExcluded(info)
+		}
+		if a.Matching.excluded(a.Exclude, p) || (ignores != nil && ignores.ignored(p, info.IsDir())) {
+			return skipExcluded(info)
+		}
+		if a.NoRecursion && info.IsDir() && p == root {
+			if err := fn(p, info, nil); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		if a.OneFileSystem && info.IsDir() {
+			if dev, _ := fileID(info); p == root {
+				rootDev = dev
+			} else if dev != rootDev {
+				if err := fn(p, info, nil); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+		}
+		if a.ExcludeCaches != "" && info.IsDir() && cacheTagged(p) {
+			return a.walkCache(p, info, fn)
+		}
+		if ignores != nil && info.IsDir() && !unreadable {
+			if err := ignores.load(p); err != nil {
+				return err
+			}
+		}
+		if err := fn(p, info, nil); err != nil || !unreadable {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
+// walkCache visits the cache directory dir as ExcludeCaches says, leaving
+// out what it holds.
+func (a *Archiver) walkCache(dir string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if a.ExcludeCaches == ExcludeCachesAll {
+		return filepath.SkipDir
+	}
+	if err := fn(dir, info, nil); err != nil {
+		return err
+	}
+	if a.ExcludeCaches == ExcludeCachesTag {
+		tag := filepath.Join(dir, cacheTagName)
+		tagInfo, err := os.Lstat(tag)
+		if err != nil {
+			return fmt.Errorf("Error accessing file %s: %s", tag, err)
+		}
+		if err := fn(tag, tagInfo, nil); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return filepath.SkipDir
+}
+
+// walkFollow visits root like filepath.Walk, but describes the targets of
+// symbolic links, entering the directories they point to. A directory
+// reached again below itself is visited without being entered.
+func walkFollow(root string, fn filepath.WalkFunc) error {
+	info, err := statFollow(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = followDir(root, info, fn, nil)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// followDir visits p, and what it holds when it is a directory not among
+// the parents being walked. As with filepath.Walk, a directory that cannot
+// be read is visited once, with the error.
+func followDir(p string, info os.FileInfo, fn filepath.WalkFunc, parents [][2]uint64) error {
+	if !info.IsDir() {
+		return fn(p, info, nil)
+	}
+	dev, ino := fileID(info)
+	id := [2]uint64{dev, ino}
+	for _, parent := range parents {
+		if parent == id && dev|ino != 0 {
+			return fn(p, info, nil)
+		}
+	}
+	names, readErr := readDirNames(p)
+	if err := fn(p, info, readErr); err != nil || readErr != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := filepath.Join(p, name)
+		childInfo, err := statFollow(child)
+		if err != nil {
+			err = fn(child, nil, err)
+		} else {
+			err = followDir(child, childInfo, fn, append(parents, id))
+		}
+		if err == filepath.SkipDir && childInfo != nil && childInfo.IsDir() {
+			continue
+		} else if err == filepath.SkipDir {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the names of the entries of the directory dir.
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
+
+// statFollow describes what p points to, or the link itself when that is
+// missing.
+func statFollow(p string) (os.FileInfo, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		if linkInfo, lerr := os.Lstat(p); lerr == nil {
+			return linkInfo, nil
+		}
+	}
+	return info, err
+}
+
+func (a *Archiver) header(src, name string, info os.FileInfo) (*tar.Header, error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(src); err != nil {
+			return nil, fmt.Errorf("Error reading link %s: %s", src, err)
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating tar header for %s: %s", src, err)
+	}
+	header.Name = name
+	addFileFlags(header, src, info)
+	if a.Fakeroot != nil {
+		a.Fakeroot.Apply(header)
+	}
+	if uid := a.OwnerMap.Map(header.Uid); uid != header.Uid {
+		header.Uid, header.Uname = uid, ""
+	}
+	if gid := a.GroupMap.Map(header.Gid); gid != header.Gid {
+		header.Gid, header.Gname = gid, ""
+	}
+	if a.Owner != nil {
+		header.Uid, header.Uname = a.Owner.ID, a.Owner.Name
+	}
+	if a.Group != nil {
+		header.Gid, header.Gname = a.Group.ID, a.Group.Name
+	}
+	if a.NumericOwner {
+		header.Uname, header.Gname = "", ""
+	}
+	if !a.ModTime.IsZero() {
+		if !a.ClampModTime || header.ModTime.After(a.ModTime) {
+			header.ModTime = a.ModTime
+		}
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	}
+	if a.Xattrs != nil {
+		if err := a.addXattrs(header, src); err != nil {
+			return nil, err
+		}
+	}
+	if a.ACLs {
+		if err := a.addACLs(header, src); err != nil {
+			return nil, err
+		}
+	}
+	renameHeader(a.Transforms, header)
+	return header, nil
+}
+
+// write emits header followed, for regular files, by the content of src.
+func (a *Archiver) write(src string, header *tar.Header) error {
+	return a.emit(header, src, nil)
+}
+
+// AddTarball copies every member of the tar stream read from r.
+func (a *Archiver) AddTarball(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		renameHeader(a.Transforms, header)
+		if err := a.emit(header, "", tr); err != nil {
+			return err
+		}
+	}
+}
+
+// emit writes header followed by content or, when content is nil and the
+// member is a regular file, by the content of src.
+func (a *Archiver) emit(header *tar.Header, src string, content io.Reader) error {
+	a.emitted = nil
+	if !a.Select.Match(header.Name) || !a.Sizes.Match(header) {
+		return nil
+	}
+	if a.Filter != nil && !a.Filter(header) {
+		return nil
+	}
+	if a.zw != nil {
+		written, err := a.writeZip(header, src, content)
+		if err != nil || !written {
+			return err
+		}
+		return a.done(header, src)
+	}
+	if a.Index != nil {
+		// Flush pads the previous member, so the count is where this one starts.
+		if err := a.tw.Flush(); err != nil {
+			return fmt.Errorf("Error writing the tarball: %s", err)
+		}
+		a.Index.Entries = append(a.Index.Entries, IndexEntry{Name: header.Name, Offset: a.cw.n})
+	}
+	if a.Sparse && (a.Format == tar.FormatUnknown || a.Format == tar.FormatPAX) && content == nil && header.Typeflag == tar.TypeReg {
+		written, err := a.writeSparse(header, src)
+		if err != nil {
+			return err
+		}
+		if written {
+			return a.done(header, src)
+		}
+	}
+	var ifile *os.File
+	if content == nil && header.Typeflag == tar.TypeReg {
+		// Open the file first, so that one that cannot be read is left out.
+		var err error
+		if ifile, err = os.Open(src); err != nil {
+			a.failed(src, err)
+			return nil
+		}
+		defer ifile.Close()
+	}
+	if err := a.writeHeader(header); err != nil {
+		return err
+	}
+	if content != nil {
+		if _, err := io.Copy(a.tw, content); err != nil {
+			return fmt.Errorf("Error copying the content of %s: %s", header.Name, err)
+		}
+	} else if ifile != nil {
+		if err := a.copyFile(ifile, src, header.Size); err != nil {
+			return err
+		}
+	}
+	return a.done(header, src)
+}
+
+// copyFile writes the size bytes of content of the file src, read from
+// f. A file that cannot be read to the end is padded with zeros, to keep
+// the tarball sound, and recorded as failed; the bytes a file grew by
+// since its header was made are left out.
+func (a *Archiver) copyFile(f *os.File, src string, size int64) error {
+	n, err := io.CopyN(a.tw, f, size)
+	if n == size {
+		return nil
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("file shrank by %d bytes", size-n)
+	}
+	if _, zerr := io.CopyN(a.tw, zeros{}, size-n); zerr != nil {
+		return fmt.Errorf("Error writing the tarball: %s", zerr)
+	}
+	a.failed(src, fmt.Errorf("%s; padded with zeros", unwrapPath(err)))
+	return nil
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// failed records the file p that could not be read, in Failed, or in
+// Skipped with IgnoreFailedRead.
+func (a *Archiver) failed(p string, err error) {
+	msg := fmt.Sprintf("%s: %s", p, unwrapPath(err))
+	if a.IgnoreFailedRead {
+		a.Skipped = append(a.Skipped, msg)
+	} else {
+		a.Failed = append(a.Failed, msg)
+	}
+}
+
+// unwrapPath returns the error behind an *os.PathError, whose path is
+// already known.
+func unwrapPath(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// done records header, written from src, as the last member emitted.
+func (a *Archiver) done(header *tar.Header, src string) error {
+	if a.Sources != nil && src != "" {
+		a.Sources[header.Name] = src
+	}
+	if a.Report != nil {
+		a.Report(header)
+	}
+	a.emitted = header
+	return nil
+}
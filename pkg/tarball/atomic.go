@@ -0,0 +1,82 @@
+package tarball
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// AtomicFile is a temporary file that replaces another when committed, so
+// a crash or a full disk while writing it leaves the original intact.
+type AtomicFile struct {
+	*os.File
+	path string
+}
+
+// CreateAtomic creates a temporary file in the directory of path, with the
+// permissions, owner and group of path when it exists.
+func CreateAtomic(path string) (*AtomicFile, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the new tarball file: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err == nil {
+		err = f.Chmod(info.Mode().Perm())
+		chownLike(f, info)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("Error setting the permissions of the new tarball file: %s", err)
+	}
+	return &AtomicFile{File: f, path: path}, nil
+}
+
+// Commit flushes the file to disk and renames it over the original.
+func (f *AtomicFile) Commit() error {
+	if err := f.Sync(); err != nil {
+		f.Abort()
+		return fmt.Errorf("Error writing the new tarball file: %s", err)
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Error closing the new tarball file: %s", err)
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Error replacing the tarball file: %s", err)
+	}
+	// Make the rename itself durable where directories can be synced.
+	syncDir(filepath.Dir(f.path))
+	return nil
+}
+
+// syncDir flushes the entries of dir to disk. Windows does not sync
+// directories, and makes entries durable with the files.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Error syncing %s: %s", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("Error syncing %s: %s", dir, err)
+	}
+	return nil
+}
+
+// Abort closes and removes the file, leaving the original untouched. It
+// does nothing after Commit.
+func (f *AtomicFile) Abort() {
+	if f.File.Close() == nil {
+		os.Remove(f.Name())
+	}
+}
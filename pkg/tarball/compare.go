@@ -0,0 +1,115 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Difference describes a member that does not match the filesystem.
+type Difference struct {
+	Name   string
+	Reason string
+}
+
+// Comparer checks the members of a tarball against the files on disk.
+type Comparer struct {
+	// Path returns the path on disk of the member name, or "" to skip the
+	// member. When nil, members are looked up under their own name with
+	// leading slashes removed.
+	Path func(name string) string
+	// Metadata also compares permissions and modification times. Otherwise
+	// only types, sizes, link targets and contents are compared.
+	Metadata bool
+}
+
+// Compare reads the tarball from r and returns the members that differ
+// from the filesystem.
+func (c *Comparer) Compare(r io.Reader) ([]Difference, error) {
+	var diffs []Difference
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return diffs, nil
+		}
+		if err != nil {
+			return diffs, fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		p := strings.TrimLeft(hdr.Name, "/")
+		if c.Path != nil {
+			p = c.Path(hdr.Name)
+		}
+		if p == "" {
+			continue
+		}
+		reason, err := c.compareMember(hdr, tr, p)
+		if err != nil {
+			return diffs, err
+		}
+		if reason != "" {
+			diffs = append(diffs, Difference{Name: hdr.Name, Reason: reason})
+		}
+	}
+}
+
+func (c *Comparer) compareMember(hdr *tar.Header, content io.Reader, p string) (string, error) {
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return "missing on disk", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	fi := hdr.FileInfo()
+	if fi.Mode()&os.ModeType != info.Mode()&os.ModeType {
+		return "type differs", nil
+	}
+	if c.Metadata {
+		if fi.Mode().Perm() != info.Mode().Perm() {
+			return fmt.Sprintf("mode differs (%s on disk, %s in the tarball)", info.Mode().Perm(), fi.Mode().Perm()), nil
+		}
+		// Plain ustar headers round times to the second.
+		if d := info.ModTime().Sub(hdr.ModTime); !info.IsDir() && (d >= time.Second || d <= -time.Second) {
+			return "modification time differs", nil
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if target != hdr.Linkname {
+			return "link target differs", nil
+		}
+	case tar.TypeReg:
+		if info.Size() != hdr.Size {
+			return fmt.Sprintf("size differs (%d on disk, %d in the tarball)", info.Size(), hdr.Size), nil
+		}
+		archived := sha256.New()
+		if _, err := io.Copy(archived, content); err != nil {
+			return "", fmt.Errorf("Error reading %s from the tarball: %s", hdr.Name, err)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		onDisk := sha256.New()
+		_, err = io.Copy(onDisk, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(archived.Sum(nil), onDisk.Sum(nil)) {
+			return "contents differ", nil
+		}
+	}
+	return "", nil
+}
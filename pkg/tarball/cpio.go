@@ -0,0 +1,229 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// Cpio archives start with one of these: the portable ASCII (odc) format,
+// and the new ASCII (newc) format, without and with checksums.
+const (
+	CpioOdcMagic  = "070707"
+	CpioNewcMagic = "070701"
+	CpioCRCMagic  = "070702"
+)
+
+const cpioTrailer = "TRAILER!!!"
+
+// cpioEntry is a cpio header read into the fields a tar header needs.
+type cpioEntry struct {
+	name                       string
+	ino, mode, uid, gid, nlink int64
+	mtime, size                int64
+	devmajor, devminor         int64
+}
+
+// CpioStream returns a tar stream of the members of the cpio archive read
+// from r, in the odc, newc or crc format, so cpio archives and the
+// payloads of RPM packages can be listed and extracted like tarballs.
+// Closing the stream stops the conversion.
+func CpioStream(r io.Reader) io.ReadCloser {
+	return convert(func(w io.Writer) error { return cpioToTar(r, w) })
+}
+
+func cpioToTar(r io.Reader, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	// newc stores the content of hard linked files with one of their
+	// names, usually the last; the names before it wait here for the one
+	// holding it, and the names after it link to it.
+	pending := make(map[int64][]*tar.Header)
+	var order []int64
+	holders := make(map[int64]string)
+	for {
+		en, newc, err := readCpioHeader(r)
+		if err != nil {
+			return fmt.Errorf("Error reading the cpio archive: %s", err)
+		}
+		if en.name == cpioTrailer {
+			for _, ino := range order {
+				headers, ok := pending[ino]
+				if !ok {
+					continue
+				}
+				if err := writeCpioLinks(tw, headers); err != nil {
+					return err
+				}
+			}
+			return tw.Close()
+		}
+		header := cpioHeader(en)
+		body := io.LimitReader(r, en.size)
+		switch {
+		case header == nil:
+			// Sockets have no place in a tarball.
+		case header.Typeflag == tar.TypeSymlink:
+			target, err := ioutil.ReadAll(body)
+			if err != nil {
+				return fmt.Errorf("Error reading the cpio archive: %s", err)
+			}
+			header.Linkname = string(target)
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("Error converting %s from the cpio archive: %s", en.name, err)
+			}
+		case newc && header.Typeflag == tar.TypeReg && en.nlink > 1 && en.size == 0 && holders[en.ino] != "":
+			header.Typeflag, header.Linkname = tar.TypeLink, holders[en.ino]
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("Error converting %s from the cpio archive: %s", en.name, err)
+			}
+		case newc && header.Typeflag == tar.TypeReg && en.nlink > 1 && en.size == 0:
+			if _, ok := pending[en.ino]; !ok {
+				order = append(order, en.ino)
+			}
+			pending[en.ino] = append(pending[en.ino], header)
+		default:
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("Error converting %s from the cpio archive: %s", en.name, err)
+			}
+			if _, err := io.Copy(tw, body); err != nil {
+				return fmt.Errorf("Error reading the cpio archive: %s", err)
+			}
+			if newc && header.Typeflag == tar.TypeReg && en.nlink > 1 {
+				if err := writeCpioLinks(tw, append([]*tar.Header{header}, pending[en.ino]...)); err != nil {
+					return err
+				}
+				delete(pending, en.ino)
+				holders[en.ino] = header.Name
+			}
+		}
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return fmt.Errorf("Error reading the cpio archive: %s", err)
+		}
+		if newc {
+			if err := skipPadding(r, en.size); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeCpioLinks writes the names after the first of headers, which
+// holds the content, as hard links to it, or the first as an empty file
+// when it has not been written.
+func writeCpioLinks(tw *tar.Writer, headers []*tar.Header) error {
+	first := headers[0]
+	for i, header := range headers {
+		if i > 0 {
+			header.Typeflag, header.Linkname, header.Size = tar.TypeLink, first.Name, 0
+		} else if header.Size > 0 {
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("Error converting %s from the cpio archive: %s", header.Name, err)
+		}
+	}
+	return nil
+}
+
+func readCpioHeader(r io.Reader) (*cpioEntry, bool, error) {
+	magic := make([]byte, 6)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, false, err
+	}
+	en := &cpioEntry{}
+	var namesize int64
+	switch string(magic) {
+	case CpioNewcMagic, CpioCRCMagic:
+		raw := make([]byte, 104)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, false, err
+		}
+		var fields [13]int64
+		for i := range fields {
+			n, err := strconv.ParseInt(string(raw[i*8:i*8+8]), 16, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid header")
+			}
+			fields[i] = n
+		}
+		en.ino, en.mode, en.uid, en.gid, en.nlink = fields[0], fields[1], fields[2], fields[3], fields[4]
+		en.mtime, en.size = fields[5], fields[6]
+		en.devmajor, en.devminor = fields[9], fields[10]
+		namesize = fields[11]
+	case CpioOdcMagic:
+		raw := make([]byte, 70)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, false, err
+		}
+		var fields []int64
+		for _, width := range []int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11} {
+			n, err := strconv.ParseInt(string(raw[:width]), 8, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid header")
+			}
+			fields, raw = append(fields, n), raw[width:]
+		}
+		en.ino, en.mode, en.uid, en.gid, en.nlink = fields[1], fields[2], fields[3], fields[4], fields[5]
+		en.devmajor, en.devminor = fields[6]>>8, fields[6]&0xff
+		en.mtime, namesize, en.size = fields[7], fields[8], fields[9]
+	default:
+		return nil, false, fmt.Errorf("invalid header")
+	}
+	if namesize < 1 || namesize > 1<<16 {
+		return nil, false, fmt.Errorf("invalid name")
+	}
+	name := make([]byte, namesize)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, false, err
+	}
+	en.name = string(name[:namesize-1])
+	newc := string(magic) != CpioOdcMagic
+	if newc {
+		if err := skipPadding(r, 110+namesize); err != nil {
+			return nil, false, err
+		}
+	}
+	return en, newc, nil
+}
+
+// skipPadding reads the padding of newc archives after n bytes, to a
+// multiple of 4.
+func skipPadding(r io.Reader, n int64) error {
+	if _, err := io.CopyN(ioutil.Discard, r, -n&3); err != nil {
+		return fmt.Errorf("Error reading the cpio archive: %s", err)
+	}
+	return nil
+}
+
+// cpioHeader returns the tar header of en, or nil for a socket.
+func cpioHeader(en *cpioEntry) *tar.Header {
+	header := &tar.Header{
+		Name:    en.name,
+		Mode:    en.mode & 07777,
+		Uid:     int(en.uid),
+		Gid:     int(en.gid),
+		ModTime: time.Unix(en.mtime, 0),
+	}
+	switch en.mode & 0170000 {
+	case 0040000:
+		header.Typeflag = tar.TypeDir
+	case 0120000:
+		header.Typeflag = tar.TypeSymlink
+	case 0020000, 0060000:
+		header.Typeflag = tar.TypeChar
+		if en.mode&0170000 == 0060000 {
+			header.Typeflag = tar.TypeBlock
+		}
+		header.Devmajor, header.Devminor = en.devmajor, en.devminor
+	case 0010000:
+		header.Typeflag = tar.TypeFifo
+	case 0140000:
+		return nil
+	default:
+		header.Typeflag, header.Size = tar.TypeReg, en.size
+	}
+	return header
+}
@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package tarball
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// mknod creates the device node or FIFO described by hdr at target.
+func mknod(target string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	major, minor := uint64(hdr.Devmajor), uint64(hdr.Devminor)
+	dev := (major&0xfff)<<8 | minor&0xff | (major&^0xfff)<<32 | (minor&^0xff)<<12
+	return syscall.Mknod(target, mode, int(dev))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+func mknod(target string, hdr *tar.Header) error {
+	return fmt.Errorf("device nodes and FIFOs are only supported on Linux")
+}
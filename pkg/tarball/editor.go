@@ -0,0 +1,239 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Editor rewrites an existing tarball in place.
+type Editor struct {
+	// Report, if set, is called with the header of every member deleted by
+	// Delete or written from disk by Update.
+	Report func(hdr *tar.Header)
+	// DryRun reports what Delete and Update would change without modifying
+	// the tarball.
+	DryRun bool
+	// Exclude lists glob patterns for files Update leaves out, matched like
+	// Archiver.Exclude.
+	Exclude []string
+	// Matching, if set, changes how Delete patterns and Exclude match.
+	Matching *MatchOptions
+	// NoRecursion makes Update take the directories named without walking
+	// them.
+	NoRecursion bool
+	// Select, if set, limits Delete to the members whose names it selects,
+	// all of them when no patterns are given.
+	Select *RegexpFilter
+
+	path string
+}
+
+// NewEditor returns an Editor for the tarball at tarballPath.
+func NewEditor(tarballPath string) *Editor {
+	return &Editor{path: tarballPath}
+}
+
+// rewrite passes the members of the tarball to fn, which copies what it
+// keeps to the new tarball with copyMember or writes new members to tw.
+// The new tarball is written to an AtomicFile, so neither is ever held in
+// memory and the old one is left intact if anything fails.
+func (e *Editor) rewrite(fn func(f *os.File, members []*fileEntry, tw *tar.Writer, out io.Writer) error) error {
+	tarballFile, err := os.Open(e.path)
+	if err != nil {
+		return fmt.Errorf("Error opening the Tarball file: %s", err)
+	}
+	defer tarballFile.Close()
+	members, err := scanMembers(tarballFile)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = ioutil.Discard
+	var tmpFile *AtomicFile
+	if !e.DryRun {
+		if tmpFile, err = CreateAtomic(e.path); err != nil {
+			return err
+		}
+		defer tmpFile.Abort()
+		out = tmpFile
+	}
+
+	tw := tar.NewWriter(out)
+	if err := fn(tarballFile, members, tw, out); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("Error closing the tarball writer: %s", err)
+	}
+	if tmpFile == nil {
+		return nil
+	}
+	tarballFile.Close()
+	return tmpFile.Commit()
+}
+
+// copyMember copies the blocks of m from f to out, the tarball tw writes
+// to, as they are, sparse maps and extension headers included.
+func copyMember(f *os.File, m *fileEntry, tw *tar.Writer, out io.Writer) error {
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("Error writing the new tarball: %s", err)
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(f, m.Start, m.End-m.Start)); err != nil {
+		return fmt.Errorf("Error copying the file to the new tarball: %s", err)
+	}
+	return nil
+}
+
+// Delete removes the members whose names match any of patterns.
+func (e *Editor) Delete(patterns []string) error {
+	return e.rewrite(func(f *os.File, members []*fileEntry, tw *tar.Writer, out io.Writer) error {
+		for _, m := range members {
+			header := m.Header
+			deleteFile := len(patterns) == 0 && e.Select != nil
+			for _, pattern := range patterns {
+				matched, err := e.Matching.match(pattern, header.Name, true)
+				if err != nil {
+					return fmt.Errorf("Error matching wildcard pattern: %s", err)
+				}
+				if matched {
+					deleteFile = true
+					break
+				}
+			}
+			if deleteFile && e.Select.Match(header.Name) {
+				if e.Report != nil {
+					e.Report(header)
+				}
+				continue
+			}
+			if err := copyMember(f, m, tw, out); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update replaces the members named after the given paths (expanded as
+// globs and walked) with the files on disk, adding those not yet present.
+// Replaced members keep their place in the tarball, without the later
+// copies stored under the same name, and new ones are added at the end.
+func (e *Editor) Update(paths []string) error {
+	var order []string
+	files := make(map[string]os.FileInfo)
+	for _, fileToAdd := range paths {
+		matches, err := Glob(fileToAdd)
+		if err != nil {
+			return fmt.Errorf("Error getting files matching pattern: %s", err)
+		}
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return fmt.Errorf("Error accessing file %s: %s", path, err)
+				}
+				if e.Matching.excluded(e.Exclude, path) {
+					return skipExcluded(info)
+				}
+				if _, ok := files[path]; !ok {
+					order = append(order, path)
+					files[path] = info
+				}
+				if e.NoRecursion && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	written := make(map[string]bool)
+	return e.rewrite(func(f *os.File, members []*fileEntry, tw *tar.Writer, out io.Writer) error {
+		for _, m := range members {
+			header := m.Header
+			if info, ok := files[header.Name]; ok {
+				if written[header.Name] {
+					continue
+				}
+				written[header.Name] = true
+				if err := e.writeFile(tw, header.Name, info); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := copyMember(f, m, tw, out); err != nil {
+				return err
+			}
+		}
+		for _, path := range order {
+			if !written[path] {
+				if err := e.writeFile(tw, path, files[path]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// writeFile copies the file at path from disk to tw.
+func (e *Editor) writeFile(tw *tar.Writer, path string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return fmt.Errorf("Error reading link %s: %s", path, err)
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("Error creating tar header for %s: %s", path, err)
+	}
+	header.Name = path
+	addFileFlags(header, path, info)
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("Error writing the file header to the updated tarball: %s", err)
+	}
+	if info.IsDir() {
+		return nil
+	}
+	if info.Mode().IsRegular() {
+		fileToCopy, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Error opening the file %s: %s", path, err)
+		}
+		_, err = io.Copy(tw, fileToCopy)
+		fileToCopy.Close()
+		if err != nil {
+			return fmt.Errorf("Error copying the file content to the updated tarball: %s", err)
+		}
+	}
+	if e.Report != nil {
+		e.Report(header)
+	}
+	return nil
+}
+
+// Reorganize rewrites the tarball with its members sorted by path, keeping
+// only the last member stored under each name. The members are copied
+// block for block from where they are in the old tarball.
+func (e *Editor) Reorganize() error {
+	return e.rewrite(func(f *os.File, members []*fileEntry, tw *tar.Writer, out io.Writer) error {
+		last := make(map[string]*fileEntry)
+		for _, m := range members {
+			last[m.Header.Name] = m
+		}
+		for _, name := range sortedKeys(last) {
+			if err := copyMember(f, last[name], tw, out); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
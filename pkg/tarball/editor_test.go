@@ -0,0 +1,188 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sparseSize is the size of the sparse member written by
+// writeSparseTarball, which holds 5 bytes of data at sparseOffset.
+const (
+	sparseSize   = 10 << 20
+	sparseOffset = 4 << 20
+)
+
+// writeSparseTarball writes the tarball at path with the sparse member
+// "s", in the PAX 1.0 format writeSparse uses, between "a" and "b".
+func writeSparseTarball(t *testing.T, path string) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(name string) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 3}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(name + name + name))
+		tw.Flush()
+	}
+	write("a")
+
+	sparseMap := []byte(fmt.Sprintf("1\n%d\n5\n", sparseOffset))
+	sparseMap = append(sparseMap, make([]byte, blockPadding(int64(len(sparseMap))))...)
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     "s",
+		"GNU.sparse.realsize": strconv.Itoa(sparseSize),
+	}
+	body := paxRecords(records)
+	modTime := time.Unix(0, 0)
+	buf.Write(ustarHeader(&tar.Header{Name: "PaxHeaders.0/s", Mode: 0644, Size: int64(len(body)), ModTime: modTime}, tar.TypeXHeader, nil))
+	buf.Write(body)
+	buf.Write(make([]byte, blockPadding(int64(len(body)))))
+	buf.Write(ustarHeader(&tar.Header{Name: "GNUSparseFile.0/s", Mode: 0644, Size: int64(len(sparseMap)) + 5, ModTime: modTime}, tar.TypeReg, records))
+	buf.Write(sparseMap)
+	buf.Write([]byte("hello"))
+	buf.Write(make([]byte, blockPadding(5)))
+
+	write("b")
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkSparseTarball checks that the tarball at path holds the members
+// names in order, with "s" still sparse and intact.
+func checkSparseTarball(t *testing.T, path string, names ...string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 64<<10 {
+		t.Errorf("the tarball grew to %d bytes", info.Size())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	members, err := scanMembers(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range members {
+		got = append(got, m.Header.Name)
+		if m.Header.Name != "s" {
+			continue
+		}
+		if m.Header.Size != sparseSize {
+			t.Errorf("s has size %d, want %d", m.Header.Size, sparseSize)
+		}
+		tr := tar.NewReader(f)
+		f.Seek(m.Start, 0)
+		if _, err := tr.Next(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]byte, sparseSize)
+		copy(want[sparseOffset:], "hello")
+		if !bytes.Equal(data, want) {
+			t.Error("the content of s changed")
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(names) {
+		t.Errorf("the tarball holds %v, want %v", got, names)
+	}
+}
+
+func TestEditorKeepsSparseMembers(t *testing.T) {
+	inRoot(t, func(string) {
+		writeSparseTarball(t, "t.tar")
+		checkSparseTarball(t, "t.tar", "a", "s", "b")
+
+		if err := NewEditor("t.tar").Delete([]string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+		checkSparseTarball(t, "t.tar", "s", "b")
+
+		if err := ioutil.WriteFile("c", []byte("ccc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewEditor("t.tar").Update([]string{"c"}); err != nil {
+			t.Fatal(err)
+		}
+		checkSparseTarball(t, "t.tar", "s", "b", "c")
+
+		if err := NewEditor("t.tar").Reorganize(); err != nil {
+			t.Fatal(err)
+		}
+		checkSparseTarball(t, "t.tar", "b", "c", "s")
+	})
+}
+
+func TestEditorKeepsExtendedHeaders(t *testing.T) {
+	long := strings.Repeat("d/", 60) + "f"
+	for _, format := range []tar.Format{tar.FormatGNU, tar.FormatPAX} {
+		t.Run(format.String(), func(t *testing.T) {
+			inRoot(t, func(string) {
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				for _, hdr := range []*tar.Header{
+					{Name: long + "1", Typeflag: tar.TypeReg, Size: 1},
+					{Name: "l", Typeflag: tar.TypeSymlink, Linkname: long},
+					{Name: long + "2", Typeflag: tar.TypeReg, Size: 1},
+				} {
+					hdr.Mode, hdr.Format = 0644, format
+					if err := tw.WriteHeader(hdr); err != nil {
+						t.Fatal(err)
+					}
+					tw.Write(make([]byte, hdr.Size))
+				}
+				tw.Close()
+				if err := ioutil.WriteFile("t.tar", buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := NewEditor("t.tar").Delete([]string{long + "1"}); err != nil {
+					t.Fatal(err)
+				}
+				f, err := os.Open("t.tar")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				tr := tar.NewReader(f)
+				var got []string
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, hdr.Name+"->"+hdr.Linkname)
+				}
+				want := []string{"l->" + long, long + "2->"}
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("the tarball holds %v, want %v", got, want)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,885 @@
+package tarball
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Extractor restores the members of a tarball to the filesystem, or copies
+// their contents to a stream.
+type Extractor struct {
+	// Stdout, if set, receives the contents of the extracted members instead
+	// of the filesystem.
+	Stdout io.Writer
+	// Report, if set, is called with the header of every member extracted
+	// and the path it is written to, which is empty when extracting to
+	// Stdout.
+	Report func(hdr *tar.Header, dest string)
+	// DryRun reports the members that would be extracted without writing
+	// anything.
+	DryRun bool
+	// Whiteout selects how .wh. members are handled when extracting a whole
+	// tarball: WhiteoutRemove, WhiteoutOverlay, or "" to extract them as
+	// regular files.
+	Whiteout string
+	// Existing selects what happens to files already on disk where members
+	// go: ExistingError, ExistingSkip, ExistingKeepNewer, or "" to replace
+	// them. Directories are merged into either way.
+	Existing string
+	// UnlinkFirst removes what is at the path of every member before
+	// writing it, including symbolic links and empty directories where
+	// other members go. Otherwise files are written over, and removed
+	// first only when that fails, as for running programs.
+	UnlinkFirst bool
+	// Sync flushes every extracted file to disk, and the directories
+	// holding members once everything has been extracted.
+	Sync bool
+	// Resume, if set, skips the members an earlier run extracted that are
+	// still intact on disk, and records those extracted by this one.
+	Resume *ResumeState
+	// BufferSize is the size of the buffer member contents are copied
+	// through, DefaultBufferSize when 0.
+	BufferSize int
+	// Fakeroot, if set, records the metadata of every extracted member.
+	Fakeroot FakerootDB
+	// StripComponents removes that many leading path elements from member
+	// names before they are written to disk. Members with no elements left
+	// are skipped.
+	StripComponents int
+	// Transforms rename members and the targets of links, in turn, before
+	// StripComponents applies.
+	Transforms []*Transform
+	// Select, if set, skips the members whose names it does not select.
+	Select *RegexpFilter
+	// Sizes, if set, skips the regular files whose sizes it does not
+	// select.
+	Sizes *SizeFilter
+	// Types, if set, skips the members whose types it does not select.
+	Types TypeFilter
+	// Confirm, if set, is asked about every member selected, and returns
+	// false to skip it.
+	Confirm func(hdr *tar.Header) bool
+	// Matching, if set, changes how the patterns given to Extract match
+	// member names, which it then leaves unexpanded on disk.
+	Matching *MatchOptions
+	// AbsoluteNames keeps leading slashes and ".." elements in member names.
+	// By default leading slashes are removed and members that would land
+	// outside the extraction root are refused.
+	AbsoluteNames bool
+	// Index, if set, lets Extract seek straight to the matching members
+	// instead of reading the tarball from the start. It needs the reader to
+	// be an io.Seeker over the uncompressed tar stream.
+	Index *Index
+	// Recover makes ExtractAll skip damaged parts of the tarball, resuming
+	// at the next valid header, instead of stopping at the first error.
+	Recover bool
+	// Incremental removes, when extracting a directory made by an
+	// incremental backup, the entries on disk it did not hold at the time.
+	Incremental bool
+	// SameOwner gives extracted members the owner and group recorded in
+	// the tarball, which needs root. Otherwise they belong to the user
+	// extracting them.
+	SameOwner bool
+	// PreservePermissions gives extracted members the exact modes recorded
+	// in the tarball. Otherwise the umask of the process is applied to
+	// them. Either way, the modes of directories are set once everything
+	// has been extracted, so that read-only ones can be filled.
+	PreservePermissions bool
+	// NumericOwner makes SameOwner use the numeric ids in the tarball and
+	// ignore the user and group names.
+	NumericOwner bool
+	// OwnerMap and GroupMap translate the ids SameOwner gives members.
+	OwnerMap IDMap
+	GroupMap IDMap
+	// Damaged lists the parts of the tarball skipped in Recover mode.
+	Damaged []string
+	// Skipped lists the device nodes, FIFOs, extended attributes and ACLs
+	// that could not be created, as happens without privileges, with the
+	// reason.
+	Skipped []string
+	// Sparse leaves holes for the runs of zeros in every file, not only
+	// in the members stored as sparse.
+	Sparse bool
+	// Xattrs, when set, restores the extended attributes it selects from
+	// SCHILY.xattr PAX records.
+	Xattrs *XattrFilter
+	// ACLs applies the POSIX.1e ACLs stored in SCHILY.acl PAX records.
+	ACLs bool
+
+	r   io.Reader
+	tr  *tar.Reader
+	rr  *recoveryReader
+	ids ownerIDs
+	// root is the real path of the extraction root, once resolved.
+	root  string
+	umask os.FileMode
+	// dirs are the directories extracted, whose modes are set last.
+	dirs []dirMode
+	// parents are the directories members were extracted to, for Sync.
+	parents []string
+	synced  map[string]bool
+	buf     []byte
+	// sum hashes the content of the member being extracted, for Resume.
+	sum hash.Hash
+}
+
+// DefaultBufferSize is the size of the buffer an Extractor copies member
+// contents through, unless BufferSize says otherwise.
+const DefaultBufferSize = 1 << 20
+
+// bufferSize returns BufferSize, or DefaultBufferSize when it is not set.
+func (e *Extractor) bufferSize() int {
+	if e.BufferSize > 0 {
+		return e.BufferSize
+	}
+	return DefaultBufferSize
+}
+
+// copyMember copies the content of the current member to w through the
+// buffer of e, which is allocated once.
+func (e *Extractor) copyMember(w io.Writer) (int64, error) {
+	if e.buf == nil {
+		e.buf = make([]byte, e.bufferSize())
+	}
+	// Hide any ReadFrom or WriteTo, which would bypass the buffer.
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{e.member()}, e.buf)
+}
+
+// member returns the reader of the content of the current member, which
+// feeds sum when it is set.
+func (e *Extractor) member() io.Reader {
+	if e.sum != nil {
+		return io.TeeReader(e.tr, e.sum)
+	}
+	return e.tr
+}
+
+// dirMode is the mode to give an extracted directory.
+type dirMode struct {
+	path string
+	mode os.FileMode
+}
+
+// NewExtractor returns an Extractor reading a tarball from r.
+func NewExtractor(r io.Reader) *Extractor {
+	return &Extractor{r: r, tr: tar.NewReader(r), umask: umask()}
+}
+
+// ExtractAll extracts every member of the tarball.
+func (e *Extractor) ExtractAll() error {
+	if err := e.extractAll(); err != nil {
+		return err
+	}
+	return e.finish()
+}
+
+func (e *Extractor) extractAll() error {
+	if e.Recover {
+		e.rr = &recoveryReader{r: e.r}
+		e.tr = tar.NewReader(e.rr)
+	}
+	if e.Stdout != nil {
+		for {
+			hdr, err := e.next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("Error reading the tarball header: %s", err)
+			}
+			if !e.Select.Match(hdr.Name) || !e.Sizes.Match(hdr) || !e.Types.Match(hdr) || !e.confirm(hdr) {
+				continue
+			}
+			if e.Report != nil {
+				e.Report(hdr, "")
+			}
+			if e.DryRun {
+				continue
+			}
+			if _, err := e.copyMember(e.Stdout); err != nil {
+				if err := e.damaged(hdr, err); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	extracted := make(map[string]bool)
+	for {
+		hdr, err := e.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		if !e.Select.Match(hdr.Name) || !e.Sizes.Match(hdr) || !e.Types.Match(hdr) {
+			continue
+		}
+		destPath, ok, err := e.destination(rename(e.Transforms, hdr.Name, tar.TypeReg))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if e.Whiteout != "" && !e.DryRun {
+			whiteout, err := applyWhiteout(destPath, extracted, e.Whiteout)
+			if err != nil {
+				return err
+			}
+			if whiteout {
+				continue
+			}
+			extracted[path.Clean(destPath)] = true
+		}
+		if err := e.extractMember(hdr, destPath); err != nil {
+			if err := e.damaged(hdr, err); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Extract extracts the members matching patterns. Each pattern is first
+// expanded against the filesystem; patterns that match nothing there are
+// matched against member names as they are. A matching directory brings
+// along the members below it, and a pattern ending in '/' places matches
+// directly inside that directory.
+func (e *Extractor) Extract(patterns []string) error {
+	if err := e.extract(patterns); err != nil {
+		return err
+	}
+	return e.finish()
+}
+
+func (e *Extractor) extract(patterns []string) error {
+	var dirs []string
+	for _, arg := range patterns {
+		// Recursive patterns are meant for the members only.
+		if strings.Contains(arg, "**") || e.Matching != nil {
+			dirs = append(dirs, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			matches = append(matches, arg)
+		}
+		dirs = append(dirs, matches...)
+	}
+	if seeker, ok := e.r.(io.Seeker); ok && e.Index != nil {
+		for _, dir := range dirs {
+			if err := e.extractIndexed(seeker, dir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return e.extractPatterns(dirs)
+}
+
+// extractPatterns reads the tarball once, extracting the members matching
+// any of dirs and the members below the matching directories.
+func (e *Extractor) extractPatterns(dirs []string) error {
+	var matchedDirs []string
+	for {
+		hdr, err := e.tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		below := false
+		for _, dirPath := range matchedDirs {
+			if strings.HasPrefix(hdr.Name, dirPath) {
+				if err := e.extractBelow(dirPath, hdr); err != nil {
+					return err
+				}
+				below = true
+				break
+			}
+		}
+		if below {
+			continue
+		}
+		for _, dir := range dirs {
+			matched, err := e.Matching.match(dir, hdr.Name, true)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				continue
+			}
+			if hdr.FileInfo().IsDir() {
+				e.recordDir(hdr)
+				matchedDirs = append(matchedDirs, hdr.Name)
+			} else if err := e.extractMatch(dir, hdr); err != nil {
+				return err
+			}
+			break
+		}
+	}
+}
+
+// extractIndexed extracts the members matching dir by seeking to each of
+// them. A matching directory is followed through the rest of the tarball,
+// as extractPatterns does.
+func (e *Extractor) extractIndexed(seeker io.Seeker, dir string) error {
+	for _, entry := range e.Index.Entries {
+		matched, err := e.Matching.match(dir, entry.Name, true)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			continue
+		}
+		if _, err := seeker.Seek(entry.Offset, io.SeekStart); err != nil {
+			return fmt.Errorf("Error seeking to %s: %s", entry.Name, err)
+		}
+		e.tr = tar.NewReader(e.r)
+		hdr, err := e.tr.Next()
+		if err != nil {
+			return fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		if hdr.Name != entry.Name {
+			return fmt.Errorf("The index does not match the tarball at %s", entry.Name)
+		}
+		if err := e.extractMatch(dir, hdr); err != nil {
+			return err
+		}
+		if hdr.FileInfo().IsDir() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// extractMatch extracts a member that matched dir, and everything below it
+// when it is a directory.
+func (e *Extractor) extractMatch(dir string, hdr *tar.Header) error {
+	if hdr.FileInfo().IsDir() {
+		e.recordDir(hdr)
+		return e.extractDir(hdr.Name)
+	}
+	destPath, ok, err := e.destination(rename(e.Transforms, hdr.Name, tar.TypeReg))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	if strings.HasSuffix(dir, "/") {
+		destPath = path.Join(dir, path.Base(hdr.Name))
+	}
+	return e.extractMember(hdr, destPath)
+}
+
+// recordDir records the ownership of a matched directory for Fakeroot.
+func (e *Extractor) recordDir(hdr *tar.Header) {
+	if e.Fakeroot != nil && e.Stdout == nil && !e.DryRun {
+		e.Fakeroot.Record(hdr)
+	}
+}
+
+// extractDir extracts the remaining members below dirPath.
+func (e *Extractor) extractDir(dirPath string) error {
+	for {
+		hdr, err := e.tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		if !strings.HasPrefix(hdr.Name, dirPath) {
+			continue
+		}
+		if err := e.extractBelow(dirPath, hdr); err != nil {
+			return err
+		}
+	}
+}
+
+// extractBelow extracts a member below the matched directory dirPath.
+func (e *Extractor) extractBelow(dirPath string, hdr *tar.Header) error {
+	destPath, ok, err := e.destination(rename(e.Transforms, hdr.Name, tar.TypeReg))
+	if err != nil || !ok {
+		return err
+	}
+	if strings.HasSuffix(dirPath, "/") {
+		destPath = path.Join(dirPath, path.Base(hdr.Name))
+	}
+	return e.extractMember(hdr, destPath)
+}
+
+// destination returns the path a member is extracted to, or false when
+// nothing is left of its name after removing leading slashes and
+// StripComponents elements. Names escaping the extraction root are an error
+// unless AbsoluteNames is set.
+func (e *Extractor) destination(name string) (string, bool, error) {
+	dest := name
+	if !e.AbsoluteNames {
+		dest = strings.TrimLeft(dest, "/")
+	}
+	if e.StripComponents > 0 {
+		parts := strings.Split(strings.Trim(dest, "/"), "/")
+		if len(parts) <= e.StripComponents {
+			return "", false, nil
+		}
+		dest = path.Join(parts[e.StripComponents:]...)
+	}
+	if e.AbsoluteNames {
+		return dest, true, nil
+	}
+	if dest == "" {
+		return "", false, nil
+	}
+	if !filepath.IsLocal(filepath.FromSlash(dest)) {
+		return "", false, fmt.Errorf("Refusing to extract %s: path escapes the extraction root", name)
+	}
+	return dest, true, nil
+}
+
+// Policies for files in the way accepted by Extractor.Existing.
+const (
+	ExistingError     = "error"
+	ExistingSkip      = "skip"
+	ExistingKeepNewer = "keep-newer"
+)
+
+// keepExisting reports whether the file at destPath stays as it is
+// instead of being replaced by hdr, as Existing says.
+func (e *Extractor) keepExisting(hdr *tar.Header, destPath string) (bool, error) {
+	if e.Existing == "" || e.Stdout != nil || hdr.Typeflag == tar.TypeDir {
+		return false, nil
+	}
+	info, err := os.Lstat(destPath)
+	if err != nil {
+		return false, nil
+	}
+	switch e.Existing {
+	case ExistingError:
+		return true, fmt.Errorf("Error extracting %s: %s already exists", hdr.Name, destPath)
+	case ExistingKeepNewer:
+		return !hdr.ModTime.After(info.ModTime()), nil
+	}
+	return true, nil
+}
+
+// mode returns the mode to give the member described by fi, with the
+// umask applied unless PreservePermissions is set.
+func (e *Extractor) mode(fi os.FileInfo) os.FileMode {
+	if e.PreservePermissions {
+		return fi.Mode()
+	}
+	return fi.Mode() &^ e.umask
+}
+
+// finish sets the modes of the directories extracted and, with Sync,
+// flushes the directories holding members to disk.
+func (e *Extractor) finish() error {
+	if err := e.setDirModes(); err != nil {
+		return err
+	}
+	for _, dir := range e.parents {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	e.parents, e.synced = nil, nil
+	return nil
+}
+
+// setDirModes gives the directories extracted their modes, in reverse
+// order so that those below come before their parents.
+func (e *Extractor) setDirModes() error {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(e.dirs[i].path, e.dirs[i].mode); err != nil {
+			return fmt.Errorf("Error setting permissions: %s", err)
+		}
+	}
+	e.dirs = nil
+	return nil
+}
+
+// unlink removes what is at destPath, unless it is a directory and dir is
+// set.
+func unlink(destPath string, dir bool) error {
+	info, err := os.Lstat(destPath)
+	if err != nil || (dir && info.IsDir()) {
+		return nil
+	}
+	if err := os.Remove(destPath); err != nil {
+		return fmt.Errorf("Error replacing %s: %s", destPath, err)
+	}
+	return nil
+}
+
+// confirm asks Confirm, when set, whether to extract hdr.
+func (e *Extractor) confirm(hdr *tar.Header) bool {
+	return e.Confirm == nil || e.Confirm(hdr)
+}
+
+// extractMember writes the current member to destPath, or its content to
+// e.Stdout.
+func (e *Extractor) extractMember(hdr *tar.Header, destPath string) error {
+	if !e.Select.Match(hdr.Name) || !e.Sizes.Match(hdr) || !e.Types.Match(hdr) {
+		return nil
+	}
+	if e.Stdout == nil && e.Resume.Done(hdr, destPath) {
+		return nil
+	}
+	if keep, err := e.keepExisting(hdr, destPath); keep || err != nil {
+		return err
+	}
+	if !e.confirm(hdr) {
+		return nil
+	}
+	if e.Report != nil {
+		if e.Stdout != nil {
+			e.Report(hdr, "")
+		} else {
+			e.Report(hdr, destPath)
+		}
+	}
+	if e.DryRun {
+		return nil
+	}
+	if e.Stdout != nil {
+		_, err := e.copyMember(e.Stdout)
+		return err
+	}
+	e.sum = nil
+	if e.Resume != nil && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeGNUSparse) {
+		e.sum = sha256.New()
+	}
+	if err := e.writeMember(hdr, destPath); err != nil {
+		return err
+	}
+	return e.Resume.record(hdr, e.sum)
+}
+
+// writeMember writes the current member to destPath.
+func (e *Extractor) writeMember(hdr *tar.Header, destPath string) error {
+	if e.Fakeroot != nil {
+		e.Fakeroot.Record(hdr)
+	}
+
+	if err := e.checkInside(destPath); err != nil {
+		return err
+	}
+	if e.Sync {
+		if e.synced == nil {
+			e.synced = make(map[string]bool)
+		}
+		if dir := filepath.Dir(destPath); !e.synced[dir] {
+			e.synced[dir] = true
+			e.parents = append(e.parents, dir)
+		}
+	}
+	fi := hdr.FileInfo()
+	if e.UnlinkFirst {
+		if err := unlink(destPath, fi.IsDir()); err != nil {
+			return err
+		}
+	}
+	if fi.IsDir() {
+		// Until its mode is set, the directory can be filled.
+		if err := os.MkdirAll(destPath, fi.Mode().Perm()|0700); err != nil {
+			return fmt.Errorf("Error creating directory: %s", err)
+		}
+		e.dirs = append(e.dirs, dirMode{destPath, e.mode(fi)})
+		if err := e.chown(hdr, destPath); err != nil {
+			return err
+		}
+		if e.Xattrs != nil {
+			e.setXattrs(hdr, destPath)
+		}
+		if e.ACLs {
+			e.setACLs(hdr, destPath)
+		}
+		if err := setFileFlags(hdr, destPath); err != nil {
+			return err
+		}
+		if e.Incremental {
+			return pruneDir(hdr, destPath)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("Error creating directory: %s", err)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		return e.link(hdr, destPath)
+	case tar.TypeSymlink:
+		return e.symlink(hdr, destPath)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		made, err := e.device(hdr, destPath)
+		if err != nil || made || e.Fakeroot == nil {
+			return err
+		}
+		// Fakeroot has recorded the device, and an empty file stands in
+		// for it.
+	}
+	// Never write through a symbolic or hard link left at destPath.
+	if info, err := os.Lstat(destPath); err == nil && !info.IsDir() {
+		if err := os.Remove(destPath); err != nil {
+			return fmt.Errorf("Error replacing %s: %s", destPath, err)
+		}
+	}
+	ofile, err := os.Create(destPath)
+	if err != nil && !e.UnlinkFirst {
+		// A busy or read-only file can still be replaced.
+		if unlink(destPath, false) == nil {
+			ofile, err = os.Create(destPath)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating file: %s", err)
+	}
+	if e.Sparse || isSparse(hdr) {
+		err = copySparse(ofile, e.member(), hdr.Size)
+	} else {
+		// Members taking more than a buffer are worth laying out at once.
+		if hdr.Size >= int64(e.bufferSize()) {
+			preallocate(ofile, hdr.Size)
+		}
+		_, err = e.copyMember(ofile)
+	}
+	if err == nil && e.Sync {
+		err = ofile.Sync()
+	}
+	if err != nil {
+		ofile.Close()
+		return err
+	}
+	ofile.Close()
+
+	// Changing the owner clears the setuid and setgid bits, so it comes
+	// before the mode.
+	if err := e.chown(hdr, destPath); err != nil {
+		return err
+	}
+	if err := os.Chmod(destPath, e.mode(fi)); err != nil {
+		return fmt.Errorf("Error setting permissions: %s", err)
+	}
+	// Writing and changing the owner clear file capabilities, so the
+	// attributes come last. ACLs set the group bits of the mode, so they
+	// come after it.
+	if e.Xattrs != nil {
+		e.setXattrs(hdr, destPath)
+	}
+	if e.ACLs {
+		e.setACLs(hdr, destPath)
+	}
+	return setFileFlags(hdr, destPath)
+}
+
+// link recreates a hard link to a member extracted before it, replacing
+// whatever is at destPath.
+func (e *Extractor) link(hdr *tar.Header, destPath string) error {
+	target, ok, err := e.destination(rename(e.Transforms, hdr.Linkname, tar.TypeLink))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	// os.Link follows symbolic links on the way to the target, so resolve
+	// them and make sure the file linked to is inside the root.
+	if err := e.checkInside(target); err != nil {
+		return err
+	}
+	if !e.AbsoluteNames {
+		real, err := filepath.EvalSymlinks(target)
+		if err != nil {
+			return fmt.Errorf("Error creating hard link: %s", err)
+		}
+		if !e.within(real) {
+			return fmt.Errorf("Refusing to extract %s: link target %s is outside the extraction root", hdr.Name, hdr.Linkname)
+		}
+	}
+	if err := os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error replacing %s: %s", destPath, err)
+	}
+	if err := os.Link(target, destPath); err != nil {
+		return fmt.Errorf("Error creating hard link: %s", err)
+	}
+	return nil
+}
+
+// symlink creates a symbolic link to the target of hdr, replacing whatever
+// is at destPath. Unless AbsoluteNames is set, targets that are absolute
+// or lead outside the extraction root, following the symbolic links
+// already on disk, are refused.
+func (e *Extractor) symlink(hdr *tar.Header, destPath string) error {
+	link := rename(e.Transforms, hdr.Linkname, tar.TypeSymlink)
+	if !e.AbsoluteNames {
+		target := filepath.FromSlash(link)
+		if filepath.IsAbs(target) {
+			return fmt.Errorf("Refusing to extract %s: link target %s escapes the extraction root", hdr.Name, link)
+		}
+		if err := e.checkInside(destPath); err != nil {
+			return err
+		}
+		real, err := resolveLink(filepath.Dir(destPath), target)
+		if err != nil {
+			return fmt.Errorf("Error resolving %s: %s", link, err)
+		}
+		if !e.within(real) {
+			return fmt.Errorf("Refusing to extract %s: link target %s escapes the extraction root", hdr.Name, link)
+		}
+	}
+	if err := os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error replacing %s: %s", destPath, err)
+	}
+	if err := os.Symlink(link, destPath); err != nil {
+		return fmt.Errorf("Error creating symbolic link: %s", err)
+	}
+	return e.chown(hdr, destPath)
+}
+
+// resolveLink returns the real path a symbolic link in dir to target
+// leads to. Unlike filepath.Join, ".." is applied after resolving the
+// symbolic links before it, as the system does. The parts of target that
+// do not exist yet are taken as they are.
+func resolveLink(dir, target string) (string, error) {
+	cur, err := filepath.EvalSymlinks(dir)
+	if err == nil {
+		cur, err = filepath.Abs(cur)
+	}
+	if err != nil {
+		return "", err
+	}
+	return followLink(cur, target, 0)
+}
+
+// followLink applies the parts of target, in turn, to the real absolute
+// path cur, following the symbolic links it meets, even dangling ones.
+func followLink(cur, target string, depth int) (string, error) {
+	if depth > 40 {
+		return "", fmt.Errorf("too many levels of symbolic links")
+	}
+	if filepath.IsAbs(target) {
+		cur = string(filepath.Separator)
+	}
+	for _, part := range strings.Split(target, string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+		next := filepath.Join(cur, part)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if cur, err = followLink(cur, filepath.FromSlash(link), depth+1); err != nil {
+			return "", err
+		}
+	}
+	return cur, nil
+}
+
+// checkInside refuses, unless AbsoluteNames is set, to extract to destPath
+// when a symbolic link on the way to it leads outside the extraction root.
+// It resolves the closest parent directory that exists.
+func (e *Extractor) checkInside(destPath string) error {
+	if e.AbsoluteNames {
+		return nil
+	}
+	if err := e.resolveRoot(); err != nil {
+		return err
+	}
+	dir := filepath.Dir(destPath)
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		if parent := filepath.Dir(dir); parent != dir {
+			dir = parent
+		} else {
+			return nil
+		}
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("Error resolving %s: %s", dir, err)
+	}
+	if !e.within(real) {
+		return fmt.Errorf("Refusing to extract %s: a symbolic link leads outside the extraction root", destPath)
+	}
+	return nil
+}
+
+// resolveRoot sets root to the real path of the extraction root, once.
+func (e *Extractor) resolveRoot() error {
+	if e.root != "" {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(".")
+	if err == nil {
+		root, err = filepath.Abs(root)
+	}
+	if err != nil {
+		return fmt.Errorf("Error resolving the extraction root: %s", err)
+	}
+	e.root = root
+	return nil
+}
+
+// within reports whether real, a path with no symbolic links left in it,
+// is the extraction root or below it. resolveRoot must have been called.
+func (e *Extractor) within(real string) bool {
+	real, err := filepath.Abs(real)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(e.root, real)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// device creates a device node or FIFO, replacing whatever is at destPath,
+// and reports whether it did. When it cannot, the member is added to
+// Skipped, unless Fakeroot is set to record it.
+func (e *Extractor) device(hdr *tar.Header, destPath string) (bool, error) {
+	if err := os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("Error replacing %s: %s", destPath, err)
+	}
+	if err := mknod(destPath, hdr); err != nil {
+		if e.Fakeroot == nil {
+			e.Skipped = append(e.Skipped, fmt.Sprintf("%s: %s", hdr.Name, err))
+		}
+		return false, nil
+	}
+	if err := e.chown(hdr, destPath); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(destPath, e.mode(hdr.FileInfo())); err != nil {
+		return false, fmt.Errorf("Error setting permissions: %s", err)
+	}
+	return true, nil
+}
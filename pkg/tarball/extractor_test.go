@@ -0,0 +1,226 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// member describes a member of a tarball built by makeTarball.
+type member struct {
+	name     string
+	typeflag byte
+	link     string
+	body     string
+}
+
+func makeTarball(t *testing.T, members []member) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Typeflag: m.typeflag, Linkname: m.link, Mode: 0644, Size: int64(len(m.body))}
+		if m.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(m.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// inRoot runs fn in the directory root below a new temporary directory,
+// which holds the file outside with the content "secret".
+func inRoot(t *testing.T, fn func(outside string)) {
+	t.Helper()
+	tmp, err := ioutil.TempDir("", "tarball")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	outside := filepath.Join(tmp, "outside")
+	if err := ioutil.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(tmp, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	fn(outside)
+}
+
+func TestExtractLinkEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []member
+	}{
+		{"hard link through symlinks", []member{
+			{name: "x", typeflag: tar.TypeSymlink, link: "."},
+			{name: "y", typeflag: tar.TypeSymlink, link: "x/.."},
+			{name: "h", typeflag: tar.TypeLink, link: "y/outside"},
+			{name: "h", typeflag: tar.TypeReg, body: "PWNED"},
+		}},
+		{"hard link outside", []member{
+			{name: "h", typeflag: tar.TypeLink, link: "../outside"},
+			{name: "h", typeflag: tar.TypeReg, body: "PWNED"},
+		}},
+		{"hard link to a symlink outside", []member{
+			{name: "s", typeflag: tar.TypeSymlink, link: "../outside"},
+			{name: "h", typeflag: tar.TypeLink, link: "s"},
+			{name: "h", typeflag: tar.TypeReg, body: "PWNED"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inRoot(t, func(outside string) {
+				e := NewExtractor(bytes.NewReader(makeTarball(t, tt.members)))
+				e.ExtractAll()
+				data, err := ioutil.ReadFile(outside)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != "secret" {
+					t.Errorf("the file outside the root was overwritten with %q", data)
+				}
+			})
+		})
+	}
+}
+
+func TestExtractTraversal(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip int
+		// want is where the member lands, or "" when it is refused.
+		want string
+	}{
+		{"f", 0, "f"},
+		{"/f", 0, "f"},
+		{"./f", 0, "f"},
+		{"../outside", 0, ""},
+		{"a/../../outside", 0, ""},
+		{"/../outside", 0, ""},
+		{"top/f", 1, "f"},
+		{"top/../../outside", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inRoot(t, func(outside string) {
+				e := NewExtractor(bytes.NewReader(makeTarball(t, []member{
+					{name: tt.name, typeflag: tar.TypeReg, body: "PWNED"},
+				})))
+				e.StripComponents = tt.strip
+				err := e.ExtractAll()
+				if data, _ := ioutil.ReadFile(outside); string(data) != "secret" {
+					t.Fatalf("the file outside the root was overwritten with %q", data)
+				}
+				if tt.want == "" {
+					if err == nil {
+						t.Error("the member was extracted")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data, err := ioutil.ReadFile(tt.want); err != nil || string(data) != "PWNED" {
+					t.Errorf("%s holds %q (%v)", tt.want, data, err)
+				}
+			})
+		})
+	}
+}
+
+func TestExtractReplacesHardLink(t *testing.T) {
+	inRoot(t, func(string) {
+		tarball := makeTarball(t, []member{
+			{name: "a", typeflag: tar.TypeReg, body: "original"},
+			{name: "b", typeflag: tar.TypeLink, link: "a"},
+			{name: "b", typeflag: tar.TypeReg, body: "replaced"},
+		})
+		if err := NewExtractor(bytes.NewReader(tarball)).ExtractAll(); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]string{"a": "original", "b": "replaced"} {
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != want {
+				t.Errorf("%s holds %q, want %q", name, data, want)
+			}
+		}
+	})
+}
+
+func TestExtractSymlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []member
+		refused string
+	}{
+		{"inside", []member{
+			{name: "d", typeflag: tar.TypeDir},
+			{name: "d/l", typeflag: tar.TypeSymlink, link: "../a"},
+			{name: "l", typeflag: tar.TypeSymlink, link: "d/../a"},
+		}, ""},
+		{"dot dot", []member{
+			{name: "l", typeflag: tar.TypeSymlink, link: "../outside"},
+		}, "l"},
+		{"absolute", []member{
+			{name: "l", typeflag: tar.TypeSymlink, link: "/etc"},
+		}, "l"},
+		{"through a symlink to the root", []member{
+			{name: "x", typeflag: tar.TypeSymlink, link: "."},
+			{name: "y", typeflag: tar.TypeSymlink, link: "x/.."},
+		}, "y"},
+		{"through a symlink to a directory", []member{
+			{name: "d", typeflag: tar.TypeDir},
+			{name: "d/e", typeflag: tar.TypeDir},
+			{name: "x", typeflag: tar.TypeSymlink, link: "d/e"},
+			{name: "y", typeflag: tar.TypeSymlink, link: "x/../../.."},
+		}, "y"},
+		{"through a dangling symlink", []member{
+			{name: "x", typeflag: tar.TypeSymlink, link: "missing/.."},
+			{name: "y", typeflag: tar.TypeSymlink, link: "x/../z"},
+		}, "y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inRoot(t, func(string) {
+				e := NewExtractor(bytes.NewReader(makeTarball(t, tt.members)))
+				err := e.ExtractAll()
+				if tt.refused == "" {
+					if err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				if err == nil {
+					t.Fatalf("%s was extracted", tt.refused)
+				}
+				if _, err := os.Lstat(tt.refused); err == nil {
+					t.Errorf("%s exists", tt.refused)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// FakerootRecord holds the metadata an unprivileged extraction could not
+// apply to a member.
+type FakerootRecord struct {
+	Name     string `json:"name"`
+	Typeflag string `json:"type"`
+	Mode     int64  `json:"mode"`
+	Uid      int    `json:"uid"`
+	Gid      int    `json:"gid"`
+	Uname    string `json:"uname,omitempty"`
+	Gname    string `json:"gname,omitempty"`
+	Devmajor int64  `json:"devmajor,omitempty"`
+	Devminor int64  `json:"devminor,omitempty"`
+}
+
+// FakerootDB is an ownership database keyed by member name. It lets
+// unprivileged users extract a tarball, modify the tree and pack it again
+// without losing owners, modes or device nodes.
+type FakerootDB map[string]*FakerootRecord
+
+func fakerootKey(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "./"))
+}
+
+// LoadFakerootDB reads a database of JSON lines; a missing file yields an
+// empty database so the first extraction can create it.
+func LoadFakerootDB(dbPath string) (FakerootDB, error) {
+	db := make(FakerootDB)
+	dbFile, err := os.Open(dbPath)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the ownership database: %s", err)
+	}
+	defer dbFile.Close()
+
+	scanner := bufio.NewScanner(dbFile)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		rec := &FakerootRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return nil, fmt.Errorf("Error parsing the ownership database: %s", err)
+		}
+		db[fakerootKey(rec.Name)] = rec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the ownership database: %s", err)
+	}
+	return db, nil
+}
+
+// Save writes the database to dbPath, one JSON record per line.
+func (db FakerootDB) Save(dbPath string) error {
+	names := make([]string, 0, len(db))
+	for name := range db {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dbFile, err := os.Create(dbPath)
+	if err != nil {
+		return fmt.Errorf("Error creating the ownership database: %s", err)
+	}
+	w := bufio.NewWriter(dbFile)
+	enc := json.NewEncoder(w)
+	for _, name := range names {
+		if err := enc.Encode(db[name]); err != nil {
+			dbFile.Close()
+			return fmt.Errorf("Error writing the ownership database: %s", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		dbFile.Close()
+		return fmt.Errorf("Error writing the ownership database: %s", err)
+	}
+	return dbFile.Close()
+}
+
+// Record stores the metadata of an extracted member.
+func (db FakerootDB) Record(hdr *tar.Header) {
+	key := fakerootKey(hdr.Name)
+	db[key] = &FakerootRecord{
+		Name:     key,
+		Typeflag: string(hdr.Typeflag),
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+}
+
+// Apply restores recorded metadata onto a header built from the files on
+// disk. Device and FIFO placeholders get their original type back and lose
+// their (empty) content.
+func (db FakerootDB) Apply(header *tar.Header) {
+	rec, ok := db[fakerootKey(header.Name)]
+	if !ok {
+		return
+	}
+	header.Mode = rec.Mode
+	header.Uid = rec.Uid
+	header.Gid = rec.Gid
+	header.Uname = rec.Uname
+	header.Gname = rec.Gname
+	switch tf := rec.Typeflag; tf {
+	case string(tar.TypeChar), string(tar.TypeBlock), string(tar.TypeFifo):
+		header.Typeflag = tf[0]
+		header.Devmajor = rec.Devmajor
+		header.Devminor = rec.Devminor
+		header.Size = 0
+	}
+}
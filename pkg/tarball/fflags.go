@@ -0,0 +1,38 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+)
+
+// fflagsKey is the PAX record holding file flags, as a comma-separated
+// list of names. On Windows these are the readonly, hidden and system
+// attributes, named as libarchive names them.
+const fflagsKey = "SCHILY.fflags"
+
+// addFileFlags stores the file flags of info in header and gives it the
+// mode the file would have on a Unix system, where the system has no
+// mode of its own.
+func addFileFlags(header *tar.Header, name string, info os.FileInfo) {
+	header.Mode = systemMode(header.Mode, name, info)
+	if flags := fileFlags(info); flags != "" {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[fflagsKey] = flags
+	}
+}
+
+// setFileFlags applies the file flags stored in hdr to destPath, where
+// the system has them.
+func setFileFlags(hdr *tar.Header, destPath string) error {
+	flags, ok := hdr.PAXRecords[fflagsKey]
+	if !ok {
+		return nil
+	}
+	if err := applyFileFlags(destPath, flags); err != nil {
+		return fmt.Errorf("Error setting file attributes: %s", err)
+	}
+	return nil
+}
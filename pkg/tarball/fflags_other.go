@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package tarball
+
+import "os"
+
+// Unix modes are stored as they are, and the flags of other systems are
+// not kept.
+
+func fileFlags(info os.FileInfo) string {
+	return ""
+}
+
+func systemMode(mode int64, name string, info os.FileInfo) int64 {
+	return mode
+}
+
+func applyFileFlags(p, flags string) error {
+	return nil
+}
@@ -0,0 +1,76 @@
+package tarball
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var fileFlagNames = []struct {
+	name string
+	attr uint32
+}{
+	{"rdonly", syscall.FILE_ATTRIBUTE_READONLY},
+	{"hidden", syscall.FILE_ATTRIBUTE_HIDDEN},
+	{"system", syscall.FILE_ATTRIBUTE_SYSTEM},
+}
+
+func fileAttributes(info os.FileInfo) uint32 {
+	if d, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return d.FileAttributes
+	}
+	return 0
+}
+
+func fileFlags(info os.FileInfo) string {
+	attrs := fileAttributes(info)
+	var names []string
+	for _, f := range fileFlagNames {
+		if attrs&f.attr != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// systemMode replaces the 0666 and 0777 modes Windows reports with 0644
+// for files, 0755 for directories and programs, and takes write
+// permission away from readonly files.
+func systemMode(mode int64, name string, info os.FileInfo) int64 {
+	perm := int64(0644)
+	switch {
+	case info.IsDir():
+		perm = 0755
+	case info.Mode().IsRegular():
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".exe", ".com", ".bat", ".cmd":
+			perm = 0755
+		}
+	default:
+		return mode
+	}
+	if fileAttributes(info)&syscall.FILE_ATTRIBUTE_READONLY != 0 {
+		perm &^= 0222
+	}
+	return mode&^0777 | perm
+}
+
+func applyFileFlags(p, flags string) error {
+	name, err := syscall.UTF16PtrFromString(p)
+	if err != nil {
+		return err
+	}
+	attrs, err := syscall.GetFileAttributes(name)
+	if err != nil {
+		return err
+	}
+	for _, flag := range strings.Split(flags, ",") {
+		for _, f := range fileFlagNames {
+			if strings.TrimSpace(flag) == f.name {
+				attrs |= f.attr
+			}
+		}
+	}
+	return syscall.SetFileAttributes(name, attrs)
+}
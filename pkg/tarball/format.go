@@ -0,0 +1,122 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"time"
+)
+
+// ustarMaxSize is the largest size the 11 octal digits of a ustar header
+// hold, 8 GiB less a byte.
+const ustarMaxSize = 1<<33 - 1
+
+// ParseFormat returns the tar format named ustar, pax or gnu, or the
+// zero Format, which picks ustar when a member fits it and PAX otherwise,
+// for an empty name.
+func ParseFormat(name string) (tar.Format, error) {
+	switch name {
+	case "":
+		return tar.FormatUnknown, nil
+	case "ustar":
+		return tar.FormatUSTAR, nil
+	case "pax":
+		return tar.FormatPAX, nil
+	case "gnu":
+		return tar.FormatGNU, nil
+	}
+	return tar.FormatUnknown, fmt.Errorf("Unknown tar format: %s", name)
+}
+
+// needsPAX reports whether header holds a member too large or a path too
+// long for a ustar header, for which PAX is chosen rather than leaving
+// archive/tar to fall back to a GNU extension.
+func needsPAX(header *tar.Header) bool {
+	return header.Size > ustarMaxSize || len(header.Name) > 255 || len(header.Linkname) > 100
+}
+
+// formatLimit explains why format cannot store header, or returns "" when
+// no reason is known.
+func formatLimit(header *tar.Header, format tar.Format) string {
+	if len(header.PAXRecords) > 0 {
+		return "its extended attributes, ACLs or other PAX records need the pax format"
+	}
+	if format != tar.FormatUSTAR {
+		return ""
+	}
+	switch {
+	case header.Size > ustarMaxSize:
+		return "it is larger than 8 GiB"
+	case len(header.Name) > 256 || !ustarSplits(header.Name):
+		return "its path is too long"
+	case len(header.Linkname) > 100:
+		return "its link target is longer than 100 bytes"
+	case !isASCII(header.Name) || !isASCII(header.Linkname):
+		return "its path is not ASCII"
+	case header.Uid > 07777777 || header.Gid > 07777777:
+		return "its user or group id is too large"
+	case len(header.Uname) > 32 || len(header.Gname) > 32:
+		return "its user or group name is longer than 32 bytes"
+	case header.ModTime.Unix() < 0 || header.ModTime.Unix() > ustarMaxSize:
+		return "its modification time is out of range"
+	}
+	return ""
+}
+
+// ustarSplits reports whether name fits the 100 bytes of the name field,
+// or splits at a slash into those and the 155 bytes of the prefix.
+func ustarSplits(name string) bool {
+	if len(name) <= 100 {
+		return true
+	}
+	for i := len(name) - 1; i >= 0; i-- {
+		if name[i] == '/' && i <= 155 && len(name)-i-1 <= 100 && i < len(name)-1 {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeHeader writes header in a.Format, or with PAX forced for large
+// members and long paths, naming the member and the reason when the
+// format cannot store it.
+func (a *Archiver) writeHeader(header *tar.Header) error {
+	if a.Format == tar.FormatUSTAR {
+		// ustar has no access and change times, and whole seconds only,
+		// which archive/tar drops only when it picks the format itself.
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		header.ModTime = header.ModTime.Round(time.Second)
+	}
+	if a.Format != tar.FormatUnknown {
+		header.Format = a.Format
+	} else if needsPAX(header) {
+		header.Format = tar.FormatPAX
+	}
+	if err := a.tw.WriteHeader(header); err != nil {
+		if reason := formatLimit(header, header.Format); reason != "" {
+			return fmt.Errorf("Error writing %s: the %s format cannot store it, as %s; use the pax format", header.Name, formatName(header.Format), reason)
+		}
+		return fmt.Errorf("Error writing the file header for %s: %s", header.Name, err)
+	}
+	return nil
+}
+
+func formatName(f tar.Format) string {
+	switch f {
+	case tar.FormatUSTAR:
+		return "ustar"
+	case tar.FormatPAX:
+		return "pax"
+	case tar.FormatGNU:
+		return "gnu"
+	}
+	return f.String()
+}
@@ -0,0 +1,90 @@
+package tarball
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// IDRange maps Count ids starting at From to the ids starting at To.
+type IDRange struct {
+	From  int
+	To    int
+	Count int
+}
+
+// IDMap translates user or group ids, as between a user namespace and the
+// host. Ids outside every range are left as they are.
+type IDMap []IDRange
+
+// LoadIDMap reads an id map with a range per line, either as CSV,
+// "from,to[,count]", or in the /etc/subuid format, "name:start:count",
+// which maps ids 0 to count-1 to the range starting at start. Blank lines
+// and lines starting with '#' are skipped.
+func LoadIDMap(mapPath string) (IDMap, error) {
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the id map: %s", err)
+	}
+	defer f.Close()
+
+	var m IDMap
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseIDRange(line)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing the id map at line %d: %s", lineNo, err)
+		}
+		m = append(m, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the id map: %s", err)
+	}
+	return m, nil
+}
+
+func parseIDRange(line string) (IDRange, error) {
+	var fields []string
+	r := IDRange{Count: 1}
+	if strings.Contains(line, ",") {
+		fields = strings.Split(line, ",")
+		if len(fields) != 2 && len(fields) != 3 {
+			return r, fmt.Errorf("expected from,to[,count]")
+		}
+	} else {
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return r, fmt.Errorf("expected from,to[,count] or name:start:count")
+		}
+		fields = []string{"0", parts[1], parts[2]}
+	}
+	nums := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 0 {
+			return r, fmt.Errorf("invalid id %q", field)
+		}
+		nums[i] = n
+	}
+	r.From, r.To = nums[0], nums[1]
+	if len(nums) == 3 {
+		r.Count = nums[2]
+	}
+	return r, nil
+}
+
+// Map returns the id that id translates to.
+func (m IDMap) Map(id int) int {
+	for _, r := range m {
+		if id >= r.From && id < r.From+r.Count {
+			return r.To + id - r.From
+		}
+	}
+	return id
+}
@@ -0,0 +1,200 @@
+package tarball
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is one line of a gitignore-style file.
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// vcsNames are the directories and files of version control systems, as
+// left out by GNU tar --exclude-vcs.
+var vcsNames = map[string]bool{
+	"CVS": true, ".cvsignore": true, "RCS": true, "SCCS": true,
+	".git": true, ".gitignore": true, ".gitattributes": true, ".gitmodules": true,
+	".svn": true, ".arch-ids": true, "{arch}": true,
+	"=RELEASE-ID": true, "=meta-update": true, "=update": true,
+	".bzr": true, ".bzrignore": true, ".bzrtags": true,
+	".hg": true, ".hgignore": true, ".hgtags": true, "_darcs": true,
+}
+
+// Cache directory modes accepted by Archiver.ExcludeCaches. A cache
+// directory holds a CACHEDIR.TAG file starting with cacheTagSignature;
+// ExcludeCachesTag keeps the directory and the tag, ExcludeCachesUnder
+// the directory alone, and ExcludeCachesAll neither.
+const (
+	ExcludeCachesTag   = "tag"
+	ExcludeCachesUnder = "under"
+	ExcludeCachesAll   = "all"
+)
+
+const (
+	cacheTagName      = "CACHEDIR.TAG"
+	cacheTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// cacheTagged reports whether dir holds a valid CACHEDIR.TAG, as defined
+// by the Cache Directory Tagging Specification.
+func cacheTagged(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, cacheTagName))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, len(cacheTagSignature))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false
+	}
+	return string(buf) == cacheTagSignature
+}
+
+// ignoreRules holds the rules of the ignore files found during a walk,
+// keyed by the directory each file was found in.
+type ignoreRules struct {
+	names []string
+	rules map[string][]ignoreRule
+}
+
+func newIgnoreRules(names ...string) *ignoreRules {
+	return &ignoreRules{names: names, rules: make(map[string][]ignoreRule)}
+}
+
+// load reads the ignore files of dir, if there are any. The rules of
+// files named later come after those named earlier.
+func (ir *ignoreRules) load(dir string) error {
+	var rules []ignoreRule
+	for _, name := range ir.names {
+		more, err := readIgnoreFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		rules = append(rules, more...)
+	}
+	if len(rules) > 0 {
+		ir.rules[filepath.Clean(dir)] = rules
+	}
+	return nil
+}
+
+// readIgnoreFile returns the rules of the ignore file name, or none when
+// there is no such file.
+func readIgnoreFile(name string) ([]ignoreRule, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s: %s", name, err)
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", name, err)
+	}
+	return rules, nil
+}
+
+// ignored reports whether p is excluded by the ignore files of its parent
+// directories. Deeper files take precedence, and within a file the last
+// matching rule wins, so '!' lines can re-include earlier matches.
+func (ir *ignoreRules) ignored(p string, isDir bool) bool {
+	p = filepath.Clean(p)
+	var dirs []string
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if _, ok := ir.rules[dir]; ok {
+			dirs = append(dirs, dir)
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], p)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, rule := range ir.rules[dirs[i]] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			target := rel
+			if !rule.anchored {
+				target = path.Base(rel)
+			}
+			if matchPath(rule.pattern, target) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// matchPath matches a slash-separated name against pattern, where a "**"
+// element matches any number of path elements, including none.
+func matchPath(pattern, name string) bool {
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElements(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchElements(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,74 @@
+package tarball
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// IndexEntry locates a member in the uncompressed tar stream.
+type IndexEntry struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+}
+
+// IndexBlock maps the start of an independently decodable block of a
+// compressed tarball to the tar stream offset it holds.
+type IndexBlock struct {
+	Offset    int64 `json:"offset"`
+	RawOffset int64 `json:"raw"`
+}
+
+// Index records where every member of a tarball starts, so members can be
+// extracted without reading the ones before them. Size is the size of the
+// tarball file the index was made for, to detect stale indexes.
+type Index struct {
+	Size    int64        `json:"size"`
+	Entries []IndexEntry `json:"entries"`
+	Blocks  []IndexBlock `json:"blocks,omitempty"`
+}
+
+// LoadIndex reads an index saved with Save.
+func LoadIndex(indexPath string) (*Index, error) {
+	f, err := os.Open(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the index: %s", err)
+	}
+	defer f.Close()
+	return ReadIndex(f)
+}
+
+// ReadIndex reads an index written by Save from r.
+func ReadIndex(r io.Reader) (*Index, error) {
+	ix := &Index{}
+	if err := json.NewDecoder(r).Decode(ix); err != nil {
+		return nil, fmt.Errorf("Error parsing the index: %s", err)
+	}
+	return ix, nil
+}
+
+// Save writes the index to indexPath.
+func (ix *Index) Save(indexPath string) error {
+	f, err := os.Create(indexPath)
+	if err != nil {
+		return fmt.Errorf("Error creating the index: %s", err)
+	}
+	if err := json.NewEncoder(f).Encode(ix); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing the index: %s", err)
+	}
+	return f.Close()
+}
+
+// countingWriter tracks the offset in the tar stream for the index.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,227 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Whiteout modes accepted by Extractor.Whiteout.
+const (
+	WhiteoutRemove  = "remove"
+	WhiteoutOverlay = "overlay"
+)
+
+type layerEntry struct {
+	source string
+	header *tar.Header
+}
+
+// ociName normalizes a path to the form used inside image layers: slash
+// separated, relative, and with a trailing slash for directories.
+func ociName(name string, isDir bool) string {
+	name = path.Clean(filepath.ToSlash(name))
+	name = strings.TrimLeft(name, "/")
+	name = strings.TrimPrefix(name, "./")
+	if isDir && name != "" && name != "." {
+		name += "/"
+	}
+	return name
+}
+
+// AddLayer walks the given paths and writes them as an OCI image layer:
+// members sorted by name, every parent directory present as its own entry,
+// and modes reduced to permission bits. Deletions are written as whiteouts:
+// those of an overlayfs upper directory, recorded as 0/0 character devices
+// and opaque directories, and the members of LayerBase under the paths that
+// are gone from disk.
+func (a *Archiver) AddLayer(paths []string) error {
+	entries := make(map[string]*layerEntry)
+	var roots []string
+	for _, root := range paths {
+		roots = append(roots, ociName(root, false))
+		err := a.walk(root, func(p string, info os.FileInfo, err error) error {
+			name := ociName(p, info.IsDir())
+			if name == "" || name == "." {
+				return nil
+			}
+			header, err := a.header(p, name, info)
+			if err != nil {
+				return err
+			}
+			header.Mode &= 07777
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+			if header.Typeflag == tar.TypeChar && header.Devmajor == 0 && header.Devminor == 0 {
+				name = whiteoutName(name)
+				entries[name] = &layerEntry{header: whiteoutHeader(name, header.ModTime)}
+				return nil
+			}
+			entries[name] = &layerEntry{source: p, header: header}
+			if info.IsDir() && overlayIsOpaque(p) {
+				opaque := name + whiteoutOpaque
+				entries[opaque] = &layerEntry{header: whiteoutHeader(opaque, header.ModTime)}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	a.addBaseWhiteouts(entries, roots)
+
+	for name := range entries {
+		for dir := path.Dir(strings.TrimSuffix(name, "/")); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, ok := entries[dir+"/"]; ok {
+				continue
+			}
+			entries[dir+"/"] = &layerEntry{source: dir + "/", header: &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir + "/",
+				Mode:     0755,
+				ModTime:  time.Unix(0, 0),
+			}}
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entry := entries[name]
+		var err error
+		if entry.source == "" {
+			// Whiteouts are empty files with no source on disk.
+			err = a.emit(entry.header, "", strings.NewReader(""))
+		} else {
+			err = a.write(entry.source, entry.header)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whiteoutName returns the name of the whiteout deleting name.
+func whiteoutName(name string) string {
+	dir, base := path.Split(strings.TrimSuffix(name, "/"))
+	return dir + whiteoutPrefix + base
+}
+
+func whiteoutHeader(name string, modTime time.Time) *tar.Header {
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0)
+	}
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, ModTime: modTime}
+}
+
+// addBaseWhiteouts adds to entries a whiteout for every member of
+// a.LayerBase under roots that entries no longer hold. The contents of a
+// deleted directory go with it.
+func (a *Archiver) addBaseWhiteouts(entries map[string]*layerEntry, roots []string) {
+	deleted := make(map[string]bool)
+	for _, name := range a.LayerBase {
+		name = strings.TrimSuffix(ociName(name, false), "/")
+		if name == "" || name == "." || entries[name] != nil || entries[name+"/"] != nil {
+			continue
+		}
+		for _, root := range roots {
+			if root == "." || name == root || strings.HasPrefix(name, root+"/") {
+				deleted[name] = true
+				break
+			}
+		}
+	}
+	for name := range deleted {
+		if !deleted[path.Dir(name)] {
+			wh := whiteoutName(name)
+			entries[wh] = &layerEntry{header: whiteoutHeader(wh, a.ModTime)}
+		}
+	}
+}
+
+// overlayIsOpaque reports whether the directory at p is marked opaque in
+// an overlayfs upper directory, hiding what the lower ones hold.
+func overlayIsOpaque(p string) bool {
+	for _, name := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		if v, _ := getXattr(p, name); string(v) == "y" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyWhiteout handles a layer whiteout member according to mode. With
+// "remove", a ".wh.name" entry removes name from the tree being extracted and
+// an opaque marker empties its directory of everything not written by the
+// current layer (tracked in extracted). With "overlay", the whiteouts are
+// recreated the way overlayfs expects them: a 0/0 character device for a
+// removed path and the trusted.overlay.opaque xattr for an opaque directory.
+// It reports whether the member named name was a whiteout.
+func applyWhiteout(name string, extracted map[string]bool, mode string) (bool, error) {
+	name = strings.TrimSuffix(name, "/")
+	base := path.Base(name)
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return false, nil
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return true, fmt.Errorf("Refusing whiteout outside the extraction root: %s", name)
+	}
+	dir := path.Dir(name)
+
+	if base == whiteoutOpaque {
+		if mode == WhiteoutOverlay {
+			if err := os.MkdirAll(filepath.FromSlash(dir), 0755); err != nil {
+				return true, fmt.Errorf("Error creating directory: %s", err)
+			}
+			return true, overlayOpaque(filepath.FromSlash(dir))
+		}
+		children, err := os.ReadDir(filepath.FromSlash(dir))
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		if err != nil {
+			return true, fmt.Errorf("Error reading directory %s: %s", dir, err)
+		}
+		for _, child := range children {
+			target := path.Join(dir, child.Name())
+			if extracted[target] {
+				continue
+			}
+			if err := os.RemoveAll(filepath.FromSlash(target)); err != nil {
+				return true, fmt.Errorf("Error removing %s: %s", target, err)
+			}
+		}
+		return true, nil
+	}
+
+	hidden := strings.TrimPrefix(base, whiteoutPrefix)
+	if hidden == "" {
+		return true, fmt.Errorf("Invalid whiteout entry: %s", name)
+	}
+	target := path.Join(dir, hidden)
+	if err := os.RemoveAll(filepath.FromSlash(target)); err != nil {
+		return true, fmt.Errorf("Error removing %s: %s", target, err)
+	}
+	if mode == WhiteoutOverlay {
+		if err := os.MkdirAll(filepath.FromSlash(dir), 0755); err != nil {
+			return true, fmt.Errorf("Error creating directory: %s", err)
+		}
+		return true, overlayWhiteout(filepath.FromSlash(target))
+	}
+	return true, nil
+}
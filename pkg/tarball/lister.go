@@ -0,0 +1,59 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// Lister walks the headers of a tarball without extracting anything.
+type Lister struct {
+	tr *tar.Reader
+}
+
+// Stats summarizes the members of a tarball.
+type Stats struct {
+	Files       int
+	Directories int
+	Symlinks    int
+	Others      int
+	// Size is the total size of the regular files.
+	Size int64
+}
+
+// NewLister returns a Lister reading a tarball from r.
+func NewLister(r io.Reader) *Lister {
+	return &Lister{tr: tar.NewReader(r)}
+}
+
+// Next returns the header of the next member, or io.EOF at the end of the
+// tarball.
+func (l *Lister) Next() (*tar.Header, error) {
+	return l.tr.Next()
+}
+
+// Stats reads the remaining members and counts them by type.
+func (l *Lister) Stats() (*Stats, error) {
+	st := &Stats{}
+	for {
+		header, err := l.tr.Next()
+		if err == io.EOF {
+			return st, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			st.Files++
+			st.Size += header.Size
+		case tar.TypeDir:
+			st.Directories++
+		case tar.TypeSymlink:
+			st.Symlinks++
+		default:
+			st.Others++
+		}
+	}
+}
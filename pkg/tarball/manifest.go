@@ -0,0 +1,97 @@
+package tarball
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManifestEntry maps a path on disk to its name inside the tarball. A Mode
+// of -1 and a zero ModTime keep the values found on disk.
+type ManifestEntry struct {
+	Source  string
+	Name    string
+	Mode    int64
+	ModTime time.Time
+}
+
+// ReadManifest parses a manifest file of 'source => name [mode] [mtime]'
+// lines. The mode is octal, with "-" keeping the original; the mtime is in
+// Unix seconds or RFC 3339. Blank lines and '#' comments are skipped.
+func ReadManifest(manifestPath string) ([]ManifestEntry, error) {
+	mf, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the manifest: %s", err)
+	}
+	defer mf.Close()
+
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(mf)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=>", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: missing '=>'", manifestPath, lineNo)
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected 'source => name [mode] [mtime]'", manifestPath, lineNo)
+		}
+		entry := ManifestEntry{
+			Source: strings.TrimSpace(parts[0]),
+			Name:   strings.TrimPrefix(fields[0], "/"),
+			Mode:   -1,
+		}
+		if len(fields) > 1 && fields[1] != "-" {
+			entry.Mode, err = strconv.ParseInt(fields[1], 8, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid mode %q", manifestPath, lineNo, fields[1])
+			}
+		}
+		if len(fields) > 2 {
+			if secs, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				entry.ModTime = time.Unix(secs, 0)
+			} else if entry.ModTime, err = time.Parse(time.RFC3339, fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid mtime %q", manifestPath, lineNo, fields[2])
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the manifest: %s", err)
+	}
+	return entries, nil
+}
+
+// AddManifestEntry stores entry.Source under entry.Name, walking directories
+// so their contents land below the new name. Mode and mtime overrides apply
+// to every member produced by the entry.
+func (a *Archiver) AddManifestEntry(entry ManifestEntry) error {
+	return a.walk(entry.Source, func(p string, info os.FileInfo, err error) error {
+		rel, err := filepath.Rel(entry.Source, p)
+		if err != nil {
+			return err
+		}
+		header, err := a.header(p, path.Join(entry.Name, filepath.ToSlash(rel)), info)
+		if err != nil {
+			return err
+		}
+		if entry.Mode >= 0 {
+			header.Mode = entry.Mode
+		}
+		if !entry.ModTime.IsZero() {
+			header.ModTime = entry.ModTime
+		}
+		return a.write(p, header)
+	})
+}
@@ -0,0 +1,347 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// excluded reports whether name matches any of patterns. Like GNU tar, a
+// pattern may match the whole path or any trailing part of it that starts
+// after a '/', so "*.o" and "node_modules" apply at every depth. Patterns
+// may use "**" as Match does.
+func excluded(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	name = strings.TrimSuffix(path.Clean(filepath.ToSlash(name)), "/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+		for sub := name; ; {
+			if matchPath(pattern, sub) {
+				return true
+			}
+			i := strings.Index(sub, "/")
+			if i < 0 {
+				break
+			}
+			sub = sub[i+1:]
+		}
+	}
+	return false
+}
+
+// skipExcluded is the walk result for an excluded path: the whole subtree
+// for directories, just the entry otherwise.
+func skipExcluded(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// ReadPatterns reads one pattern per line from patternPath, ignoring blank
+// lines and lines starting with '#'. Surrounding whitespace is trimmed.
+func ReadPatterns(patternPath string) ([]string, error) {
+	pf, err := os.Open(patternPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the pattern file: %s", err)
+	}
+	defer pf.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(pf)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the pattern file: %s", err)
+	}
+	return patterns, nil
+}
+
+// Match reports whether the slash-separated name matches pattern, as
+// path.Match does, except that a "**" element matches any number of path
+// elements, including none, so "**/*.log" matches log files at any depth.
+func Match(pattern, name string) (bool, error) {
+	for _, elem := range strings.Split(pattern, "/") {
+		if _, err := path.Match(elem, ""); err != nil && elem != "**" {
+			return false, err
+		}
+	}
+	return matchPath(pattern, name), nil
+}
+
+// Glob returns the files matching pattern, as filepath.Glob does, except
+// that a "**" element matches any number of directories, including none.
+// The matches are in walk order, each directory before what it holds.
+func Glob(pattern string) ([]string, error) {
+	slashed := filepath.ToSlash(pattern)
+	elems := strings.Split(slashed, "/")
+	i := 0
+	for i < len(elems) && elems[i] != "**" {
+		i++
+	}
+	if i == len(elems) {
+		return filepath.Glob(pattern)
+	}
+	if _, err := Match(slashed, ""); err != nil {
+		return nil, err
+	}
+	roots := []string{"."}
+	if base := strings.Join(elems[:i], "/"); base != "" {
+		var err error
+		if roots, err = filepath.Glob(filepath.FromSlash(base)); err != nil {
+			return nil, err
+		}
+	} else if i > 0 {
+		roots = []string{string(filepath.Separator)}
+	}
+	var matches []string
+	for _, root := range roots {
+		// Unreadable directories are passed over, as filepath.Glob does.
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || p == "." {
+				return nil
+			}
+			if matchPath(slashed, filepath.ToSlash(p)) {
+				matches = append(matches, p)
+			}
+			return nil
+		})
+	}
+	return matches, nil
+}
+
+// RegexpFilter selects members by name with regular expressions, for
+// rules that globs cannot express.
+type RegexpFilter struct {
+	// Include, when not empty, keeps only the names matching one of its
+	// expressions; Exclude then leaves out those matching any of its own.
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+}
+
+// Match reports whether f selects the member name. Directory names are
+// matched without their trailing slash. A nil filter selects everything.
+func (f *RegexpFilter) Match(name string) bool {
+	if f == nil {
+		return true
+	}
+	name = strings.TrimSuffix(name, "/")
+	return (len(f.Include) == 0 || matchAnyRegexp(f.Include, name)) && !matchAnyRegexp(f.Exclude, name)
+}
+
+func matchAnyRegexp(res []*regexp.Regexp, name string) bool {
+	for _, re := range res {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SizeFilter selects regular files by size. Members of other types are
+// always selected.
+type SizeFilter struct {
+	// Min and Max, when not 0, are the smallest and largest sizes kept.
+	Min int64
+	Max int64
+}
+
+// Match reports whether f selects the member hdr. A nil filter selects
+// everything.
+func (f *SizeFilter) Match(hdr *tar.Header) bool {
+	if f == nil || (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeGNUSparse) {
+		return true
+	}
+	return hdr.Size >= f.Min && (f.Max == 0 || hdr.Size <= f.Max)
+}
+
+// TypeFilter selects members by type, keyed by the letters find -type
+// uses: f for regular files, d for directories, l for symbolic links, h
+// for hard links, c and b for character and block devices, and p for
+// FIFOs.
+type TypeFilter map[byte]bool
+
+// ParseTypeFilter returns the TypeFilter for letters such as "f" or "f,l".
+func ParseTypeFilter(letters string) (TypeFilter, error) {
+	f := make(TypeFilter)
+	for _, c := range strings.Replace(letters, ",", "", -1) {
+		if !strings.ContainsRune("fdlhcbp", c) {
+			return nil, fmt.Errorf("Invalid type %q: use f, d, l, h, c, b or p", c)
+		}
+		f[byte(c)] = true
+	}
+	if len(f) == 0 {
+		return nil, fmt.Errorf("Invalid type: empty")
+	}
+	return f, nil
+}
+
+// Match reports whether f selects the member hdr. A nil filter selects
+// everything.
+func (f TypeFilter) Match(hdr *tar.Header) bool {
+	if f == nil {
+		return true
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return f['d']
+	case tar.TypeSymlink:
+		return f['l']
+	case tar.TypeLink:
+		return f['h']
+	case tar.TypeChar:
+		return f['c']
+	case tar.TypeBlock:
+		return f['b']
+	case tar.TypeFifo:
+		return f['p']
+	}
+	return f['f']
+}
+
+// MatchOptions changes how glob patterns match member names, as the GNU
+// tar options of the same names do. Without it, patterns match as
+// path.Match does, with "**" as Match allows.
+type MatchOptions struct {
+	// IgnoreCase matches letters regardless of case.
+	IgnoreCase bool
+	// Anchored, when set, decides whether patterns must match whole names
+	// or may also match any trailing part starting after a '/'. By
+	// default, exclusion patterns are unanchored and member patterns
+	// anchored.
+	Anchored *bool
+	// WildcardsMatchSlash lets * and ? match '/' too.
+	WildcardsMatchSlash bool
+
+	mu    sync.Mutex
+	cache map[string]*regexp.Regexp
+}
+
+// match reports whether name matches pattern, anchored unless o says
+// otherwise.
+func (o *MatchOptions) match(pattern, name string, anchored bool) (bool, error) {
+	if o == nil {
+		if anchored {
+			return Match(pattern, name)
+		}
+		return excluded([]string{pattern}, name), nil
+	}
+	if o.Anchored != nil {
+		anchored = *o.Anchored
+	}
+	key := fmt.Sprint(anchored, "\x00", pattern)
+	o.mu.Lock()
+	re, ok := o.cache[key]
+	o.mu.Unlock()
+	if !ok {
+		expr, err := globRegexp(pattern, o.WildcardsMatchSlash)
+		if err != nil {
+			return false, err
+		}
+		if anchored {
+			expr = "^" + expr + "$"
+		} else {
+			expr = "(?:^|/)" + expr + "$"
+		}
+		if o.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		if re, err = regexp.Compile(expr); err != nil {
+			return false, path.ErrBadPattern
+		}
+		o.mu.Lock()
+		if o.cache == nil {
+			o.cache = make(map[string]*regexp.Regexp)
+		}
+		o.cache[key] = re
+		o.mu.Unlock()
+	}
+	return re.MatchString(name), nil
+}
+
+// excluded reports whether name matches any of the exclusion patterns.
+func (o *MatchOptions) excluded(patterns []string, name string) bool {
+	if o == nil {
+		return excluded(patterns, name)
+	}
+	name = strings.TrimSuffix(path.Clean(filepath.ToSlash(name)), "/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+		if matched, _ := o.match(pattern, name, false); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// globRegexp translates a glob pattern to a regular expression. A "**"
+// element matches any number of path elements, including none.
+func globRegexp(pattern string, slash bool) (string, error) {
+	star, one := "[^/]*", "[^/]"
+	if slash {
+		star, one = ".*", "."
+	}
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		elemStart := i == 0 || pattern[i-1] == '/'
+		switch {
+		case c == '*' && elemStart && strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && elemStart && pattern[i:] == "**":
+			b.WriteString(".*")
+			i++
+		case c == '/' && pattern[i+1:] == "**":
+			b.WriteString("(?:/.*)?")
+			i += 2
+		case c == '*':
+			b.WriteString(star)
+		case c == '?':
+			b.WriteString(one)
+		case c == '\\':
+			if i+1 == len(pattern) {
+				return "", path.ErrBadPattern
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '[':
+			j := i + 1
+			b.WriteByte('[')
+			if j < len(pattern) && (pattern[j] == '^' || pattern[j] == '!') {
+				b.WriteByte('^')
+				j++
+			}
+			for ; j < len(pattern) && pattern[j] != ']'; j++ {
+				if pattern[j] == '\\' && j+1 < len(pattern) {
+					j++
+				}
+				if strings.IndexByte(`\[]^`, pattern[j]) >= 0 {
+					b.WriteByte('\\')
+				}
+				b.WriteByte(pattern[j])
+			}
+			if j == len(pattern) {
+				return "", path.ErrBadPattern
+			}
+			b.WriteByte(']')
+			i = j
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return b.String(), nil
+}
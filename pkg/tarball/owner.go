@@ -0,0 +1,115 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// ownerIDs resolves user and group names to ids, caching the lookups.
+type ownerIDs struct {
+	users  map[string]int
+	groups map[string]int
+}
+
+func (o *ownerIDs) uid(name string, fallback int) int {
+	if name == "" {
+		return fallback
+	}
+	if o.users == nil {
+		o.users = make(map[string]int)
+	}
+	id, ok := o.users[name]
+	if !ok {
+		id = fallback
+		if u, err := user.Lookup(name); err == nil {
+			if n, err := strconv.Atoi(u.Uid); err == nil {
+				id = n
+			}
+		}
+		o.users[name] = id
+	}
+	return id
+}
+
+func (o *ownerIDs) gid(name string, fallback int) int {
+	if name == "" {
+		return fallback
+	}
+	if o.groups == nil {
+		o.groups = make(map[string]int)
+	}
+	id, ok := o.groups[name]
+	if !ok {
+		id = fallback
+		if g, err := user.LookupGroup(name); err == nil {
+			if n, err := strconv.Atoi(g.Gid); err == nil {
+				id = n
+			}
+		}
+		o.groups[name] = id
+	}
+	return id
+}
+
+// chown gives the extracted member at destPath the owner and group of hdr
+// when SameOwner is set. Unless NumericOwner is set, names are preferred
+// to ids when they exist on this system, as tar does.
+func (e *Extractor) chown(hdr *tar.Header, destPath string) error {
+	if !e.SameOwner {
+		return nil
+	}
+	uid, gid := hdr.Uid, hdr.Gid
+	if !e.NumericOwner {
+		uid = e.ids.uid(hdr.Uname, hdr.Uid)
+		gid = e.ids.gid(hdr.Gname, hdr.Gid)
+	}
+	if err := os.Lchown(destPath, e.OwnerMap.Map(uid), e.GroupMap.Map(gid)); err != nil {
+		return fmt.Errorf("Error setting ownership: %s", err)
+	}
+	return nil
+}
+
+// Owner is a user or group forced onto the members of a tarball.
+type Owner struct {
+	Name string
+	ID   int
+}
+
+// ParseOwner parses "name:id", a name to look up on this system, or a
+// numeric id alone, given as "id" or "+id", which leaves the name empty.
+// It parses a group when group is set, and a user otherwise.
+func ParseOwner(s string, group bool) (*Owner, error) {
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		id, err := strconv.Atoi(s[i+1:])
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("Invalid id in %q", s)
+		}
+		return &Owner{Name: s[:i], ID: id}, nil
+	}
+	if id, err := strconv.Atoi(strings.TrimPrefix(s, "+")); err == nil && id >= 0 {
+		return &Owner{ID: id}, nil
+	}
+	var ids string
+	if group {
+		g, err := user.LookupGroup(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown group %q; give its id as name:id", s)
+		}
+		ids = g.Gid
+	} else {
+		u, err := user.Lookup(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown user %q; give its id as name:id", s)
+		}
+		ids = u.Uid
+	}
+	id, err := strconv.Atoi(ids)
+	if err != nil {
+		return nil, fmt.Errorf("The id of %q is not numeric", s)
+	}
+	return &Owner{Name: s, ID: id}, nil
+}
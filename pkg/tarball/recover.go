@@ -0,0 +1,100 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// recoveryReader counts the bytes read from the tarball and keeps the
+// last read error, so Recover can tell damage in the tarball apart from
+// errors writing the extracted files, and knows where to resume.
+type recoveryReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (rr *recoveryReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if err != nil && err != io.EOF {
+		rr.err = err
+	}
+	return n, err
+}
+
+// validHeader reports whether block is a ustar header with a correct
+// checksum.
+func validHeader(block []byte) bool {
+	if !bytes.HasPrefix(block[257:], []byte("ustar")) {
+		return false
+	}
+	want, err := strconv.ParseInt(strings.Trim(string(block[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	var sum int64
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	return sum == want
+}
+
+// next returns the next header. With Recover set, a damaged header is
+// recorded and skipped by resynchronizing on the following valid one.
+func (e *Extractor) next() (*tar.Header, error) {
+	for {
+		hdr, err := e.tr.Next()
+		if err == nil || err == io.EOF || !e.Recover {
+			return hdr, err
+		}
+		if err := e.resync(fmt.Sprintf("bad header: %s", err)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// damaged decides what to do with an error met while extracting a member.
+// In Recover mode, errors reading the tarball are recorded and extraction
+// resumes at the next valid header; anything else is returned.
+func (e *Extractor) damaged(hdr *tar.Header, err error) error {
+	if !e.Recover || (e.rr.err == nil && err != io.ErrUnexpectedEOF) {
+		return err
+	}
+	return e.resync(fmt.Sprintf("%s: %s", hdr.Name, err))
+}
+
+// resync records a damaged part of the tarball and scans forward, block
+// by block, for the next valid header. It returns io.EOF when none is
+// left.
+func (e *Extractor) resync(what string) error {
+	start := e.rr.n
+	e.rr.err = nil
+	if pad := (512 - e.rr.n%512) % 512; pad > 0 {
+		if _, err := io.CopyN(ioutil.Discard, e.rr, pad); err != nil {
+			e.Damaged = append(e.Damaged, fmt.Sprintf("%s (rest of the tarball lost)", what))
+			return io.EOF
+		}
+	}
+	block := make([]byte, 512)
+	for {
+		if _, err := io.ReadFull(e.rr, block); err != nil {
+			e.Damaged = append(e.Damaged, fmt.Sprintf("%s (rest of the tarball lost)", what))
+			return io.EOF
+		}
+		if validHeader(block) {
+			break
+		}
+	}
+	e.Damaged = append(e.Damaged, fmt.Sprintf("%s (skipped %d bytes at offset %d)", what, e.rr.n-512-start, start))
+	e.tr = tar.NewReader(io.MultiReader(bytes.NewReader(block), e.rr))
+	return nil
+}
@@ -0,0 +1,159 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// ResumeRecord identifies a member fully extracted by an earlier run.
+// SHA256 is the hash of the content of a regular file, and empty for
+// other members.
+type ResumeRecord struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ResumeState lets an interrupted extraction start again where it
+// stopped: it holds the members extracted by earlier runs, which are
+// skipped while still intact on disk, and records every member extracted
+// by this run as soon as it is done.
+type ResumeState struct {
+	path string
+	f    *os.File
+	done map[string]ResumeRecord
+}
+
+// LoadResumeState reads a resume state file of JSON lines. A missing file
+// yields an empty state, which extracts everything. Lines that cannot be
+// parsed, such as one cut short by an interruption, are ignored, and their
+// members extracted again.
+func LoadResumeState(statePath string) (*ResumeState, error) {
+	s := &ResumeState{path: statePath, done: make(map[string]ResumeRecord)}
+	f, err := os.Open(statePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the resume state file: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var rec ResumeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		s.done[rec.Name] = rec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the resume state file: %s", err)
+	}
+	return s, nil
+}
+
+// resumable reports whether s follows hdr. Directories are always
+// extracted again, as their modes are only set once everything is.
+func (s *ResumeState) resumable(hdr *tar.Header) bool {
+	return s != nil && hdr.Typeflag != tar.TypeDir
+}
+
+// Done reports whether hdr was extracted to destPath by an earlier run
+// and is still there: a regular file of the same size and hash, or
+// anything for other members. A nil state has nothing done.
+func (s *ResumeState) Done(hdr *tar.Header, destPath string) bool {
+	if !s.resumable(hdr) {
+		return false
+	}
+	rec, ok := s.done[hdr.Name]
+	if !ok || rec.Size != hdr.Size {
+		return false
+	}
+	info, err := os.Lstat(destPath)
+	if err != nil {
+		return false
+	}
+	if rec.SHA256 == "" {
+		return true
+	}
+	if !info.Mode().IsRegular() || info.Size() != rec.Size {
+		return false
+	}
+	f, err := os.Open(destPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == rec.SHA256
+}
+
+// record appends hdr, whose content hashed to sum when it is a regular
+// file, to the state file, which is created on first use.
+func (s *ResumeState) record(hdr *tar.Header, sum hash.Hash) error {
+	if !s.resumable(hdr) {
+		return nil
+	}
+	var line []byte
+	if s.f == nil {
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Error creating the resume state file: %s", err)
+		}
+		s.f = f
+		// Start a new line after any cut short.
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			line = []byte{'\n'}
+		}
+	}
+	rec := ResumeRecord{Name: hdr.Name, Size: hdr.Size}
+	if sum != nil {
+		rec.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("Error writing the resume state file: %s", err)
+	}
+	// One write per line, so an interruption loses at most the last one.
+	line = append(append(line, data...), '\n')
+	if _, err := s.f.Write(line); err != nil {
+		return fmt.Errorf("Error writing the resume state file: %s", err)
+	}
+	s.done[hdr.Name] = rec
+	return nil
+}
+
+// Close closes the state file, keeping it for the next run.
+func (s *ResumeState) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// Remove closes and removes the state file, once the extraction it
+// tracks has completed.
+func (s *ResumeState) Remove() error {
+	s.Close()
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing the resume state file: %s", err)
+	}
+	return nil
+}
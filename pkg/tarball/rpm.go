@@ -0,0 +1,39 @@
+package tarball
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// RPMMagic starts the lead of RPM packages.
+const RPMMagic = "\xed\xab\xee\xdb"
+
+// RPMPayload reads the lead and the signature and main headers of the RPM
+// package in r and returns r at the start of its payload, a cpio archive
+// compressed as the package chose.
+func RPMPayload(r io.Reader) (io.Reader, error) {
+	lead := make([]byte, 96)
+	if _, err := io.ReadFull(r, lead); err != nil || string(lead[:4]) != RPMMagic {
+		return nil, fmt.Errorf("Error reading the RPM package: not an RPM package")
+	}
+	// The signature header is padded to 8 bytes; the main header is not.
+	for _, pad := range []bool{true, false} {
+		intro := make([]byte, 16)
+		if _, err := io.ReadFull(r, intro); err != nil {
+			return nil, fmt.Errorf("Error reading the RPM package: %s", err)
+		}
+		if string(intro[:3]) != "\x8e\xad\xe8" {
+			return nil, fmt.Errorf("Error reading the RPM package: invalid header")
+		}
+		n := int64(binary.BigEndian.Uint32(intro[8:]))*16 + int64(binary.BigEndian.Uint32(intro[12:]))
+		if pad {
+			n += -(16 + n) & 7
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+			return nil, fmt.Errorf("Error reading the RPM package: %s", err)
+		}
+	}
+	return r, nil
+}
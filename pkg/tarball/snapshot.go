@@ -0,0 +1,158 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dumpdirKey is the PAX record listing the entries a directory held when
+// an incremental tarball was made, separated by NUL bytes.
+const dumpdirKey = "TARBALL.dumpdir"
+
+// SnapshotRecord identifies the state of a file when it was archived.
+type SnapshotRecord struct {
+	Path    string `json:"path"`
+	Dev     uint64 `json:"dev"`
+	Ino     uint64 `json:"ino"`
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+}
+
+// Snapshot drives incremental backups like GNU tar's --listed-incremental:
+// it holds the files archived by the previous run, so unchanged ones are
+// skipped, and collects the state of every file seen by this run.
+type Snapshot struct {
+	prev map[string]SnapshotRecord
+	next map[string]SnapshotRecord
+}
+
+// LoadSnapshot reads a snapshot file of JSON lines. A missing file yields
+// an empty snapshot, which makes a full (level 0) backup.
+func LoadSnapshot(snapshotPath string) (*Snapshot, error) {
+	s := &Snapshot{prev: make(map[string]SnapshotRecord), next: make(map[string]SnapshotRecord)}
+	f, err := os.Open(snapshotPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the snapshot file: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var rec SnapshotRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("Error parsing the snapshot file: %s", err)
+		}
+		s.prev[rec.Path] = rec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the snapshot file: %s", err)
+	}
+	return s, nil
+}
+
+// Save writes the state of the files seen by this run to snapshotPath, for
+// the next incremental backup.
+func (s *Snapshot) Save(snapshotPath string) error {
+	paths := make([]string, 0, len(s.next))
+	for p := range s.next {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	f, err := os.Create(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("Error creating the snapshot file: %s", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, p := range paths {
+		if err := enc.Encode(s.next[p]); err != nil {
+			f.Close()
+			return fmt.Errorf("Error writing the snapshot file: %s", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing the snapshot file: %s", err)
+	}
+	return f.Close()
+}
+
+// changed records the state of p and reports whether it differs from the
+// previous run.
+func (s *Snapshot) changed(p string, info os.FileInfo) bool {
+	dev, ino := fileID(info)
+	rec := SnapshotRecord{
+		Path:    filepath.Clean(p),
+		Dev:     dev,
+		Ino:     ino,
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+	}
+	s.next[rec.Path] = rec
+	prev, ok := s.prev[rec.Path]
+	return !ok || prev != rec
+}
+
+// addDumpdir records the entries of directory p in header, so an
+// incremental extraction can remove what was deleted since the last run.
+func addDumpdir(header *tar.Header, p string) error {
+	d, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("Error reading directory %s: %s", p, err)
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return fmt.Errorf("Error reading directory %s: %s", p, err)
+	}
+	sort.Strings(names)
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[dumpdirKey] = strings.Join(names, "\x00")
+	header.Format = tar.FormatPAX
+	return nil
+}
+
+// pruneDir removes the entries of dir that the directory member hdr does
+// not list, when it carries a listing.
+func pruneDir(hdr *tar.Header, dir string) error {
+	listing, ok := hdr.PAXRecords[dumpdirKey]
+	if !ok {
+		return nil
+	}
+	keep := make(map[string]bool)
+	for _, name := range strings.Split(listing, "\x00") {
+		keep[name] = true
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !keep[name] {
+			if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+				return fmt.Errorf("Error removing %s: %s", filepath.Join(dir, name), err)
+			}
+		}
+	}
+	return nil
+}
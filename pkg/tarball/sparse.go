@@ -0,0 +1,200 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sparseRegion is a run of data in a sparse file; the rest is holes.
+type sparseRegion struct {
+	offset, length int64
+}
+
+// writeSparse writes the regular file src as a GNU sparse member in the
+// PAX 1.0 format, holding only its data regions, and reports whether it
+// did. Files without holes, or on systems where holes cannot be found, are
+// left for the caller to write as usual. archive/tar reads sparse members
+// but cannot write them, so the blocks are written here, between the
+// members tw writes.
+func (a *Archiver) writeSparse(header *tar.Header, src string) (bool, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return false, fmt.Errorf("Error opening the file %s: %s", src, err)
+	}
+	defer f.Close()
+	regions, err := dataRegions(f, header.Size)
+	if err != nil || regions == nil {
+		return false, nil
+	}
+
+	// The member starts with the map of the regions, padded to a block.
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	stored := int64(0)
+	for _, r := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", r.offset, r.length)
+		stored += r.length
+	}
+	sparseMap.Write(make([]byte, blockPadding(int64(sparseMap.Len()))))
+	size := int64(sparseMap.Len()) + stored
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     header.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(header.Size, 10),
+	}
+	for k, v := range header.PAXRecords {
+		records[k] = v
+	}
+	dir, file := path.Split(header.Name)
+	fake := *header
+	fake.Name = path.Join(dir, "GNUSparseFile.0", file)
+	fake.Size = size
+	main := ustarHeader(&fake, tar.TypeReg, records)
+	paxName := path.Join(dir, "PaxHeaders.0", file)
+	pax := ustarHeader(&tar.Header{Name: paxName, Mode: 0644, Size: int64(len(paxRecords(records))), ModTime: header.ModTime}, tar.TypeXHeader, nil)
+
+	if err := a.tw.Flush(); err != nil {
+		return false, fmt.Errorf("Error writing the tarball: %s", err)
+	}
+	body := paxRecords(records)
+	out := [][]byte{pax, body, make([]byte, blockPadding(int64(len(body)))), main, sparseMap.Bytes()}
+	for _, b := range out {
+		if _, err := a.cw.Write(b); err != nil {
+			return false, fmt.Errorf("Error writing the file header for %s: %s", header.Name, err)
+		}
+	}
+	for _, r := range regions {
+		n, err := io.Copy(a.cw, io.NewSectionReader(f, r.offset, r.length))
+		if err == nil && n != r.length {
+			err = fmt.Errorf("the file changed while being read")
+		}
+		if err != nil {
+			return false, fmt.Errorf("Error copying the file content of %s: %s", src, err)
+		}
+	}
+	if _, err := a.cw.Write(make([]byte, blockPadding(stored))); err != nil {
+		return false, fmt.Errorf("Error writing the tarball: %s", err)
+	}
+	return true, nil
+}
+
+func blockPadding(n int64) int64 {
+	return -n & 511
+}
+
+// paxRecords formats records as the body of a PAX extended header, sorted
+// by key so the output is reproducible.
+func paxRecords(records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		// The length prefix counts its own digits.
+		rec := " " + k + "=" + records[k] + "\n"
+		n := len(rec)
+		for n < len(strconv.Itoa(n))+len(rec) {
+			n = len(strconv.Itoa(n)) + len(rec)
+		}
+		b.WriteString(strconv.Itoa(n) + rec)
+	}
+	return b.Bytes()
+}
+
+// ustarHeader formats hdr as a ustar header block with typeflag. Values
+// that do not fit are added to records, when given, as PAX records, and
+// left zero or truncated in the block.
+func ustarHeader(hdr *tar.Header, typeflag byte, records map[string]string) []byte {
+	block := make([]byte, 512)
+	str := func(field []byte, s, key string) {
+		if len(s) > len(field) && records != nil {
+			records[key] = s
+		}
+		copy(field, s)
+	}
+	num := func(field []byte, n int64, key string) {
+		digits := strconv.FormatInt(n, 8)
+		if n < 0 || len(digits) > len(field)-1 {
+			if records != nil {
+				records[key] = strconv.FormatInt(n, 10)
+			}
+			digits = "0"
+		}
+		for len(digits) < len(field)-1 {
+			digits = "0" + digits
+		}
+		copy(field, digits)
+	}
+	str(block[0:100], hdr.Name, "path")
+	num(block[100:108], hdr.Mode&07777, "mode")
+	num(block[108:116], int64(hdr.Uid), "uid")
+	num(block[116:124], int64(hdr.Gid), "gid")
+	num(block[124:136], hdr.Size, "size")
+	num(block[136:148], hdr.ModTime.Unix(), "mtime")
+	block[156] = typeflag
+	copy(block[257:265], "ustar\x0000")
+	str(block[265:297], hdr.Uname, "uname")
+	str(block[297:329], hdr.Gname, "gname")
+
+	copy(block[148:156], "        ")
+	sum := 0
+	for _, b := range block {
+		sum += int(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+// isSparse reports whether hdr is a sparse member, in any of the GNU
+// formats.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// copySparse copies size bytes from r to f, seeking over the blocks of
+// zeros instead of writing them so the file system leaves holes.
+func copySparse(f *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, 4096)
+	zero := make([]byte, len(buf))
+	for off := int64(0); off < size; {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			var werr error
+			if bytes.Equal(buf[:n], zero[:n]) {
+				_, werr = f.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, werr = f.Write(buf[:n])
+			}
+			if werr != nil {
+				return werr
+			}
+			off += int64(n)
+		}
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && off == size) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	// A file ending in a hole gets its size here.
+	return f.Truncate(size)
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package tarball
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataRegions returns the data regions of f, found with SEEK_DATA and
+// SEEK_HOLE, or nil when f has no holes or they cannot be found. A file
+// ending in a hole gets an empty region at its end, as GNU tar writes.
+func dataRegions(f *os.File, size int64) ([]sparseRegion, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// A file using all its blocks has no holes worth looking for.
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || st.Blocks*512 >= size {
+		return nil, nil
+	}
+	var regions []sparseRegion
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, seekData)
+		if err != nil {
+			if err.(*os.PathError).Err == syscall.ENXIO {
+				break
+			}
+			return nil, err
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+		regions = append(regions, sparseRegion{data, hole - data})
+		off = hole
+	}
+	if len(regions) == 1 && regions[0].offset == 0 && regions[0].length == size {
+		return nil, nil
+	}
+	if n := len(regions); n == 0 || regions[n-1].offset+regions[n-1].length < size {
+		regions = append(regions, sparseRegion{size, 0})
+	}
+	return regions, nil
+}
+
+// preallocate reserves size bytes of disk for f without changing its
+// size, so that it is written contiguously. File systems without
+// fallocate are left to allocate as usual.
+func preallocate(f *os.File, size int64) {
+	const keepSize = 1 // FALLOC_FL_KEEP_SIZE
+	syscall.Fallocate(int(f.Fd()), keepSize, 0, size)
+}
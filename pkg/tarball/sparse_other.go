@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package tarball
+
+import "os"
+
+// dataRegions cannot find holes here, so files are stored in full.
+func dataRegions(f *os.File, size int64) ([]sparseRegion, error) {
+	return nil, nil
+}
+
+// preallocate does nothing where fallocate is not available.
+func preallocate(f *os.File, size int64) {}
@@ -0,0 +1,54 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestArchiverWritesSparse(t *testing.T) {
+	inRoot(t, func(string) {
+		f, err := os.Create("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte("start"), 0)
+		f.WriteAt([]byte("end"), sparseSize-3)
+		f.Close()
+		if info, err := os.Stat("s"); err != nil || info.Size() != sparseSize {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		a := NewArchiver(&buf)
+		a.Sparse = true
+		if err := a.AddPath("s"); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() > 64<<10 {
+			t.Skipf("no holes found in the file: the tarball takes %d bytes", buf.Len())
+		}
+
+		tr := tar.NewReader(&buf)
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "s" || hdr.Size != sparseSize {
+			t.Fatalf("got member %s of %d bytes, want s of %d", hdr.Name, hdr.Size, sparseSize)
+		}
+		got, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := ioutil.ReadFile("s")
+		if !bytes.Equal(got, want) {
+			t.Error("the content read back differs from the file")
+		}
+	})
+}
@@ -0,0 +1,24 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package tarball
+
+import "os"
+
+// fileID is not available here; changes are told by size and mtime alone.
+func fileID(info os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
+
+// chownLike does nothing where files have no numeric owners.
+func chownLike(f *os.File, info os.FileInfo) {}
+
+// linkCount reports every file as having a single link.
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
+
+// umask is 0 where there is no file mode creation mask.
+func umask() os.FileMode {
+	return 0
+}
@@ -0,0 +1,41 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package tarball
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode numbers of a file, which tell a file
+// replaced by another apart even when size and mtime match.
+func fileID(info os.FileInfo) (uint64, uint64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino)
+	}
+	return 0, 0
+}
+
+// chownLike gives f the owner and group of the file described by info.
+// Only root may give files away, so failing to is not an error.
+func chownLike(f *os.File, info os.FileInfo) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		f.Chown(int(st.Uid), int(st.Gid))
+	}
+}
+
+// linkCount returns the number of hard links to a file.
+func linkCount(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// umask returns the file mode creation mask of the process.
+func umask() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask)
+}
@@ -0,0 +1,152 @@
+// Package tarball implements the archive operations behind the tar command:
+// creating, appending to, extracting, listing, updating and deleting from
+// tarballs. Archiver writes members, Extractor restores them to disk or a
+// stream, Lister walks the headers and Editor rewrites an existing tarball
+// in place.
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fileEntry is a member of a tarball and its extent, from its first
+// extension header to the end of its padded data, so it can be copied
+// block for block.
+type fileEntry struct {
+	Header     *tar.Header
+	Start, End int64
+}
+
+// scanMembers walks the blocks of the tarball in f and returns its members
+// with their extents. archive/tar cannot write sparse members, and expands
+// them when copied through it, so Editor copies the raw blocks instead.
+func scanMembers(f io.ReaderAt) ([]*fileEntry, error) {
+	var members []*fileEntry
+	block := make([]byte, 512)
+	start, pos := int64(0), int64(0)
+	override := int64(-1)
+	for {
+		if _, err := f.ReadAt(block, pos); err == io.EOF {
+			return members, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		if bytes.Equal(block, make([]byte, 512)) {
+			return members, nil
+		}
+		size, err := parseNumeric(block[124:136])
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		pos += 512
+		typeflag := block[156]
+		switch typeflag {
+		case tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			// Extension headers belong to the member that follows.
+			if typeflag == tar.TypeXHeader {
+				data := make([]byte, size)
+				if _, err := f.ReadAt(data, pos); err != nil {
+					return nil, fmt.Errorf("Error reading the tarball header: %s", err)
+				}
+				if n, ok := paxSize(data); ok {
+					override = n
+				}
+			}
+			pos += size + blockPadding(size)
+			continue
+		case tar.TypeGNUSparse:
+			// Old GNU sparse headers may go on in extension blocks.
+			for extended := block[482] != 0; extended; extended = block[504] != 0 {
+				if _, err := f.ReadAt(block, pos); err != nil {
+					return nil, fmt.Errorf("Error reading the tarball header: %s", err)
+				}
+				pos += 512
+			}
+		}
+		if override >= 0 {
+			size = override
+		}
+		switch typeflag {
+		case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+			size = 0
+		}
+		pos += size + blockPadding(size)
+		header, err := tar.NewReader(io.NewSectionReader(f, start, pos-start)).Next()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the tarball header: %s", err)
+		}
+		members = append(members, &fileEntry{Header: header, Start: start, End: pos})
+		start, override = pos, -1
+	}
+}
+
+// parseNumeric parses a numeric header field, in octal or, with the high
+// bit of its first byte set, in base-256.
+func parseNumeric(field []byte) (int64, error) {
+	if len(field) > 0 && field[0]&0x80 != 0 {
+		n := int64(field[0] & 0x7f)
+		for _, b := range field[1:] {
+			if n > (1<<63-1)>>8 {
+				return 0, fmt.Errorf("numeric field out of range")
+			}
+			n = n<<8 | int64(b)
+		}
+		return n, nil
+	}
+	s := strings.Trim(string(field), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 8, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid numeric field %q", s)
+	}
+	return n, nil
+}
+
+// paxSize returns the size record of the PAX extended header data, if any.
+func paxSize(data []byte) (int64, bool) {
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return 0, false
+		}
+		n, err := strconv.Atoi(string(data[:sp]))
+		if err != nil || n <= sp || n > len(data) {
+			return 0, false
+		}
+		rec := strings.TrimSuffix(string(data[sp+1:n]), "\n")
+		if strings.HasPrefix(rec, "size=") {
+			size, err := strconv.ParseInt(rec[len("size="):], 10, 64)
+			return size, err == nil && size >= 0
+		}
+		data = data[n:]
+	}
+	return 0, false
+}
+
+func sortedKeys(m map[string]*fileEntry) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		partsI := strings.Split(keys[i], string(os.PathSeparator))
+		partsJ := strings.Split(keys[j], string(os.PathSeparator))
+		for k := 0; k < len(partsI) && k < len(partsJ); k++ {
+			if partsI[k] == partsJ[k] {
+				continue
+			}
+			return partsI[k] < partsJ[k]
+		}
+		return len(partsI) < len(partsJ)
+	})
+	return keys
+}
@@ -0,0 +1,209 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Transform renames members with a sed-style s/regexp/replacement/flags
+// expression, as GNU tar --transform does.
+type Transform struct {
+	re   *regexp.Regexp
+	repl string
+	// nth is the match replaced first, and global replaces those after it.
+	nth    int
+	global bool
+	// Regular, Symlinks and Hardlinks select whether member names, the
+	// targets of symbolic links and the targets of hard links are renamed.
+	Regular   bool
+	Symlinks  bool
+	Hardlinks bool
+}
+
+// ParseTransform parses expr. Any character may delimit its parts. The
+// regular expression is a POSIX basic one unless the x flag is given; the
+// other flags are g, i, a number N to start replacing at the Nth match,
+// and r, s and h, or R, S and H, to apply the expression, or not, to
+// member names, symbolic link targets and hard link targets. The
+// replacement may refer to the match with & and to groups with \1 to \9.
+func ParseTransform(expr string) (*Transform, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return nil, fmt.Errorf("Invalid transform %q: expected s/regexp/replacement/flags", expr)
+	}
+	delim := expr[1]
+	var parts []string
+	var part strings.Builder
+	for i := 2; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case c == '\\' && i+1 < len(expr) && expr[i+1] == delim:
+			part.WriteByte(delim)
+			i++
+		case c == '\\' && i+1 < len(expr):
+			part.WriteByte(c)
+			part.WriteByte(expr[i+1])
+			i++
+		case c == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(c)
+		}
+	}
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid transform %q: expected s/regexp/replacement/flags", expr)
+	}
+	t := &Transform{repl: parts[1], nth: 1, Regular: true, Symlinks: true, Hardlinks: true}
+	pattern, extended, fold := parts[0], false, false
+	flags := part.String()
+	for i := 0; i < len(flags); i++ {
+		switch c := flags[i]; c {
+		case 'g':
+			t.global = true
+		case 'i':
+			fold = true
+		case 'x':
+			extended = true
+		case 'r', 'R':
+			t.Regular = c == 'r'
+		case 's', 'S':
+			t.Symlinks = c == 's'
+		case 'h', 'H':
+			t.Hardlinks = c == 'h'
+		default:
+			if c < '0' || c > '9' {
+				return nil, fmt.Errorf("Invalid transform %q: unknown flag %c", expr, c)
+			}
+			j := i
+			for j < len(flags) && '0' <= flags[j] && flags[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(flags[i:j])
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("Invalid transform %q: bad match number", expr)
+			}
+			t.nth, i = n, j-1
+		}
+	}
+	if !extended {
+		pattern = basicRegexp(pattern)
+	}
+	if fold {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid transform %q: %s", expr, err)
+	}
+	t.re = re
+	return t, nil
+}
+
+// PrefixTransform returns a Transform putting members, and the targets of
+// hard links, below dir.
+func PrefixTransform(dir string) *Transform {
+	repl := strings.NewReplacer(`\`, `\\`, `&`, `\&`).Replace(strings.TrimSuffix(dir, "/") + "/")
+	return &Transform{re: regexp.MustCompile(`^`), repl: repl, nth: 1, Regular: true, Hardlinks: true}
+}
+
+// basicRegexp translates a POSIX basic regular expression, where \( \)
+// \{ \} \| \+ and \? are operators and the bare characters are literal, to
+// the syntax of the regexp package.
+func basicRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern) && strings.IndexByte("(){}|+?", pattern[i+1]) >= 0:
+			b.WriteByte(pattern[i+1])
+			i++
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c)
+			b.WriteByte(pattern[i+1])
+			i++
+		case strings.IndexByte("(){}|+?", c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Apply returns name with the expression applied.
+func (t *Transform) Apply(name string) string {
+	matches := t.re.FindAllStringSubmatchIndex(name, -1)
+	var b strings.Builder
+	last := 0
+	for i, m := range matches {
+		if i+1 < t.nth || i+1 > t.nth && !t.global {
+			continue
+		}
+		b.WriteString(name[last:m[0]])
+		t.expand(&b, name, m)
+		last = m[1]
+	}
+	b.WriteString(name[last:])
+	return b.String()
+}
+
+// expand writes the replacement for the match m of name.
+func (t *Transform) expand(b *strings.Builder, name string, m []int) {
+	for i := 0; i < len(t.repl); i++ {
+		c := t.repl[i]
+		switch {
+		case c == '&':
+			b.WriteString(name[m[0]:m[1]])
+		case c == '\\' && i+1 < len(t.repl):
+			i++
+			if d := t.repl[i]; '1' <= d && d <= '9' {
+				if g := int(d - '0'); 2*g+1 < len(m) && m[2*g] >= 0 {
+					b.WriteString(name[m[2*g]:m[2*g+1]])
+				}
+			} else if d == 'n' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(d)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// rename applies transforms in turn to name, which is a member name for
+// typeflag tar.TypeReg, or the target of a link of that type.
+func rename(transforms []*Transform, name string, typeflag byte) string {
+	for _, t := range transforms {
+		switch typeflag {
+		case tar.TypeSymlink:
+			if !t.Symlinks {
+				continue
+			}
+		case tar.TypeLink:
+			if !t.Hardlinks {
+				continue
+			}
+		default:
+			if !t.Regular {
+				continue
+			}
+		}
+		name = t.Apply(name)
+	}
+	return name
+}
+
+// renameHeader renames the member hdr and the target of its link.
+func renameHeader(transforms []*Transform, hdr *tar.Header) {
+	if len(transforms) == 0 {
+		return
+	}
+	hdr.Name = rename(transforms, hdr.Name, tar.TypeReg)
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname = rename(transforms, hdr.Linkname, hdr.Typeflag)
+	}
+}
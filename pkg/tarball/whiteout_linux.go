@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package tarball
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// overlayWhiteout marks target as deleted using the overlayfs convention of
+// a character device with device number 0/0.
+func overlayWhiteout(target string) error {
+	if err := syscall.Mknod(target, syscall.S_IFCHR, 0); err != nil {
+		return fmt.Errorf("Error creating whiteout device %s: %s", target, err)
+	}
+	return nil
+}
+
+// overlayOpaque marks dir as opaque so lower layers do not show through.
+func overlayOpaque(dir string) error {
+	if err := syscall.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		return fmt.Errorf("Error marking %s opaque: %s", dir, err)
+	}
+	return nil
+}
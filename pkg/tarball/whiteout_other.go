@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package tarball
+
+import "fmt"
+
+func overlayWhiteout(target string) error {
+	return fmt.Errorf("Overlay whiteouts are only supported on Linux: %s", target)
+}
+
+func overlayOpaque(dir string) error {
+	return fmt.Errorf("Overlay whiteouts are only supported on Linux: %s", dir)
+}
@@ -0,0 +1,86 @@
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// xattrPrefix starts the PAX records holding extended attributes, as GNU
+// tar and star write them.
+const xattrPrefix = "SCHILY.xattr."
+
+// DefaultXattrs are the extended attributes an XattrFilter without
+// Include selects.
+var DefaultXattrs = []string{"user.*", "security.*"}
+
+// MacMetadata matches the extended attributes macOS keeps its metadata
+// in, among them the resource fork (com.apple.ResourceFork) and the
+// Finder flags (com.apple.FinderInfo).
+const MacMetadata = "com.apple.*"
+
+// XattrFilter selects extended attributes by name with path.Match
+// patterns. Without Include, the user.* and security.* attributes are
+// selected; Exclude then removes names from the selection.
+type XattrFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (f *XattrFilter) match(name string) bool {
+	include := f.Include
+	if len(include) == 0 {
+		include = DefaultXattrs
+	}
+	return matchAny(include, name) && !matchAny(f.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addXattrs stores the extended attributes of src selected by a.Xattrs
+// in header.
+func (a *Archiver) addXattrs(header *tar.Header, src string) error {
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	attrs, err := getXattrs(src)
+	if err != nil {
+		return fmt.Errorf("Error reading the extended attributes of %s: %s", src, err)
+	}
+	for name, value := range attrs {
+		if !a.Xattrs.match(name) {
+			continue
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[xattrPrefix+name] = value
+	}
+	return nil
+}
+
+// setXattrs restores on destPath the extended attributes of hdr selected
+// by e.Xattrs. Those that cannot be set, as security.* ones without
+// privileges, are listed in e.Skipped.
+func (e *Extractor) setXattrs(hdr *tar.Header, destPath string) {
+	for k, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, xattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, xattrPrefix)
+		if !e.Xattrs.match(name) {
+			continue
+		}
+		if err := setXattr(destPath, name, value); err != nil {
+			e.Skipped = append(e.Skipped, fmt.Sprintf("%s: extended attribute %s: %s", hdr.Name, name, err))
+		}
+	}
+}
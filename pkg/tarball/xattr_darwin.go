@@ -0,0 +1,92 @@
+//go:build darwin
+// +build darwin
+
+package tarball
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+// xattrNoFollow is XATTR_NOFOLLOW; the attributes of a symbolic link are
+// never those of its target.
+const xattrNoFollow = 1
+
+// getXattrs returns the extended attributes of the file at p, such as the
+// resource fork and Finder information, or none where the file system
+// does not support them.
+func getXattrs(p string) (map[string]string, error) {
+	size, err := xattrCall(syscall.SYS_LISTXATTR, p, "", nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	list := make([]byte, size)
+	if size, err = xattrCall(syscall.SYS_LISTXATTR, p, "", list); err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]string)
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(p, string(name))
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = string(value)
+	}
+	return attrs, nil
+}
+
+// getXattr returns the extended attribute name of the file at p, or nil
+// when it has none.
+func getXattr(p, name string) ([]byte, error) {
+	n, err := xattrCall(syscall.SYS_GETXATTR, p, name, nil)
+	if err == syscall.ENOATTR || err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	value := make([]byte, n)
+	if n, err = xattrCall(syscall.SYS_GETXATTR, p, name, value); err != nil {
+		return nil, err
+	}
+	return value[:n], nil
+}
+
+func setXattr(p, name, value string) error {
+	_, err := xattrCall(syscall.SYS_SETXATTR, p, name, []byte(value))
+	return err
+}
+
+// xattrCall makes the listxattr, getxattr or setxattr call trap on p,
+// which take the same arguments but for the attribute name listxattr
+// goes without.
+func xattrCall(trap uintptr, p, name string, buf []byte) (int, error) {
+	pp, err := syscall.BytePtrFromString(p)
+	if err != nil {
+		return 0, err
+	}
+	var ptr unsafe.Pointer
+	if len(buf) > 0 {
+		ptr = unsafe.Pointer(&buf[0])
+	}
+	var n uintptr
+	var errno syscall.Errno
+	if trap == syscall.SYS_LISTXATTR {
+		n, _, errno = syscall.Syscall6(trap, uintptr(unsafe.Pointer(pp)), uintptr(ptr), uintptr(len(buf)), xattrNoFollow, 0, 0)
+	} else {
+		np, err := syscall.BytePtrFromString(name)
+		if err != nil {
+			return 0, err
+		}
+		n, _, errno = syscall.Syscall6(trap, uintptr(unsafe.Pointer(pp)), uintptr(unsafe.Pointer(np)), uintptr(ptr), uintptr(len(buf)), 0, xattrNoFollow)
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package tarball
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// getXattrs returns the extended attributes of the file at p, or none
+// where the file system does not support them.
+func getXattrs(p string) (map[string]string, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(p, list); err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]string)
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(p, string(name))
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = string(value)
+	}
+	return attrs, nil
+}
+
+// getXattr returns the extended attribute name of the file at p, or nil
+// when it has none.
+func getXattr(p, name string) ([]byte, error) {
+	n, err := syscall.Getxattr(p, name, nil)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	value := make([]byte, n)
+	if n, err = syscall.Getxattr(p, name, value); err != nil {
+		return nil, err
+	}
+	return value[:n], nil
+}
+
+func setXattr(p, name, value string) error {
+	return syscall.Setxattr(p, name, []byte(value), 0)
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package tarball
+
+import "errors"
+
+// getXattrs finds no extended attributes on this system.
+func getXattrs(p string) (map[string]string, error) {
+	return nil, nil
+}
+
+func getXattr(p, name string) ([]byte, error) {
+	return nil, nil
+}
+
+func setXattr(p, name, value string) error {
+	return errors.New("extended attributes are not supported on this system")
+}
@@ -0,0 +1,94 @@
+package tarball
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ZipStream returns a tar stream of the entries of the zip file of size
+// bytes in r, so zip files can be listed and extracted like tarballs.
+// Closing the stream stops the conversion.
+func ZipStream(r io.ReaderAt, size int64) (io.ReadCloser, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the zip file: %s", err)
+	}
+	return convert(func(w io.Writer) error { return zipToTar(zr, w) }), nil
+}
+
+// converted is a tar stream written by a goroutine converting another
+// archive format.
+type converted struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// convert returns the tar stream fn writes. Closing it stops fn and waits
+// for it to return, so the source can be closed.
+func convert(fn func(w io.Writer) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	c := &converted{pr, make(chan struct{})}
+	go func() {
+		pw.CloseWithError(fn(pw))
+		close(c.done)
+	}()
+	return c
+}
+
+func (c *converted) Close() error {
+	c.PipeReader.Close()
+	<-c.done
+	return nil
+}
+
+func zipToTar(zr *zip.Reader, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, f := range zr.File {
+		if err := zipEntry(tw, f); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// zipEntry writes the zip entry f to tw as a member. Info-ZIP stores the
+// target of a symbolic link as its content.
+func zipEntry(tw *tar.Writer, f *zip.File) error {
+	mode := f.Mode()
+	header := &tar.Header{
+		Name:     f.Name,
+		Mode:     int64(mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)),
+		ModTime:  f.Modified,
+		Typeflag: tar.TypeReg,
+		Size:     int64(f.UncompressedSize64),
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("Error reading %s from the zip file: %s", f.Name, err)
+	}
+	defer rc.Close()
+	switch {
+	case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+		header.Typeflag, header.Size = tar.TypeDir, 0
+	case mode&os.ModeSymlink != 0:
+		target, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return fmt.Errorf("Error reading %s from the zip file: %s", f.Name, err)
+		}
+		header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, string(target), 0
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("Error converting %s from the zip file: %s", f.Name, err)
+	}
+	if header.Typeflag == tar.TypeReg {
+		if _, err := io.Copy(tw, rc); err != nil {
+			return fmt.Errorf("Error reading %s from the zip file: %s", f.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package tarball
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// NewZipArchiver returns an Archiver writing a zip file to w instead of a
+// tarball, for recipients without tar. Members are selected and named as
+// for a tarball; owners, extended attributes and ACLs are not kept, hard
+// links are stored as copies, and devices and FIFOs are skipped.
+func NewZipArchiver(w io.Writer) *Archiver {
+	return &Archiver{zw: zip.NewWriter(w)}
+}
+
+// writeZip writes header, with content or the content of src, as an entry
+// of the zip file, and reports whether it could.
+func (a *Archiver) writeZip(header *tar.Header, src string, content io.Reader) (bool, error) {
+	fh := &zip.FileHeader{Name: header.Name, Modified: header.ModTime, Method: zip.Deflate}
+	fh.SetMode(header.FileInfo().Mode())
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if !strings.HasSuffix(fh.Name, "/") {
+			fh.Name += "/"
+		}
+		fh.Method = zip.Store
+	case tar.TypeSymlink:
+		// Info-ZIP stores the target as the content of the link.
+		content = strings.NewReader(header.Linkname)
+		fh.Method = zip.Store
+	case tar.TypeReg, tar.TypeRegA:
+		if content == nil {
+			f, err := os.Open(src)
+			if err != nil {
+				return false, fmt.Errorf("Error opening the file %s: %s", src, err)
+			}
+			defer f.Close()
+			content = f
+		}
+	default:
+		a.Skipped = append(a.Skipped, fmt.Sprintf("%s: cannot be stored in a zip file", header.Name))
+		return false, nil
+	}
+	w, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return false, fmt.Errorf("Error writing the zip entry for %s: %s", header.Name, err)
+	}
+	if content != nil {
+		if _, err := io.Copy(w, content); err != nil {
+			return false, fmt.Errorf("Error copying the content of %s: %s", header.Name, err)
+		}
+	}
+	return true, nil
+}